@@ -24,6 +24,7 @@ cd $GOPATH/src/github.com/venicegeo/pz-uuidgen
 # run unit tests w/ coverage collection
 go test -v -coverprofile=$root/uuidgen.cov github.com/venicegeo/pz-uuidgen/uuidgen
 go tool cover -func=$root/uuidgen.cov -o $root/uuidgen.cov.txt
+go test -v github.com/venicegeo/pz-uuidgen/uuidgentest
 
 # run lint
 # sh ci/metalinter.sh | tee $root/lint.txt
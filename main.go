@@ -15,7 +15,10 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
+	"time"
 
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
 	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
@@ -23,7 +26,15 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		bench(os.Args[2:])
+		return
+	}
+
+	serve()
+}
 
+func serve() {
 	required := []piazza.ServiceName{
 		piazza.PzElasticSearch,
 	}
@@ -43,7 +54,12 @@ func main() {
 		log.Fatal(err)
 	}
 
-	kit, err := pzuuidgen.NewKit(sys, logWriter, auditWriter)
+	options, err := pzuuidgen.NewServiceOptionsFromEnv(sys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kit, err := pzuuidgen.NewKitWithOptions(sys, logWriter, auditWriter, options)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -58,3 +74,63 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// bench runs the load-test harness, either against a remote instance
+// (-url) or against a Kit started in this process (-local).
+func bench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	url := flags.String("url", "", "base URL of the pz-uuidgen instance to test")
+	apiKey := flags.String("apikey", "", "API key to send with each request")
+	local := flags.Bool("local", false, "start an in-process server and test against it")
+	concurrency := flags.Int("c", 4, "number of concurrent workers")
+	batchSize := flags.Int("n", 1, "number of uuids per request")
+	duration := flags.Duration("d", 10*time.Second, "how long to run")
+	_ = flags.Parse(args)
+
+	config := &pzuuidgen.BenchConfig{
+		Concurrency: *concurrency,
+		BatchSize:   *batchSize,
+		Duration:    *duration,
+	}
+
+	var result *pzuuidgen.BenchResult
+	var err error
+
+	switch {
+	case *local:
+		var sys *piazza.SystemConfig
+		sys, err = piazza.NewSystemConfig(piazza.PzUuidgen, []piazza.ServiceName{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		var kit *pzuuidgen.Kit
+		kit, err = pzuuidgen.NewKit(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = kit.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, err = kit.Bench(config)
+		_ = kit.Stop()
+	case *url != "":
+		var client *pzuuidgen.Client
+		client, err = pzuuidgen.NewClient(*url, *apiKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, err = pzuuidgen.RunBench(client, config)
+	default:
+		log.Fatal("bench: one of -url or -local is required")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	result.Report(os.Stdout)
+
+	if result.Duplicates > 0 || result.Invalid > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IBlockClient leases blocks of integer ranges; Client implements it.
+type IBlockClient interface {
+	LeaseBlockContext(ctx context.Context, name string, size int, holder string) (*BlockLease, error)
+	ReleaseBlockContext(ctx context.Context, lease *BlockLease, used int64) (*BlockLease, error)
+}
+
+// ErrAllocatorClosed is returned by a BlockAllocator after Close.
+var ErrAllocatorClosed = errors.New("block allocator is closed")
+
+// AllocatorOptions controls how a BlockAllocator leases blocks.
+type AllocatorOptions struct {
+	// BlockSize is the number of values asked for in each lease.
+	BlockSize int
+
+	// LowWater is the number of values left below which the next block
+	// is leased in the background.
+	LowWater int
+
+	// Holder is recorded against each lease.
+	Holder string
+
+	// Timeout bounds each lease and release request.
+	Timeout time.Duration
+}
+
+func DefaultAllocatorOptions() *AllocatorOptions {
+	return &AllocatorOptions{
+		BlockSize: DefaultBlockSize,
+		LowWater:  DefaultBlockSize / 10,
+		Timeout:   10 * time.Second,
+	}
+}
+
+// BlockAllocator hands out the values of a named range from leased blocks,
+// without a request per value, and leases the next block before the
+// current one runs out. Values are unique, and increase within a block,
+// but a value not handed out before Close is never used. It is safe for
+// concurrent use.
+type BlockAllocator struct {
+	sync.Mutex
+	client  IBlockClient
+	name    string
+	options AllocatorOptions
+	blocks  []*BlockLease // blocks[0] is in use
+	next    int64         // the next value of blocks[0]
+	lastErr error
+	fetch   chan struct{} // non-nil while a lease is being fetched; closed when it ends
+	closed  bool
+}
+
+func NewBlockAllocator(client IBlockClient, name string, options *AllocatorOptions) (*BlockAllocator, error) {
+	if options.BlockSize < 1 || options.BlockSize > MaxBlockSize {
+		return nil, fmt.Errorf("block size out of range: %d", options.BlockSize)
+	}
+	if options.LowWater < 0 || options.LowWater >= options.BlockSize {
+		return nil, fmt.Errorf("low water out of range: %d", options.LowWater)
+	}
+
+	a := &BlockAllocator{
+		client:  client,
+		name:    name,
+		options: *options,
+	}
+
+	a.Lock()
+	a.startFetch()
+	a.Unlock()
+
+	return a, nil
+}
+
+// remaining must be called with the lock held.
+func (a *BlockAllocator) remaining() int64 {
+	var n int64
+	for i, block := range a.blocks {
+		if i == 0 {
+			n += block.Last - a.next + 1
+		} else {
+			n += block.Last - block.First + 1
+		}
+	}
+	return n
+}
+
+// startFetch must be called with the lock held. It returns a channel that
+// is closed when the current fetch ends.
+func (a *BlockAllocator) startFetch() chan struct{} {
+	if a.fetch != nil {
+		return a.fetch
+	}
+	done := make(chan struct{})
+	a.fetch = done
+	go a.doFetch(done)
+	return done
+}
+
+func (a *BlockAllocator) doFetch(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.options.Timeout)
+	lease, err := a.client.LeaseBlockContext(ctx, a.name, a.options.BlockSize, a.options.Holder)
+	cancel()
+
+	a.Lock()
+	closed := a.closed
+	if err == nil && !closed {
+		if len(a.blocks) == 0 {
+			a.next = lease.First
+		}
+		a.blocks = append(a.blocks, lease)
+	}
+	a.lastErr = err
+	a.fetch = nil
+	a.Unlock()
+	close(done)
+
+	if err == nil && closed {
+		a.release(lease, 0)
+	}
+}
+
+// release ends the lease on a block, saying how much of it was used.
+func (a *BlockAllocator) release(lease *BlockLease, used int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.options.Timeout)
+	defer cancel()
+	_, err := a.client.ReleaseBlockContext(ctx, lease, used)
+	return err
+}
+
+// Next returns the next value, waiting for a lease only if every leased
+// value has been handed out. A lease error is reported only then.
+func (a *BlockAllocator) Next(ctx context.Context) (int64, error) {
+	for {
+		a.Lock()
+		if a.closed {
+			a.Unlock()
+			return 0, ErrAllocatorClosed
+		}
+		for len(a.blocks) > 0 && a.next > a.blocks[0].Last {
+			spent := a.blocks[0]
+			a.blocks = a.blocks[1:]
+			if len(a.blocks) > 0 {
+				a.next = a.blocks[0].First
+			}
+			go a.release(spent, spent.Last-spent.First+1)
+		}
+		if len(a.blocks) > 0 {
+			v := a.next
+			a.next++
+			if a.remaining() < int64(a.options.LowWater) {
+				a.startFetch()
+			}
+			a.Unlock()
+			return v, nil
+		}
+		done := a.startFetch()
+		a.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+
+		a.Lock()
+		err := a.lastErr
+		empty := len(a.blocks) == 0
+		a.Unlock()
+		if err != nil && empty {
+			return 0, err
+		}
+	}
+}
+
+// Close releases the leased blocks, saying how much of each was used. The
+// values left in them are lost.
+func (a *BlockAllocator) Close() error {
+	a.Lock()
+	if a.closed {
+		a.Unlock()
+		return nil
+	}
+	a.closed = true
+	blocks := a.blocks
+	next := a.next
+	a.blocks = nil
+	a.Unlock()
+
+	var firstErr error
+	for i, block := range blocks {
+		var used int64
+		if i == 0 {
+			used = next - block.First
+		}
+		err := a.release(block, used)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,207 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BalancePolicy says how a client spreads requests across its base URLs.
+type BalancePolicy int
+
+const (
+	// RoundRobin takes each healthy endpoint in turn.
+	RoundRobin BalancePolicy = iota
+
+	// LeastLatency takes the healthy endpoint with the lowest recent
+	// latency. An endpoint not yet measured counts as the mean of the
+	// others, and ties are taken in turn.
+	LeastLatency
+)
+
+// EndpointStatus describes one of a client's base URLs, for health reporting.
+type EndpointStatus struct {
+	Url     string        `json:"url"`
+	Healthy bool          `json:"healthy"`
+	Latency time.Duration `json:"latency"`
+	Breaker string        `json:"breaker"`
+}
+
+//---------------------------------------------------------------------
+
+type endpoint struct {
+	url          string
+	breaker      *Breaker
+	latency      time.Duration // moving average; zero until measured
+	failures     int           // consecutive
+	ejectedUntil time.Time
+}
+
+// balancer picks an endpoint for each attempt. An endpoint that fails
+// ejectAfter times in a row is skipped for ejectFor; if every endpoint is
+// ejected, the one due back soonest is used anyway. Each endpoint has its
+// own circuit breaker, so one that is down doesn't stop the others being
+// used.
+type balancer struct {
+	sync.Mutex
+	endpoints  []*endpoint
+	policy     BalancePolicy
+	next       int
+	ejectAfter int
+	ejectFor   time.Duration
+}
+
+func newBalancer(urls []string, options *ClientOptions) (*balancer, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("at least one pz-uuidgen url is required")
+	}
+
+	b := &balancer{
+		policy:     options.Balance,
+		ejectAfter: options.EjectAfter,
+		ejectFor:   options.EjectFor,
+	}
+	for _, url := range urls {
+		url = strings.TrimRight(url, "/")
+		if url == "" {
+			return nil, errors.New("empty pz-uuidgen url")
+		}
+		b.endpoints = append(b.endpoints, &endpoint{
+			url:     url,
+			breaker: NewBreaker(options.BreakerThreshold, options.BreakerCooldown),
+		})
+	}
+	return b, nil
+}
+
+// pick returns the endpoint to use next, or nil if every endpoint's
+// breaker is open.
+func (b *balancer) pick() *endpoint {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	n := len(b.endpoints)
+
+	// healthy endpoints in turn, from next
+	var healthy, ejected []*endpoint
+	for i := 0; i < n; i++ {
+		ep := b.endpoints[(b.next+i)%n]
+		if now.Before(ep.ejectedUntil) {
+			ejected = append(ejected, ep)
+		} else {
+			healthy = append(healthy, ep)
+		}
+	}
+
+	if b.policy == LeastLatency {
+		var sum time.Duration
+		var measured int
+		for _, ep := range healthy {
+			if ep.latency > 0 {
+				sum += ep.latency
+				measured++
+			}
+		}
+		var mean time.Duration
+		if measured > 0 {
+			mean = sum / time.Duration(measured)
+		}
+		latency := func(ep *endpoint) time.Duration {
+			if ep.latency == 0 {
+				return mean
+			}
+			return ep.latency
+		}
+		sort.SliceStable(healthy, func(i, j int) bool { return latency(healthy[i]) < latency(healthy[j]) })
+	}
+
+	// if everything is ejected, try whichever comes back first
+	sort.SliceStable(ejected, func(i, j int) bool { return ejected[i].ejectedUntil.Before(ejected[j].ejectedUntil) })
+
+	for _, ep := range append(healthy, ejected...) {
+		if ep.breaker.Allow() {
+			for i, e := range b.endpoints {
+				if e == ep {
+					b.next = (i + 1) % n
+				}
+			}
+			return ep
+		}
+	}
+	return nil
+}
+
+// breakerState sums up the endpoints' breakers: closed if any is, else
+// half-open if any is, else open.
+func (b *balancer) breakerState() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+
+	state := BreakerOpen
+	for _, ep := range b.endpoints {
+		switch ep.breaker.State() {
+		case BreakerClosed:
+			return BreakerClosed
+		case BreakerHalfOpen:
+			state = BreakerHalfOpen
+		}
+	}
+	return state
+}
+
+func (b *balancer) success(ep *endpoint, latency time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	ep.failures = 0
+	ep.ejectedUntil = time.Time{}
+	if ep.latency == 0 {
+		ep.latency = latency
+	} else {
+		ep.latency = (ep.latency*7 + latency) / 8
+	}
+}
+
+func (b *balancer) failure(ep *endpoint) {
+	b.Lock()
+	defer b.Unlock()
+
+	ep.failures++
+	if b.ejectAfter > 0 && ep.failures >= b.ejectAfter {
+		ep.ejectedUntil = time.Now().Add(b.ejectFor)
+	}
+}
+
+func (b *balancer) status() []EndpointStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	out := make([]EndpointStatus, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		out[i] = EndpointStatus{
+			Url:     ep.url,
+			Healthy: !now.Before(ep.ejectedUntil),
+			Latency: ep.latency,
+			Breaker: ep.breaker.State().String(),
+		}
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import "fmt"
+
+// Crockford's base32: no I, L, O or U, and case-insensitive on input, with
+// I and L read as 1 and O as 0. See http://www.crockford.com/base32.html.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var crockfordValues [256]byte
+
+func init() {
+	for i := range crockfordValues {
+		crockfordValues[i] = 0xff
+	}
+	for i := 0; i < len(crockfordAlphabet); i++ {
+		c := crockfordAlphabet[i]
+		crockfordValues[c] = byte(i)
+		if c >= 'A' && c <= 'Z' {
+			crockfordValues[c+'a'-'A'] = byte(i)
+		}
+	}
+	for _, c := range "IiLl" {
+		crockfordValues[c] = 1
+	}
+	for _, c := range "Oo" {
+		crockfordValues[c] = 0
+	}
+}
+
+// crockfordLen is the number of characters needed for n bytes.
+func crockfordLen(n int) int {
+	return (n*8 + 4) / 5
+}
+
+// encodeCrockford writes src into dst, as a big-endian number, most
+// significant digit first. dst is usually crockfordLen(len(src)) long; the
+// top digit then carries the spare bits, which are zero.
+func encodeCrockford(dst []byte, src []byte) {
+	acc, nbits := uint(0), uint(0)
+	j := len(src) - 1
+	for i := len(dst) - 1; i >= 0; i-- {
+		for nbits < 5 && j >= 0 {
+			acc |= uint(src[j]) << nbits
+			nbits += 8
+			j--
+		}
+		dst[i] = crockfordAlphabet[acc&0x1f]
+		acc >>= 5
+		if nbits < 5 {
+			nbits = 0
+		} else {
+			nbits -= 5
+		}
+	}
+}
+
+// decodeCrockford is the inverse of encodeCrockford, into n bytes. It
+// fails on a character outside the alphabet, or a value that needs more
+// than n bytes.
+func decodeCrockford(s string, n int) ([]byte, error) {
+	dst := make([]byte, n)
+	acc, nbits := uint(0), uint(0)
+	j := n - 1
+	for i := len(s) - 1; i >= 0; i-- {
+		v := crockfordValues[s[i]]
+		if v == 0xff {
+			return nil, fmt.Errorf("invalid base32 character: %q", s[i])
+		}
+		acc |= uint(v) << nbits
+		nbits += 5
+		for nbits >= 8 && j >= 0 {
+			dst[j] = byte(acc)
+			acc >>= 8
+			nbits -= 8
+			j--
+		}
+		if j < 0 && acc != 0 {
+			return nil, fmt.Errorf("base32 value too large for %d bytes", n)
+		}
+	}
+	if j >= 0 {
+		dst[j] = byte(acc)
+	}
+	return dst, nil
+}
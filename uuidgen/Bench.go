@@ -0,0 +1,257 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------
+
+// BenchConfig describes one load-test run: how many workers to run at once,
+// how many IDs each request asks for, and how long to keep going.
+type BenchConfig struct {
+	Concurrency int
+	BatchSize   int
+	Duration    time.Duration
+}
+
+// BenchResult holds what was observed during a load-test run.
+type BenchResult struct {
+	Config      BenchConfig
+	Elapsed     time.Duration
+	NumRequests int
+	NumErrors   int
+	NumUUIDs    int
+	Duplicates  int
+	Invalid     int
+	FirstError  error
+	Latency     *LatencyHistogram
+}
+
+func (config *BenchConfig) validate() error {
+	if config.Concurrency < 1 {
+		return errors.New("bench: concurrency must be at least 1")
+	}
+	if config.BatchSize < 1 {
+		return errors.New("bench: batch size must be at least 1")
+	}
+	if config.Duration <= 0 {
+		return errors.New("bench: duration must be positive")
+	}
+	return nil
+}
+
+// RunBench drives the given client with config.Concurrency workers, each
+// repeatedly posting for config.BatchSize IDs until config.Duration has passed.
+// Every returned ID is checked for validity and for duplicates across the
+// whole run.
+func RunBench(client IClient, config *BenchConfig) (*BenchResult, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BenchResult{
+		Config:  *config,
+		Latency: NewLatencyHistogram(),
+	}
+
+	var mutex sync.Mutex
+	seen := map[string]bool{}
+
+	record := func(latency time.Duration, uuids *[]string, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		result.NumRequests++
+		result.Latency.Record(latency)
+
+		if err != nil {
+			result.NumErrors++
+			if result.FirstError == nil {
+				result.FirstError = err
+			}
+			return
+		}
+
+		for _, uuid := range *uuids {
+			result.NumUUIDs++
+			if !ValidUuidV4(uuid) {
+				result.Invalid++
+			}
+			if seen[uuid] {
+				result.Duplicates++
+			}
+			seen[uuid] = true
+		}
+	}
+
+	start := time.Now()
+	deadline := start.Add(config.Duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				t0 := time.Now()
+				uuids, err := client.PostUuids(config.BatchSize)
+				record(time.Since(t0), uuids, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+
+	return result, nil
+}
+
+// Throughput returns the number of IDs received per second.
+func (result *BenchResult) Throughput() float64 {
+	if result.Elapsed <= 0 {
+		return 0.0
+	}
+	return float64(result.NumUUIDs) / result.Elapsed.Seconds()
+}
+
+// RequestRate returns the number of requests completed per second.
+func (result *BenchResult) RequestRate() float64 {
+	if result.Elapsed <= 0 {
+		return 0.0
+	}
+	return float64(result.NumRequests) / result.Elapsed.Seconds()
+}
+
+// Report writes a human-readable summary of the run.
+func (result *BenchResult) Report(w io.Writer) {
+	c := result.Config
+	fmt.Fprintf(w, "concurrency: %d, batch size: %d, duration: %s\n", c.Concurrency, c.BatchSize, c.Duration)
+	fmt.Fprintf(w, "elapsed:     %s\n", result.Elapsed)
+	fmt.Fprintf(w, "requests:    %d (%.1f/sec)\n", result.NumRequests, result.RequestRate())
+	fmt.Fprintf(w, "uuids:       %d (%.1f/sec)\n", result.NumUUIDs, result.Throughput())
+	fmt.Fprintf(w, "errors:      %d\n", result.NumErrors)
+	fmt.Fprintf(w, "duplicates:  %d\n", result.Duplicates)
+	fmt.Fprintf(w, "invalid:     %d\n", result.Invalid)
+	if result.FirstError != nil {
+		fmt.Fprintf(w, "first error: %s\n", result.FirstError.Error())
+	}
+	fmt.Fprintf(w, "latency:\n")
+	result.Latency.Report(w)
+}
+
+//---------------------------------------------------------------------
+
+// latencyBuckets are the upper bounds of the histogram buckets; anything
+// slower than the last bound lands in the overflow bucket.
+var latencyBuckets = []time.Duration{
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	5 * time.Second,
+}
+
+// LatencyHistogram counts latencies into fixed, roughly logarithmic buckets.
+// It is not safe for concurrent use.
+type LatencyHistogram struct {
+	Counts []int
+	Count  int
+	Min    time.Duration
+	Max    time.Duration
+	Total  time.Duration
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		Counts: make([]int, len(latencyBuckets)+1),
+	}
+}
+
+func (h *LatencyHistogram) Record(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Count++
+	h.Total += d
+}
+
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// Percentile returns the upper bound of the bucket holding the p-th
+// percentile (0 < p <= 100). For the overflow bucket, Max is returned.
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	target := int(float64(h.Count)*p/100.0 + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	sum := 0
+	for i, n := range h.Counts {
+		sum += n
+		if sum >= target {
+			if i < len(latencyBuckets) {
+				return latencyBuckets[i]
+			}
+			break
+		}
+	}
+	return h.Max
+}
+
+func (h *LatencyHistogram) Report(w io.Writer) {
+	fmt.Fprintf(w, "  min %s, mean %s, max %s\n", h.Min, h.Mean(), h.Max)
+	fmt.Fprintf(w, "  p50 <= %s, p90 <= %s, p99 <= %s\n", h.Percentile(50), h.Percentile(90), h.Percentile(99))
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		label := "> " + latencyBuckets[len(latencyBuckets)-1].String()
+		if i < len(latencyBuckets) {
+			label = "<= " + latencyBuckets[i].String()
+		}
+		fmt.Fprintf(w, "  %10s  %d\n", label, n)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by the client, without contacting the server,
+// while the circuit breakers of all its base URLs are open.
+var ErrCircuitOpen = errors.New("pz-uuidgen circuit breaker is open")
+
+//---------------------------------------------------------------------
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+//---------------------------------------------------------------------
+
+// Breaker is a simple consecutive-failure circuit breaker. After threshold
+// failures in a row it opens and rejects every call; once cooldown has
+// passed it lets a single probe call through (half-open), and that call's
+// outcome decides whether it closes again or goes back to open.
+//
+// A threshold of zero disables the breaker.
+type Breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     BreakerState
+	failures  int
+	openedOn  time.Time
+	probing   bool
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+// Allow reports whether a call may be made now.
+func (b *Breaker) Allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedOn) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Success records a call that reached a healthy server.
+func (b *Breaker) Success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	b.state = BreakerClosed
+}
+
+// Release records a call whose outcome says nothing about the server,
+// such as one the caller cancelled. A half-open breaker may probe again.
+func (b *Breaker) Release() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+}
+
+// Failure records a call that failed because of a network error or a 5xx.
+func (b *Breaker) Failure() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if b.state == BreakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = BreakerOpen
+		b.openedOn = time.Now()
+	}
+}
+
+// State returns the current state, for health reporting.
+func (b *Breaker) State() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedOn) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
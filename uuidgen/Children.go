@@ -0,0 +1,250 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// Child IDs are issued from a parent ID, and remember it.
+const (
+	// a v5 UUID over the parent and an index: anyone can work out the
+	// children of an ID, and asking again gives the same ones
+	ChildDerived = "derived"
+
+	// v4 UUIDs, linked to the parent only by the service's records
+	ChildRandom = "random"
+
+	// no ancestry is followed further than this
+	maxAncestry = 64
+)
+
+// ChildRequest is the body of a POST to /uuids/{id}/children.
+type ChildRequest struct {
+	Count int    `json:"count"`
+	Mode  string `json:"mode"`  // ChildDerived (the default) or ChildRandom
+	Start int    `json:"start"` // first index, for derived children; default 1
+}
+
+// ChildUuid is the derived child of parent with the given index: the
+// version 5 UUID with parent as its namespace and the index, in decimal,
+// as its name.
+func ChildUuid(parent string, index int) (string, error) {
+	namespace, ok := parseUuid(parent)
+	if !ok {
+		return "", fmt.Errorf("invalid uuid: %s", parent)
+	}
+	h := sha1.New()
+	h.Write(namespace)
+	h.Write([]byte(strconv.Itoa(index)))
+	sum := h.Sum(nil)
+
+	b := sum[:16]
+	b[6] = (b[6] & 0x0f) | 0x50 // Version 5
+	b[8] = (b[8] & 0x3f) | 0x80 // Variant is 10
+
+	out := make([]byte, 36)
+	encodeUuid(out, b)
+	return string(out), nil
+}
+
+//---------------------------------------------------------------------
+
+// PostChildren issues child IDs of parent, which must not be revoked. The
+// parent need not be recorded: plain issued IDs aren't.
+func (service *Service) PostChildren(parent string, request *ChildRequest) *piazza.JsonResponse {
+	parent = strings.ToLower(parent)
+	if !ValidUuid(parent) {
+		return service.newErrorResponse(http.StatusBadRequest, "invalid uuid: "+parent)
+	}
+	if request.Count == 0 {
+		request.Count = 1
+	}
+	if request.Count < 0 || request.Count > service.maxCount {
+		s := fmt.Sprintf("count out of range: %d", request.Count)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+	if request.Start == 0 {
+		request.Start = 1
+	}
+	if request.Start < 0 {
+		s := fmt.Sprintf("start out of range: %d", request.Start)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+
+	record, err := service.ids.Get(parent)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if record != nil && record.Revoked {
+		return service.newErrorResponse(http.StatusConflict, "uuid is revoked: "+parent)
+	}
+	if record == nil {
+		// it is linked now, so record it for the ancestry of its children
+		now := time.Now()
+		_, err = service.ids.Insert([]*IdRecord{{Uuid: parent, State: IdIssued, CreatedOn: now, UpdatedOn: now}})
+		if err != nil {
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	var uuids []string
+	switch request.Mode {
+	case "", ChildDerived:
+		uuids, err = service.derivedChildren(parent, request.Start, request.Count)
+	case ChildRandom:
+		uuids, err = service.randomChildren(parent, request.Count)
+	default:
+		return service.newErrorResponse(http.StatusBadRequest, "invalid mode: "+request.Mode)
+	}
+	if err != nil {
+		if conflict, ok := err.(*conflictError); ok {
+			return service.newErrorResponse(http.StatusConflict, conflict.Error())
+		}
+		_ = service.syslogger.Error("uuidgen could not make child uuids: %s", err.Error())
+		return service.newErrorResponse(http.StatusServiceUnavailable, err.Error())
+	}
+
+	atomic.AddInt64(&service.numUUIDs, int64(len(uuids)))
+	atomic.AddInt64(&service.numRequests, 1)
+
+	return &piazza.JsonResponse{StatusCode: http.StatusCreated, Type: stringListType, Data: uuids}
+}
+
+// derivedChildren records the children with indexes start onwards. Those
+// already recorded are returned again, as long as they were recorded as
+// the same children of the same parent.
+func (service *Service) derivedChildren(parent string, start int, count int) ([]string, error) {
+	now := time.Now()
+	uuids := make([]string, count)
+	records := make([]*IdRecord, count)
+	for i := range uuids {
+		uuid, err := ChildUuid(parent, start+i)
+		if err != nil {
+			return nil, err
+		}
+		uuids[i] = uuid
+		records[i] = &IdRecord{Uuid: uuid, State: IdIssued, CreatedOn: now, UpdatedOn: now, Parent: parent, Index: start + i}
+	}
+
+	existing, err := service.ids.Insert(records)
+	if err != nil {
+		return nil, err
+	}
+	for _, uuid := range existing {
+		record, err := service.ids.Get(uuid)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			continue
+		}
+		if record.Parent != parent {
+			return nil, &conflictError{fmt.Sprintf("uuid %s is already in use", uuid)}
+		}
+		if record.Revoked {
+			return nil, &conflictError{fmt.Sprintf("child uuid %s is revoked", uuid)}
+		}
+	}
+	return uuids, nil
+}
+
+func (service *Service) randomChildren(parent string, count int) ([]string, error) {
+	uuids, err := service.randomUuids(count)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return service.recordNew(uuids, service.randomUuids, func(uuid string) *IdRecord {
+		return &IdRecord{Uuid: uuid, State: IdIssued, CreatedOn: now, UpdatedOn: now, Parent: parent}
+	})
+}
+
+// GetChildren lists the recorded children of an ID, derived ones first,
+// by index, then the rest in the order they were issued. It is empty for
+// an ID with no children.
+func (service *Service) GetChildren(parent string) *piazza.JsonResponse {
+	parent = strings.ToLower(parent)
+	if !ValidUuid(parent) {
+		return service.newErrorResponse(http.StatusBadRequest, "invalid uuid: "+parent)
+	}
+
+	children, err := service.ids.Children(parent)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if (a.Index == 0) != (b.Index == 0) {
+			return a.Index != 0
+		}
+		if a.Index != b.Index {
+			return a.Index < b.Index
+		}
+		if !a.CreatedOn.Equal(b.CreatedOn) {
+			return a.CreatedOn.Before(b.CreatedOn)
+		}
+		return a.Uuid < b.Uuid
+	})
+
+	return service.idRecordListResponse(children)
+}
+
+// GetAncestry lists the ancestors of an ID: its parent first, and the
+// root last. It is empty for an ID with no recorded parent.
+func (service *Service) GetAncestry(uuid string) *piazza.JsonResponse {
+	uuid = strings.ToLower(uuid)
+	if !ValidUuid(uuid) {
+		return service.newErrorResponse(http.StatusBadRequest, "invalid uuid: "+uuid)
+	}
+	record, err := service.ids.Get(uuid)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	ancestors := []*IdRecord{}
+	for record != nil && record.Parent != "" && len(ancestors) < maxAncestry {
+		record, err = service.ids.Get(record.Parent)
+		if err != nil {
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		if record != nil {
+			ancestors = append(ancestors, record)
+		}
+	}
+
+	return service.idRecordListResponse(ancestors)
+}
+
+func (service *Service) idRecordListResponse(records []*IdRecord) *piazza.JsonResponse {
+	if records == nil {
+		records = []*IdRecord{}
+	}
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: records}
+	err := resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
@@ -0,0 +1,165 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChildUuid(t *testing.T) {
+	assert := assert.New(t)
+
+	// as any v5 implementation would make them, with the DNS namespace
+	dns := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	child, err := ChildUuid(dns, 1)
+	assert.NoError(err)
+	assert.Equal("b04965e6-a9bb-591f-8f8a-1adcb2c8dc39", child)
+	child, err = ChildUuid(dns, 42)
+	assert.NoError(err)
+	assert.Equal("7c411b5e-9d3f-50b5-9c28-62096e41c4ed", child)
+
+	_, err = ChildUuid("not-a-uuid", 1)
+	assert.Error(err)
+}
+
+func TestChildren(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+
+	// a plain issued ID isn't recorded until it has children
+	root := service.generateUuids(1).Data.([]string)[0]
+	record, err := service.ids.Get(root)
+	assert.NoError(err)
+	assert.Nil(record)
+	resp := service.GetId(root)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(IdIssued, resp.Data.(*IdRecord).State)
+	resp = service.GetChildren(root)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Len(resp.Data.([]*IdRecord), 0)
+
+	resp = service.PostChildren(root, &ChildRequest{Count: 3})
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	derived := resp.Data.([]string)
+	for i, uuid := range derived {
+		want, _ := ChildUuid(root, i+1)
+		assert.Equal(want, uuid)
+	}
+
+	// asking again gives the same children
+	resp = service.PostChildren(root, &ChildRequest{Count: 2, Start: 2})
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal(derived[1:], resp.Data.([]string))
+
+	resp = service.PostChildren(root, &ChildRequest{Count: 2, Mode: ChildRandom})
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	random := resp.Data.([]string)
+	assert.True(ValidUuidV4(random[0]))
+
+	resp = service.PostChildren(derived[0], &ChildRequest{Mode: ChildRandom})
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	grandchild := resp.Data.([]string)[0]
+
+	resp = service.GetChildren(root)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	children := resp.Data.([]*IdRecord)
+	assert.Len(children, 5)
+	for i := 0; i < 3; i++ {
+		assert.Equal(derived[i], children[i].Uuid)
+		assert.Equal(i+1, children[i].Index)
+	}
+	assert.Equal(root, children[4].Parent)
+
+	resp = service.GetAncestry(grandchild)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	ancestors := resp.Data.([]*IdRecord)
+	assert.Len(ancestors, 2)
+	assert.Equal(derived[0], ancestors[0].Uuid)
+	assert.Equal(root, ancestors[1].Uuid)
+
+	resp = service.GetAncestry(root)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Len(resp.Data.([]*IdRecord), 0)
+
+	// a revoked parent has no more children; a revoked child isn't reissued
+	service.adminKey = "secret"
+	service.PostRevocation("secret", strings.ToUpper(derived[2]), &RevocationRequest{Actor: "test", Reason: "spill"})
+	resp = service.PostChildren(derived[2], &ChildRequest{})
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+	resp = service.PostChildren(root, &ChildRequest{Count: 3})
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+
+	resp = service.PostChildren(root, &ChildRequest{Mode: "sideways"})
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestIdStoreChildren(t *testing.T) {
+	assert := assert.New(t)
+
+	elastic, err := NewElasticIdStore(NewMockDocumentIndex())
+	assert.NoError(err)
+
+	parent := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	for _, store := range []IdStore{NewMemoryIdStore(), elastic} {
+		_, err = store.Insert([]*IdRecord{
+			{Uuid: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", State: IdIssued, Parent: parent, Index: 1},
+			{Uuid: "6ba7b812-9dad-11d1-80b4-00c04fd430c8", State: IdIssued, Parent: parent},
+			{Uuid: "6ba7b813-9dad-11d1-80b4-00c04fd430c8", State: IdClaimed},
+		})
+		assert.NoError(err)
+
+		children, err := store.Children(parent)
+		assert.NoError(err)
+		assert.Len(children, 2)
+
+		children, err = store.Children("6ba7b813-9dad-11d1-80b4-00c04fd430c8")
+		assert.NoError(err)
+		assert.Empty(children)
+
+		// only the new record goes in
+		existing, err := store.Insert([]*IdRecord{
+			{Uuid: "6ba7b813-9dad-11d1-80b4-00c04fd430c8", State: IdReserved},
+			{Uuid: "6ba7b814-9dad-11d1-80b4-00c04fd430c8", State: IdClaimed},
+		})
+		assert.NoError(err)
+		assert.Equal([]string{"6ba7b813-9dad-11d1-80b4-00c04fd430c8"}, existing)
+		known, err := store.Known([]string{"6ba7b814-9dad-11d1-80b4-00c04fd430c8", parent})
+		assert.NoError(err)
+		assert.Equal([]string{"6ba7b814-9dad-11d1-80b4-00c04fd430c8"}, known)
+
+		// moving a child moves the link
+		record, err := store.Update("6ba7b812-9dad-11d1-80b4-00c04fd430c8", func(r *IdRecord) error {
+			r.Parent = "6ba7b813-9dad-11d1-80b4-00c04fd430c8"
+			return nil
+		})
+		assert.NoError(err)
+		assert.Equal("6ba7b813-9dad-11d1-80b4-00c04fd430c8", record.Parent)
+		children, err = store.Children(parent)
+		assert.NoError(err)
+		assert.Len(children, 1)
+		record, err = store.Get("6ba7b812-9dad-11d1-80b4-00c04fd430c8")
+		assert.NoError(err)
+		assert.Equal(IdIssued, record.State)
+
+		record, err = store.Update("6ba7b815-9dad-11d1-80b4-00c04fd430c8", func(r *IdRecord) error { return nil })
+		assert.NoError(err)
+		assert.Nil(record)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const nilUuid = "00000000-0000-0000-0000-000000000000"
+
+// ClaimRequest proposes IDs minted outside the service. Owner identifies
+// the caller: claiming an ID it already owns is not a conflict.
+type ClaimRequest struct {
+	Uuids []string `json:"uuids"`
+	Owner string   `json:"owner"`
+}
+
+// ClaimConflict is an ID that could not be claimed, and why: "issued",
+// "claimed" (by another owner), "reserved" and so on, or "revoked".
+type ClaimConflict struct {
+	Uuid   string `json:"uuid"`
+	Reason string `json:"reason"`
+}
+
+// ClaimResult reports, for each proposed ID, whether it is now the
+// caller's. IDs are reported in lower case.
+type ClaimResult struct {
+	Claimed   []string        `json:"claimed"`
+	Conflicts []ClaimConflict `json:"conflicts,omitempty"`
+	Invalid   []string        `json:"invalid,omitempty"`
+}
+
+//---------------------------------------------------------------------
+
+// PostClaims registers caller-proposed IDs. The ones nobody has, and that
+// were never issued here, are registered in one atomic step; the rest are
+// reported, each with the reason. From then on, claimed IDs are looked up, revoked and protected
+// from reuse just as issued ones are.
+func (service *Service) PostClaims(request *ClaimRequest) *piazza.JsonResponse {
+	if request.Owner == "" {
+		return service.newErrorResponse(http.StatusBadRequest, "owner is required")
+	}
+	if len(request.Uuids) > service.maxCount {
+		s := fmt.Sprintf("too many uuids: %d", len(request.Uuids))
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+
+	result, err := service.claim(request.Uuids, request.Owner)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	_ = service.syslogger.Info("uuidgen claimed %d uuids for %s, %d conflicts", len(result.Claimed), request.Owner, len(result.Conflicts))
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: result}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// claim is shared by claims and registrations.
+func (service *Service) claim(uuids []string, owner string) (*ClaimResult, error) {
+	result := &ClaimResult{Claimed: []string{}}
+
+	now := time.Now()
+	seen := map[string]bool{}
+	var candidates []string
+	var records []*IdRecord
+	for _, uuid := range uuids {
+		uuid = strings.ToLower(uuid)
+		if !ValidUuid(uuid) || uuid == nilUuid {
+			result.Invalid = append(result.Invalid, uuid)
+			continue
+		}
+		if seen[uuid] {
+			continue
+		}
+		seen[uuid] = true
+		candidates = append(candidates, uuid)
+	}
+
+	// IDs issued without a record can't be claimed
+	issued, err := service.issued.Find(candidates)
+	if err != nil {
+		return nil, err
+	}
+	for _, uuid := range candidates {
+		if _, ok := issued[uuid]; ok {
+			reason := string(IdIssued)
+			record, err := service.ids.Get(uuid)
+			if err != nil {
+				return nil, err
+			}
+			if record != nil && record.Revoked {
+				reason = "revoked"
+			}
+			result.Conflicts = append(result.Conflicts, ClaimConflict{Uuid: uuid, Reason: reason})
+			continue
+		}
+		records = append(records, &IdRecord{
+			Uuid:      uuid,
+			State:     IdClaimed,
+			Owner:     owner,
+			CreatedOn: now,
+			UpdatedOn: now,
+		})
+	}
+
+	existing, err := service.ids.Insert(records)
+	if err != nil {
+		return nil, err
+	}
+	taken := map[string]bool{}
+	for _, uuid := range existing {
+		taken[uuid] = true
+	}
+
+	for _, r := range records {
+		if !taken[r.Uuid] {
+			result.Claimed = append(result.Claimed, r.Uuid)
+			continue
+		}
+
+		current, err := service.ids.Get(r.Uuid)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case current == nil:
+			// can't happen with a store that never deletes
+			return nil, fmt.Errorf("record vanished: %s", r.Uuid)
+		case current.Revoked:
+			result.Conflicts = append(result.Conflicts, ClaimConflict{Uuid: r.Uuid, Reason: "revoked"})
+		case current.State == IdClaimed && current.Owner == owner:
+			result.Claimed = append(result.Claimed, r.Uuid)
+		default:
+			result.Conflicts = append(result.Conflicts, ClaimConflict{Uuid: r.Uuid, Reason: string(current.State)})
+		}
+	}
+
+	atomic.AddInt64(&service.numRegistered, int64(len(records)-len(existing)))
+
+	return result, nil
+}
+
+// recordNew adds records, made by newRecord, for freshly generated IDs.
+// Any ID that turns out to be taken already, e.g. by a claim, is replaced
+// by another from generate. It returns the IDs as recorded.
+func (service *Service) recordNew(uuids []string, generate func(int) ([]string, error), newRecord func(uuid string) *IdRecord) ([]string, error) {
+	out := make([]string, 0, len(uuids))
+	pending := uuids
+
+	for len(pending) > 0 {
+		records := make([]*IdRecord, len(pending))
+		for i, uuid := range pending {
+			records[i] = newRecord(uuid)
+		}
+		existing, err := service.ids.Insert(records)
+		if err != nil {
+			return nil, err
+		}
+
+		taken := map[string]bool{}
+		for _, uuid := range existing {
+			taken[uuid] = true
+		}
+		for _, uuid := range pending {
+			if !taken[uuid] {
+				out = append(out, uuid)
+			}
+		}
+		if len(existing) == 0 {
+			break
+		}
+
+		_ = service.syslogger.Warning("uuidgen generated %d uuids already known; replacing them", len(existing))
+		pending, err = generate(len(existing))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// skipKnown replaces any of the freshly generated uuids that the store
+// already has, e.g. because they were claimed, with others from generate.
+// Unlike recordNew it records nothing. It costs a lookup, so it is only for
+// IDs with too few random bits to rule out a claim getting there first.
+func (service *Service) skipKnown(uuids []string, generate func(int) ([]string, error)) ([]string, error) {
+	out := make([]string, 0, len(uuids))
+	pending := uuids
+
+	for len(pending) > 0 {
+		known, err := service.ids.Known(pending)
+		if err != nil {
+			return nil, err
+		}
+
+		taken := map[string]bool{}
+		for _, uuid := range known {
+			taken[uuid] = true
+		}
+		for _, uuid := range pending {
+			if !taken[uuid] {
+				out = append(out, uuid)
+			}
+		}
+		if len(known) == 0 {
+			break
+		}
+
+		_ = service.syslogger.Warning("uuidgen generated %d uuids already known; replacing them", len(known))
+		pending, err = generate(len(known))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
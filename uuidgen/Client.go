@@ -15,18 +15,116 @@
 package uuidgen
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
 )
 
+// ClientOptions controls how hard the client tries before giving up.
+type ClientOptions struct {
+	// Timeout bounds each individual attempt; zero means no limit
+	// beyond the caller's context.
+	Timeout time.Duration
+
+	// MaxRetries is the number of extra attempts made after a network
+	// error or a 5xx response.
+	MaxRetries int
+
+	// Retries wait a random time between zero and
+	// min(MaxBackoff, BaseBackoff * 2^attempt).
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// BreakerThreshold is the number of consecutive failed attempts that
+	// opens a base URL's circuit breaker; zero disables it.
+	// BreakerCooldown is how long it stays open before a probe call is
+	// let through.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Fallback makes PostUuids generate random UUIDs locally, instead of
+	// failing, when the service cannot be reached or the breaker is open.
+	// Such IDs are queued for registration with the service.
+	Fallback bool
+
+	// Reconcile makes the client register queued local IDs in the
+	// background as soon as the service answers again.
+	Reconcile bool
+
+	// Balance chooses how requests are spread over several base URLs.
+	// An endpoint that fails EjectAfter attempts in a row (zero: never)
+	// is left out for EjectFor.
+	Balance    BalancePolicy
+	EjectAfter int
+	EjectFor   time.Duration
+
+	// MaxParallel bounds how many chunk requests run at once when a
+	// count larger than the server maximum is split up.
+	MaxParallel int
+}
+
+// DefaultClientOptions returns the options used by NewClient.
+func DefaultClientOptions() *ClientOptions {
+	return &ClientOptions{
+		Timeout:          10 * time.Second,
+		MaxRetries:       3,
+		BaseBackoff:      100 * time.Millisecond,
+		MaxBackoff:       2 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+		Balance:          RoundRobin,
+		EjectAfter:       2,
+		EjectFor:         10 * time.Second,
+		MaxParallel:      4,
+	}
+}
+
 type Client struct {
-	h *piazza.Http
+	sync.Mutex
+	balancer    *balancer
+	apiKey      string
+	options     ClientOptions
+	http        *http.Client
+	random      RandomSource
+	pending     []string // locally generated, not yet registered
+	rejected    []string // locally generated, refused by the service
+	reconciling int32
+	maxCount    int // from the server's capabilities; zero until known
+
+	// when the server couldn't be asked, maxCount is DefaultMaxCount
+	// until then
+	maxCountExpires time.Time
+}
+
+// UuidBatch is the result of a POST for UUIDs.
+type UuidBatch struct {
+	Uuids []string
+
+	// Local is set when the IDs were generated by the client, because
+	// the service was unavailable.
+	Local bool
 }
 
 //---------------------------------------------------------------------
 
 func NewClient(url string, apiKey string) (*Client, error) {
+	return NewClientWithOptions(url, apiKey, DefaultClientOptions())
+}
+
+// NewClientWithOptions waits for the service at url to answer before returning.
+func NewClientWithOptions(url string, apiKey string, options *ClientOptions) (*Client, error) {
 	var err error
 
 	err = piazza.WaitForService(piazza.PzUuidgen, url)
@@ -34,27 +132,214 @@ func NewClient(url string, apiKey string) (*Client, error) {
 		return nil, err
 	}
 
-	h := &piazza.Http{
-		BaseUrl: url,
-		ApiKey:  apiKey,
+	return NewLazyClient([]string{url}, apiKey, options)
+}
+
+// NewLazyClient does not contact the service: the first request does. Requests
+// are spread over all the given base URLs according to options.Balance.
+func NewLazyClient(urls []string, apiKey string, options *ClientOptions) (*Client, error) {
+	var _ ICounterClient = new(Client)
+	var _ IBlockClient = new(Client)
+
+	balancer, err := newBalancer(urls, options)
+	if err != nil {
+		return nil, err
 	}
 
 	service := &Client{
-		h: h,
+		balancer: balancer,
+		apiKey:   apiKey,
+		options:  *options,
+		http:     &http.Client{},
+		random:   NewCryptoSource(),
 	}
 	return service, nil
 }
 
+// BreakerState sums up the state of the client's circuit breakers, one
+// per base URL: closed if any is closed, else half-open if any is, else
+// open.
+func (c *Client) BreakerState() BreakerState {
+	return c.balancer.breakerState()
+}
+
+// Endpoints reports the health of each of the client's base URLs.
+func (c *Client) Endpoints() []EndpointStatus {
+	return c.balancer.status()
+}
+
+//---------------------------------------------------------------------
+
+// retryable errors are the ones that say nothing about the request itself
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// isUnavailable reports whether err means the service could not be used
+// at all, as opposed to it rejecting the request.
+func isUnavailable(err error) bool {
+	if err == ErrCircuitOpen {
+		return true
+	}
+	_, ok := err.(*retryableError)
+	return ok
+}
+
+// attempt makes a single request and decodes the JsonResponse it returns.
+func (c *Client) attempt(ctx context.Context, ep *endpoint, verb string, endpoint string, input interface{}, header http.Header) (*piazza.JsonResponse, error) {
+	parent := ctx
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	var body io.Reader
+	if input != nil {
+		byts, err := json.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(byts)
+	}
+
+	req, err := http.NewRequest(verb, ep.url+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", piazza.ContentTypeJSON)
+	if c.apiKey != "" {
+		req.SetBasicAuth(c.apiKey, "")
+	}
+
+	start := time.Now()
+	httpResp, err := c.http.Do(req)
+	if err != nil {
+		if parent.Err() == nil {
+			c.balancer.failure(ep)
+		}
+		return nil, &retryableError{err: err}
+	}
+	defer func() {
+		_ = httpResp.Body.Close()
+	}()
+
+	resp := &piazza.JsonResponse{}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		err = fmt.Errorf("{%d: unable to decode response: %s}", httpResp.StatusCode, err.Error())
+		if httpResp.StatusCode >= 500 {
+			c.balancer.failure(ep)
+			return nil, &retryableError{err: err}
+		}
+		c.balancer.success(ep, time.Since(start))
+		return nil, err
+	}
+	resp.StatusCode = httpResp.StatusCode
+
+	if resp.StatusCode >= 500 {
+		c.balancer.failure(ep)
+		return resp, &retryableError{err: resp.ToError()}
+	}
+	c.balancer.success(ep, time.Since(start))
+	return resp, nil
+}
+
+func (c *Client) backoff(ctx context.Context, attempt int) error {
+	limit := c.options.BaseBackoff << uint(attempt)
+	if limit <= 0 || limit > c.options.MaxBackoff {
+		limit = c.options.MaxBackoff
+	}
+	if limit <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(limit))))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do makes the request, retrying network errors and 5xx responses with
+// jittered exponential backoff. Other errors, and 4xx responses, are
+// returned straight away.
+func (c *Client) do(ctx context.Context, verb string, endpoint string, input interface{}, header http.Header) (*piazza.JsonResponse, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= c.options.MaxRetries; attempt++ {
+		if attempt > 0 {
+			err := c.backoff(ctx, attempt-1)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ep := c.balancer.pick()
+		if ep == nil {
+			return nil, ErrCircuitOpen
+		}
+
+		resp, err := c.attempt(ctx, ep, verb, endpoint, input, header)
+		if err == nil {
+			ep.breaker.Success()
+			return resp, nil
+		}
+
+		if ctx.Err() == context.Canceled {
+			// the caller gave up; that says nothing about the server
+			ep.breaker.Release()
+			return nil, ctx.Err()
+		}
+		if ctx.Err() != nil {
+			// the server didn't answer within the caller's deadline,
+			// which counts against it as the per-attempt timeout would
+			ep.breaker.Failure()
+			return nil, ctx.Err()
+		}
+
+		retryErr, ok := err.(*retryableError)
+		if !ok {
+			ep.breaker.Success()
+			return nil, err
+		}
+
+		ep.breaker.Failure()
+		lastErr = retryErr
+	}
+
+	return nil, lastErr
+}
+
 //---------------------------------------------------------------------
 
 func (c *Client) GetVersion() (*piazza.Version, error) {
-	resp := c.h.PzGet("/version")
+	return c.GetVersionContext(context.Background())
+}
+
+func (c *Client) GetVersionContext(ctx context.Context) (*piazza.Version, error) {
+	resp, err := c.do(ctx, "GET", "/version", nil, nil)
+	if err != nil {
+		return nil, err
+	}
 	if resp.IsError() {
 		return nil, resp.ToError()
 	}
 
 	var version piazza.Version
-	err := resp.ExtractData(&version)
+	err = resp.ExtractData(&version)
 	if err != nil {
 		return nil, err
 	}
@@ -65,10 +350,52 @@ func (c *Client) GetVersion() (*piazza.Version, error) {
 //---------------------------------------------------------------------
 
 func (c *Client) PostUuids(count int) (*[]string, error) {
+	return c.PostUuidsContext(context.Background(), count)
+}
+
+func (c *Client) PostUuidsContext(ctx context.Context, count int) (*[]string, error) {
+	batch, err := c.PostUuidsBatchContext(ctx, count)
+	if batch == nil {
+		return nil, err
+	}
+	return &batch.Uuids, err
+}
+
+// PostUuidsBatchContext is PostUuidsContext, but also reports whether the
+// IDs were generated locally under the Fallback option.
+//
+// Counts above the server's maximum are split into chunks which are
+// requested in parallel. If only some of the chunks succeed, the IDs that
+// were received are returned together with a *PartialError.
+func (c *Client) PostUuidsBatchContext(ctx context.Context, count int) (*UuidBatch, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("query argument out of range: %d", count)
+	}
+
+	max := c.getMaxCount(ctx)
+	if count <= max {
+		return c.postChunk(ctx, count)
+	}
+
+	return c.postChunks(ctx, count, max)
+}
+
+func (c *Client) postChunk(ctx context.Context, count int) (*UuidBatch, error) {
 
 	endpoint := fmt.Sprintf("/uuids?count=%d", count)
 
-	resp := c.h.PzPost(endpoint, nil)
+	// one key for all the attempts, so a retry of a request that got
+	// through but whose response was lost returns the same IDs
+	header := http.Header{}
+	header.Set(IdempotencyHeader, piazza.NewUuid().String())
+
+	resp, err := c.do(ctx, "POST", endpoint, nil, header)
+	if err != nil {
+		if c.options.Fallback && isUnavailable(err) {
+			return c.generateLocally(count)
+		}
+		return nil, err
+	}
 	if resp.IsError() {
 		return nil, resp.ToError()
 	}
@@ -80,26 +407,756 @@ func (c *Client) PostUuids(count int) (*[]string, error) {
 	}
 
 	out := make([]string, count)
-	err := resp.ExtractData(&out)
-	return &out, err
+	err = resp.ExtractData(&out)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.options.Reconcile {
+		c.startReconcile()
+	}
+
+	return &UuidBatch{Uuids: out}, nil
+}
+
+// PartialError is returned when a chunked request got fewer IDs than asked for.
+type PartialError struct {
+	Requested  int
+	Received   int
+	Duplicates int // dropped from the merged result
+	Errors     []error
+}
+
+func (e *PartialError) Error() string {
+	s := fmt.Sprintf("received %d of %d uuids", e.Received, e.Requested)
+	if e.Duplicates > 0 {
+		s += fmt.Sprintf(", %d duplicates dropped", e.Duplicates)
+	}
+	if len(e.Errors) > 0 {
+		s += fmt.Sprintf(", %d chunks failed, first error: %s", len(e.Errors), e.Errors[0].Error())
+	}
+	return s
+}
+
+func (c *Client) postChunks(ctx context.Context, count int, max int) (*UuidBatch, error) {
+	parallel := c.options.MaxParallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var sizes []int
+	for n := count; n > 0; n -= max {
+		if n < max {
+			sizes = append(sizes, n)
+		} else {
+			sizes = append(sizes, max)
+		}
+	}
+
+	batches := make([]*UuidBatch, len(sizes))
+	errs := make([]error, len(sizes))
+
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, size := range sizes {
+		wg.Add(1)
+		go func(i int, size int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			batches[i], errs[i] = c.postChunk(ctx, size)
+			<-sem
+		}(i, size)
+	}
+	wg.Wait()
+
+	result := &UuidBatch{Uuids: make([]string, 0, count)}
+	partial := &PartialError{Requested: count}
+	seen := make(map[string]bool, count)
+
+	for i := range sizes {
+		if errs[i] != nil {
+			partial.Errors = append(partial.Errors, errs[i])
+			continue
+		}
+		result.Local = result.Local || batches[i].Local
+		for _, uuid := range batches[i].Uuids {
+			if seen[uuid] {
+				partial.Duplicates++
+				continue
+			}
+			seen[uuid] = true
+			result.Uuids = append(result.Uuids, uuid)
+		}
+	}
+
+	partial.Received = len(result.Uuids)
+	if partial.Received == count {
+		return result, nil
+	}
+	if partial.Received == 0 {
+		return nil, partial
+	}
+	return result, partial
+}
+
+// maxCountRetry is how long DefaultMaxCount is assumed when the server
+// couldn't be asked for its capabilities.
+const maxCountRetry = time.Minute
+
+// getMaxCount returns the server's maximum count, asking it the first time.
+// Until the server has answered, DefaultMaxCount is assumed; while it can't
+// be reached, it is asked again at most once per maxCountRetry.
+func (c *Client) getMaxCount(ctx context.Context) int {
+	c.Lock()
+	max := c.maxCount
+	expires := c.maxCountExpires
+	c.Unlock()
+	if max > 0 && (expires.IsZero() || time.Now().Before(expires)) {
+		return max
+	}
+
+	capabilities, err := c.GetCapabilitiesContext(ctx)
+	if err != nil {
+		if isUnavailable(err) || ctx.Err() != nil {
+			c.Lock()
+			c.maxCount = DefaultMaxCount
+			c.maxCountExpires = time.Now().Add(maxCountRetry)
+			c.Unlock()
+			return DefaultMaxCount
+		}
+		// an older server, without the endpoint
+		capabilities = &Capabilities{MaxCount: DefaultMaxCount}
+	}
+	if capabilities.MaxCount < 1 {
+		capabilities.MaxCount = DefaultMaxCount
+	}
+
+	c.Lock()
+	c.maxCount = capabilities.MaxCount
+	c.maxCountExpires = time.Time{}
+	c.Unlock()
+
+	return capabilities.MaxCount
+}
+
+func (c *Client) GetCapabilitiesContext(ctx context.Context) (*Capabilities, error) {
+	resp, err := c.do(ctx, "GET", "/capabilities", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &Capabilities{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReserveContext gets count IDs in the reserved state. Each must be
+// confirmed or released within ttl (zero for the server's default), or it
+// is abandoned. A retry after a lost response may leave an extra
+// reservation behind, which is abandoned in turn.
+func (c *Client) ReserveContext(ctx context.Context, count int, ttl time.Duration) (*Reservation, error) {
+	endpoint := fmt.Sprintf("/reservations?count=%d", count)
+	if ttl > 0 {
+		endpoint += "&ttl=" + ttl.String()
+	}
+	return c.doReservation(ctx, "POST", endpoint, nil)
+}
+
+func (c *Client) GetReservationContext(ctx context.Context, id string) (*Reservation, error) {
+	return c.doReservation(ctx, "GET", "/reservations/"+url.PathEscape(id), nil)
+}
+
+// ConfirmContext marks the given IDs of a reservation, or all of them if
+// none are given, as used.
+func (c *Client) ConfirmContext(ctx context.Context, id string, uuids ...string) (*Reservation, error) {
+	return c.doReservation(ctx, "POST", "/reservations/"+url.PathEscape(id)+"/confirm", &Registration{Uuids: uuids})
+}
+
+// ReleaseContext gives back the given IDs of a reservation, or all of them
+// if none are given.
+func (c *Client) ReleaseContext(ctx context.Context, id string, uuids ...string) (*Reservation, error) {
+	return c.doReservation(ctx, "POST", "/reservations/"+url.PathEscape(id)+"/release", &Registration{Uuids: uuids})
+}
+
+func (c *Client) doReservation(ctx context.Context, verb string, endpoint string, input interface{}) (*Reservation, error) {
+	resp, err := c.do(ctx, verb, endpoint, input, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &Reservation{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ClaimContext registers IDs minted by the caller, as owner. The result
+// lists the ones claimed, and why any others were not.
+func (c *Client) ClaimContext(ctx context.Context, uuids []string, owner string) (*ClaimResult, error) {
+	request := &ClaimRequest{Uuids: uuids, Owner: owner}
+	resp, err := c.do(ctx, "POST", "/claims", request, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &ClaimResult{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExportPackContext gets a signed pack of IDs for offline use. The
+// client's API key must be the service's admin key.
+func (c *Client) ExportPackContext(ctx context.Context, request *PackRequest) (*IdPack, error) {
+	resp, err := c.do(ctx, "POST", "/packs", request, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &IdPack{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReconcilePackContext reports which IDs of a pack were used.
+func (c *Client) ReconcilePackContext(ctx context.Context, id string, used []string) (*PackReconciliation, error) {
+	endpoint := "/packs/" + url.PathEscape(id) + "/reconcile"
+	resp, err := c.do(ctx, "POST", endpoint, &Registration{Uuids: used}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &PackReconciliation{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostSignedUuidsContext gets IDs signed in the given mode, SignEmbedded or
+// SignToken.
+func (c *Client) PostSignedUuidsContext(ctx context.Context, count int, mode string) ([]SignedUuid, error) {
+	endpoint := fmt.Sprintf("/signed-uuids?count=%d&mode=%s", count, url.QueryEscape(mode))
+	resp, err := c.do(ctx, "POST", endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	var out []SignedUuid
+	err = resp.ExtractData(&out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// VerifyContext asks the service to check a signed ID. Services that hold
+// the keys can use Verify instead, without the call.
+func (c *Client) VerifyContext(ctx context.Context, uuid string, token string) (*Verification, error) {
+	resp, err := c.do(ctx, "POST", "/verify", &SignedUuid{Uuid: uuid, Token: token}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &Verification{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostTypedUuidsContext gets typed IDs with the given prefix, which must be
+// registered with the service.
+func (c *Client) PostTypedUuidsContext(ctx context.Context, prefix string, count int) ([]TypedId, error) {
+	endpoint := fmt.Sprintf("/typed-uuids?count=%d&prefix=%s", count, url.QueryEscape(prefix))
+	resp, err := c.do(ctx, "POST", endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	var out []TypedId
+	err = resp.ExtractData(&out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostGeoUuidsContext gets geo IDs for the cell, at the given precision,
+// holding a point. Zero precision means the scheme's default.
+func (c *Client) PostGeoUuidsContext(ctx context.Context, count int, scheme string, precision int, lat float64, lon float64) ([]string, error) {
+	query := fmt.Sprintf("lat=%s&lon=%s", formatCoordinate(lat), formatCoordinate(lon))
+	return c.postGeoUuids(ctx, count, scheme, precision, query)
+}
+
+// PostGeoUuidsBboxContext gets geo IDs for the smallest cell, no finer
+// than precision, holding the box, given as west, south, east, north.
+func (c *Client) PostGeoUuidsBboxContext(ctx context.Context, count int, scheme string, precision int, bbox [4]float64) ([]string, error) {
+	edges := make([]string, 4)
+	for i, edge := range bbox {
+		edges[i] = formatCoordinate(edge)
+	}
+	query := "bbox=" + strings.Join(edges, ",")
+	return c.postGeoUuids(ctx, count, scheme, precision, query)
+}
+
+func (c *Client) postGeoUuids(ctx context.Context, count int, scheme string, precision int, query string) ([]string, error) {
+	endpoint := fmt.Sprintf("/geo-uuids?count=%d&scheme=%s&%s", count, url.QueryEscape(scheme), query)
+	if precision != 0 {
+		endpoint += fmt.Sprintf("&precision=%d", precision)
+	}
+	resp, err := c.do(ctx, "POST", endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	var out []string
+	err = resp.ExtractData(&out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func formatCoordinate(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// PostShortIdsContext gets short IDs, unique within request.Scope.
+func (c *Client) PostShortIdsContext(ctx context.Context, request *ShortIdRequest) ([]string, error) {
+	resp, err := c.do(ctx, "POST", "/short-ids", request, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	var out []string
+	err = resp.ExtractData(&out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetShortIdContext checks a short ID as read back by a person: whether it
+// is well-formed, and whether it was issued in scope.
+func (c *Client) GetShortIdContext(ctx context.Context, id string, scope string) (*ShortIdStatus, error) {
+	endpoint := "/short-ids/" + url.PathEscape(id) + "?scope=" + url.QueryEscape(scope)
+	resp, err := c.do(ctx, "GET", endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &ShortIdStatus{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateCounterContext creates a named counter.
+func (c *Client) CreateCounterContext(ctx context.Context, request *CounterRequest) (*Counter, error) {
+	return c.doCounter(ctx, "POST", "/counters", request)
+}
+
+// GetCounterContext reads a named counter, without changing it.
+func (c *Client) GetCounterContext(ctx context.Context, name string) (*Counter, error) {
+	return c.doCounter(ctx, "GET", "/counters/"+url.PathEscape(name), nil)
+}
+
+func (c *Client) doCounter(ctx context.Context, verb string, endpoint string, input interface{}) (*Counter, error) {
+	resp, err := c.do(ctx, verb, endpoint, input, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &Counter{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IncrementCounterContext takes the next count values of a named counter.
+//
+// A retry after a lost response takes a fresh range: the lost one is
+// skipped, never issued twice.
+func (c *Client) IncrementCounterContext(ctx context.Context, name string, count int) (*CounterRange, error) {
+	endpoint := fmt.Sprintf("/counters/%s/increment?count=%d", url.PathEscape(name), count)
+	resp, err := c.do(ctx, "POST", endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &CounterRange{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LeaseBlockContext leases the next block of size values from the named
+// range. A retry after a lost response leases a fresh block.
+func (c *Client) LeaseBlockContext(ctx context.Context, name string, size int, holder string) (*BlockLease, error) {
+	endpoint := fmt.Sprintf("/ranges/%s/blocks?size=%d&holder=%s", url.PathEscape(name), size, url.QueryEscape(holder))
+	return c.doBlockLease(ctx, endpoint, nil)
+}
+
+// ReleaseBlockContext ends a lease, saying how many of its values were
+// used.
+func (c *Client) ReleaseBlockContext(ctx context.Context, lease *BlockLease, used int64) (*BlockLease, error) {
+	endpoint := fmt.Sprintf("/ranges/%s/blocks/%s/release", url.PathEscape(lease.Range), url.PathEscape(lease.Id))
+	return c.doBlockLease(ctx, endpoint, &BlockRelease{Used: used})
+}
+
+func (c *Client) doBlockLease(ctx context.Context, endpoint string, input interface{}) (*BlockLease, error) {
+	resp, err := c.do(ctx, "POST", endpoint, input, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &BlockLease{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetRangeContext reports a range's next value and outstanding leases.
+func (c *Client) GetRangeContext(ctx context.Context, name string) (*IntRange, error) {
+	resp, err := c.do(ctx, "GET", "/ranges/"+url.PathEscape(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &IntRange{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PostNoncesContext issues count nonces for scope. A ttl of zero takes
+// the server's default.
+func (c *Client) PostNoncesContext(ctx context.Context, count int, scope string, ttl time.Duration) ([]*Nonce, error) {
+	endpoint := fmt.Sprintf("/nonces?count=%d&scope=%s", count, url.QueryEscape(scope))
+	if ttl != 0 {
+		endpoint += "&ttl=" + ttl.String()
+	}
+	resp, err := c.do(ctx, "POST", endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := []*Nonce{}
+	err = resp.ExtractData(&out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RedeemNonceContext redeems a nonce issued for scope. A retry after a
+// lost response gets the 409 of a second redemption.
+func (c *Client) RedeemNonceContext(ctx context.Context, value string, scope string) (*Nonce, error) {
+	endpoint := fmt.Sprintf("/nonces/%s/redeem?scope=%s", url.PathEscape(value), url.QueryEscape(scope))
+	resp, err := c.do(ctx, "POST", endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &Nonce{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetIdContext returns what the service knows about an ID, including
+// whether it has been revoked.
+func (c *Client) GetIdContext(ctx context.Context, uuid string) (*IdRecord, error) {
+	return c.doIdRecord(ctx, "GET", "/uuids/"+url.PathEscape(uuid), nil)
+}
+
+// RevokeContext revokes an ID. This, UnrevokeContext and RevokeAllContext
+// need the client's API key to be the service's admin key.
+func (c *Client) RevokeContext(ctx context.Context, uuid string, actor string, reason string) (*IdRecord, error) {
+	request := &RevocationRequest{Actor: actor, Reason: reason}
+	return c.doIdRecord(ctx, "POST", "/revocations/"+url.PathEscape(uuid), request)
+}
+
+func (c *Client) UnrevokeContext(ctx context.Context, uuid string, actor string, reason string) (*IdRecord, error) {
+	request := &RevocationRequest{Actor: actor, Reason: reason}
+	return c.doIdRecord(ctx, "DELETE", "/revocations/"+url.PathEscape(uuid), request)
+}
+
+// RevokeAllContext revokes a list of IDs in one request.
+func (c *Client) RevokeAllContext(ctx context.Context, uuids []string, actor string, reason string) (*BulkRevocation, error) {
+	request := &RevocationRequest{Uuids: uuids, Actor: actor, Reason: reason}
+	resp, err := c.do(ctx, "POST", "/revocations", request, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &BulkRevocation{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Client) doIdRecord(ctx context.Context, verb string, endpoint string, input interface{}) (*IdRecord, error) {
+	resp, err := c.do(ctx, verb, endpoint, input, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &IdRecord{}
+	err = resp.ExtractData(out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ChildrenContext issues child IDs of parent.
+func (c *Client) ChildrenContext(ctx context.Context, parent string, request *ChildRequest) ([]string, error) {
+	resp, err := c.do(ctx, "POST", "/uuids/"+url.PathEscape(parent)+"/children", request, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	var out []string
+	err = resp.ExtractData(&out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetChildrenContext lists the recorded children of an ID.
+func (c *Client) GetChildrenContext(ctx context.Context, parent string) ([]*IdRecord, error) {
+	return c.doIdRecordList(ctx, "/uuids/"+url.PathEscape(parent)+"/children")
+}
+
+// GetAncestryContext lists the ancestors of an ID, its parent first.
+func (c *Client) GetAncestryContext(ctx context.Context, uuid string) ([]*IdRecord, error) {
+	return c.doIdRecordList(ctx, "/uuids/"+url.PathEscape(uuid)+"/ancestry")
+}
+
+func (c *Client) doIdRecordList(ctx context.Context, endpoint string) ([]*IdRecord, error) {
+	resp, err := c.do(ctx, "GET", endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	var out []*IdRecord
+	err = resp.ExtractData(&out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
 func (c *Client) GetStats() (*Stats, error) {
-	resp := c.h.PzGet("/admin/stats")
+	return c.GetStatsContext(context.Background())
+}
+
+func (c *Client) GetStatsContext(ctx context.Context) (*Stats, error) {
+	resp, err := c.do(ctx, "GET", "/admin/stats", nil, nil)
+	if err != nil {
+		return nil, err
+	}
 	if resp.IsError() {
 		return nil, resp.ToError()
 	}
 	out := &Stats{}
-	err := resp.ExtractData(out)
+	err = resp.ExtractData(out)
 	return out, err
 }
 
 func (c *Client) GetUUID() (string, error) {
+	return c.GetUUIDContext(context.Background())
+}
 
-	data, err := c.PostUuids(1)
+func (c *Client) GetUUIDContext(ctx context.Context) (string, error) {
+
+	data, err := c.PostUuidsContext(ctx, 1)
 	if err != nil {
 		return "", err
 	}
 
 	return (*data)[0], nil
 }
+
+//---------------------------------------------------------------------
+
+func (c *Client) generateLocally(count int) (*UuidBatch, error) {
+	out, err := newUuids(c.random, count)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.pending = append(c.pending, out...)
+	c.Unlock()
+
+	return &UuidBatch{Uuids: out, Local: true}, nil
+}
+
+// PendingLocal returns the locally generated IDs not yet registered with the service.
+func (c *Client) PendingLocal() []string {
+	c.Lock()
+	defer c.Unlock()
+	out := make([]string, len(c.pending))
+	copy(out, c.pending)
+	return out
+}
+
+// RejectedLocal returns the locally generated IDs the service refused to
+// register, for instance because they collide with IDs it has issued.
+// They are not retried.
+func (c *Client) RejectedLocal() []string {
+	c.Lock()
+	defer c.Unlock()
+	out := make([]string, len(c.rejected))
+	copy(out, c.rejected)
+	return out
+}
+
+func (c *Client) startReconcile() {
+	c.Lock()
+	empty := len(c.pending) == 0
+	c.Unlock()
+	if empty || !atomic.CompareAndSwapInt32(&c.reconciling, 0, 1) {
+		return
+	}
+	go func() {
+		_ = c.Reconcile(context.Background())
+		atomic.StoreInt32(&c.reconciling, 0)
+	}()
+}
+
+// Reconcile registers the queued locally generated IDs with the service.
+// IDs that could not be sent stay queued. IDs the service reports as
+// conflicts, and whole batches it refuses with a 4xx, are moved to
+// RejectedLocal, and the first such error is returned once the rest of
+// the queue has been sent.
+func (c *Client) Reconcile(ctx context.Context) error {
+	c.Lock()
+	ids := c.pending
+	c.pending = nil
+	c.Unlock()
+
+	max := c.getMaxCount(ctx)
+
+	var rejectErr error
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > max {
+			n = max
+		}
+
+		resp, err := c.do(ctx, "POST", "/registrations", &Registration{Uuids: ids[:n]}, nil)
+		if err != nil {
+			c.Lock()
+			c.pending = append(ids, c.pending...)
+			c.Unlock()
+			return err
+		}
+		if resp.IsError() {
+			// sending it again would get the same answer
+			c.Lock()
+			c.rejected = append(c.rejected, ids[:n]...)
+			c.Unlock()
+			if rejectErr == nil {
+				rejectErr = resp.ToError()
+			}
+			ids = ids[n:]
+			continue
+		}
+
+		// the rest are registered, but these collide with the service's
+		result := &ClaimResult{}
+		err = resp.ExtractData(result)
+		if err != nil {
+			if rejectErr == nil {
+				rejectErr = err
+			}
+		} else if len(result.Conflicts) > 0 {
+			c.Lock()
+			for _, conflict := range result.Conflicts {
+				c.rejected = append(c.rejected, conflict.Uuid)
+			}
+			c.Unlock()
+			if rejectErr == nil {
+				rejectErr = fmt.Errorf("%d locally generated uuids were refused, the first as %s: %s",
+					len(result.Conflicts), result.Conflicts[0].Reason, result.Conflicts[0].Uuid)
+			}
+		}
+
+		ids = ids[n:]
+	}
+
+	return rejectErr
+}
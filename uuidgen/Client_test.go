@@ -0,0 +1,630 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// flakyServer answers GET / with 200, and fails the first `failures`
+// POSTs to /uuids with a 503.
+func flakyServer(failures int32) (*httptest.Server, *int32) {
+	var calls int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"statusCode":200,"type":"string","data":"hi"}`)
+			return
+		}
+		n := atomic.AddInt32(&calls, 1)
+		if n <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"statusCode":503,"message":"try later"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"statusCode":201,"type":"string-list","data":["0f8fad5b-d9cb-469f-a165-70867728950e"]}`)
+	}
+	return httptest.NewServer(http.HandlerFunc(handler)), &calls
+}
+
+func testClientOptions() *ClientOptions {
+	return &ClientOptions{
+		Timeout:          time.Second,
+		MaxRetries:       3,
+		BaseBackoff:      time.Millisecond,
+		MaxBackoff:       5 * time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  50 * time.Millisecond,
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	server, calls := flakyServer(2)
+	defer server.Close()
+
+	options := testClientOptions()
+	options.BreakerThreshold = 0
+	client, err := NewClientWithOptions(server.URL, "", options)
+	assert.NoError(err)
+
+	uuid, err := client.GetUUID()
+	assert.NoError(err)
+	assert.True(ValidUuidV4(uuid))
+	assert.EqualValues(3, atomic.LoadInt32(calls))
+}
+
+func TestClientIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+
+	// fails every other POST, recording the key each time
+	var lock sync.Mutex
+	var keys []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"statusCode":200,"type":"string","data":"hi"}`)
+			return
+		}
+		lock.Lock()
+		keys = append(keys, r.Header.Get(IdempotencyHeader))
+		n := len(keys)
+		lock.Unlock()
+		if n%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"statusCode":503,"message":"try later"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"statusCode":201,"type":"string-list","data":["0f8fad5b-d9cb-469f-a165-70867728950e"]}`)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	options := testClientOptions()
+	options.BreakerThreshold = 0
+	client, err := NewClientWithOptions(server.URL, "", options)
+	assert.NoError(err)
+
+	_, err = client.GetUUID()
+	assert.NoError(err)
+	_, err = client.GetUUID()
+	assert.NoError(err)
+
+	// the retry repeats the key; the next call has a new one
+	assert.Len(keys, 4)
+	assert.NotEqual("", keys[0])
+	assert.Equal(keys[0], keys[1])
+	assert.Equal(keys[2], keys[3])
+	assert.NotEqual(keys[0], keys[2])
+}
+
+func TestClientBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	server, calls := flakyServer(100)
+	defer server.Close()
+
+	client, err := NewClientWithOptions(server.URL, "", testClientOptions())
+	assert.NoError(err)
+
+	_, err = client.GetUUID()
+	assert.Equal(ErrCircuitOpen, err)
+	assert.EqualValues(2, atomic.LoadInt32(calls))
+	assert.Equal(BreakerOpen, client.BreakerState())
+
+	// fails fast while open
+	_, err = client.GetUUID()
+	assert.Equal(ErrCircuitOpen, err)
+	assert.EqualValues(2, atomic.LoadInt32(calls))
+
+	// after the cooldown a single probe goes through, and on failure reopens
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(BreakerHalfOpen, client.BreakerState())
+	_, err = client.GetUUID()
+	assert.Error(err)
+	assert.EqualValues(3, atomic.LoadInt32(calls))
+	assert.Equal(BreakerOpen, client.BreakerState())
+}
+
+func TestClientContext(t *testing.T) {
+	assert := assert.New(t)
+
+	server, calls := flakyServer(100)
+	defer server.Close()
+
+	client, err := NewClientWithOptions(server.URL, "", testClientOptions())
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.PostUuidsContext(ctx, 1)
+	assert.Equal(context.Canceled, err)
+	assert.Equal(BreakerClosed, client.BreakerState())
+	assert.EqualValues(0, atomic.LoadInt32(calls))
+}
+
+func TestClientHungServer(t *testing.T) {
+	assert := assert.New(t)
+
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer server.Close()
+	defer close(hang)
+
+	options := testClientOptions()
+	options.MaxRetries = 0
+	client, err := NewLazyClient([]string{server.URL}, "", options)
+	assert.NoError(err)
+
+	// deadlines shorter than the client's timeout still open the breaker
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err = client.GetVersionContext(ctx)
+		cancel()
+		assert.Equal(context.DeadlineExceeded, err)
+	}
+	assert.Equal(BreakerOpen, client.BreakerState())
+
+	// a cancelled probe neither closes nor reopens it
+	time.Sleep(60 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = client.GetVersionContext(ctx)
+	assert.Equal(context.Canceled, err)
+	assert.Equal(BreakerHalfOpen, client.BreakerState())
+}
+
+func TestPooledClient(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := NewMockClient()
+	assert.NoError(err)
+
+	options := &PoolOptions{BatchSize: 10, Capacity: 30, LowWater: 10, RefillTimeout: time.Second}
+	pool, err := NewPooledClient(mock, options)
+	assert.NoError(err)
+
+	var mutex sync.Mutex
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				uuid, err := pool.GetUUID()
+				assert.NoError(err)
+				mutex.Lock()
+				assert.False(seen[uuid])
+				seen[uuid] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(seen, 200)
+
+	data, err := pool.PostUuids(5)
+	assert.NoError(err)
+	assert.Len(*data, 5)
+
+	// too big for the pool: passed through
+	data, err = pool.PostUuids(50)
+	assert.NoError(err)
+	assert.Len(*data, 50)
+
+	_, err = pool.PostUuids(-1)
+	assert.Error(err)
+}
+
+func TestPooledClientDry(t *testing.T) {
+	assert := assert.New(t)
+
+	server, _ := flakyServer(1000)
+	defer server.Close()
+
+	options := testClientOptions()
+	options.MaxRetries = 0
+	options.BreakerThreshold = 0
+	client, err := NewClientWithOptions(server.URL, "", options)
+	assert.NoError(err)
+
+	pool, err := NewPooledClient(client, &PoolOptions{BatchSize: 1, Capacity: 2, LowWater: 1, RefillTimeout: time.Second})
+	assert.NoError(err)
+
+	_, err = pool.GetUUID()
+	assert.Error(err)
+	assert.Equal(0, pool.Available())
+}
+
+func TestPooledClientEmptyBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := NewMockClient()
+	assert.NoError(err)
+	// the constructor's refill may have failed before GetUUID starts another
+	mock.Script(MockResponse{Uuids: []string{}}, MockResponse{Uuids: []string{}})
+
+	pool, err := NewPooledClient(mock, &PoolOptions{BatchSize: 1, Capacity: 2, LowWater: 1, RefillTimeout: time.Second})
+	assert.NoError(err)
+
+	_, err = pool.GetUUID()
+	assert.Equal(errEmptyBatch, err)
+	assert.True(len(mock.Calls()) <= 2)
+}
+
+func TestClientFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	server, calls := flakyServer(2)
+	defer server.Close()
+
+	options := testClientOptions()
+	options.MaxRetries = 0
+	options.BreakerThreshold = 0
+	options.Fallback = true
+	options.Reconcile = true
+	client, err := NewClientWithOptions(server.URL, "", options)
+	assert.NoError(err)
+
+	batch, err := client.PostUuidsBatchContext(context.Background(), 3)
+	assert.NoError(err)
+	assert.True(batch.Local)
+	assert.Len(batch.Uuids, 3)
+
+	uuid, err := client.GetUUID()
+	assert.NoError(err)
+	assert.True(ValidUuidV4(uuid))
+	assert.Len(client.PendingLocal(), 4)
+
+	// the service is back: the queue is registered in the background
+	batch, err = client.PostUuidsBatchContext(context.Background(), 1)
+	assert.NoError(err)
+	assert.False(batch.Local)
+
+	for i := 0; i < 100 && len(client.PendingLocal()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Len(client.PendingLocal(), 0)
+	assert.EqualValues(4, atomic.LoadInt32(calls))
+}
+
+func TestClientReconcileRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	var registrations int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/registrations":
+			atomic.AddInt32(&registrations, 1)
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"statusCode":409,"message":"already issued"}`)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"statusCode":503,"message":"try later"}`)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	options := testClientOptions()
+	options.MaxRetries = 0
+	options.BreakerThreshold = 0
+	options.Fallback = true
+	client, err := NewLazyClient([]string{server.URL}, "", options)
+	assert.NoError(err)
+
+	batch, err := client.PostUuidsBatchContext(context.Background(), 2)
+	assert.NoError(err)
+	assert.True(batch.Local)
+
+	// a refused batch is reported, not queued again
+	err = client.Reconcile(context.Background())
+	assert.Error(err)
+	assert.Empty(client.PendingLocal())
+	assert.Equal(batch.Uuids, client.RejectedLocal())
+	assert.NoError(client.Reconcile(context.Background()))
+	assert.EqualValues(1, atomic.LoadInt32(&registrations))
+}
+
+func TestClientReconcileConflicts(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/registrations" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"statusCode":503,"message":"try later"}`)
+			return
+		}
+		// the first collides with an ID the service issued
+		registration := &Registration{}
+		err := json.NewDecoder(r.Body).Decode(registration)
+		assert.NoError(err)
+		result := &ClaimResult{
+			Claimed:   registration.Uuids[1:],
+			Conflicts: []ClaimConflict{{Uuid: registration.Uuids[0], Reason: string(IdIssued)}},
+		}
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(&piazza.JsonResponse{StatusCode: http.StatusCreated, Data: result})
+		assert.NoError(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	options := testClientOptions()
+	options.MaxRetries = 0
+	options.BreakerThreshold = 0
+	options.Fallback = true
+	client, err := NewLazyClient([]string{server.URL}, "", options)
+	assert.NoError(err)
+
+	batch, err := client.PostUuidsBatchContext(context.Background(), 3)
+	assert.NoError(err)
+	assert.True(batch.Local)
+
+	// only the colliding ID is reported, for its job to be re-keyed
+	err = client.Reconcile(context.Background())
+	assert.Error(err)
+	assert.Empty(client.PendingLocal())
+	assert.Equal(batch.Uuids[:1], client.RejectedLocal())
+}
+
+func TestLazyClientBalancing(t *testing.T) {
+	assert := assert.New(t)
+
+	good1, calls1 := flakyServer(0)
+	defer good1.Close()
+	good2, calls2 := flakyServer(0)
+	defer good2.Close()
+	bad, badCalls := flakyServer(1000)
+	defer bad.Close()
+
+	options := testClientOptions()
+	options.BreakerThreshold = 0
+	options.EjectAfter = 1
+	options.EjectFor = time.Minute
+
+	// nothing is listening here yet, and that's fine
+	_, err := NewLazyClient([]string{"http://localhost:1"}, "", options)
+	assert.NoError(err)
+	_, err = NewLazyClient([]string{}, "", options)
+	assert.Error(err)
+
+	client, err := NewLazyClient([]string{bad.URL, good1.URL, good2.URL + "/"}, "", options)
+	assert.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		_, err = client.GetUUID()
+		assert.NoError(err)
+	}
+	assert.EqualValues(1, atomic.LoadInt32(badCalls))
+	assert.Equal(10, int(atomic.LoadInt32(calls1)+atomic.LoadInt32(calls2)))
+	assert.NotZero(atomic.LoadInt32(calls1))
+	assert.NotZero(atomic.LoadInt32(calls2))
+
+	status := client.Endpoints()
+	assert.Len(status, 3)
+	assert.False(status[0].Healthy)
+	assert.True(status[1].Healthy)
+	assert.Equal(good2.URL, status[2].Url)
+
+	// the capabilities request measures good1, so bad, unmeasured, rates
+	// the same and is tried next, once
+	options.Balance = LeastLatency
+	client, err = NewLazyClient([]string{good1.URL, bad.URL}, "", options)
+	assert.NoError(err)
+	for i := 0; i < 5; i++ {
+		_, err = client.GetUUID()
+		assert.NoError(err)
+	}
+	assert.EqualValues(2, atomic.LoadInt32(badCalls))
+}
+
+func TestLazyClientBreakers(t *testing.T) {
+	assert := assert.New(t)
+
+	good1, calls1 := flakyServer(0)
+	defer good1.Close()
+	good2, calls2 := flakyServer(0)
+	defer good2.Close()
+	bad, badCalls := flakyServer(1000)
+	defer bad.Close()
+
+	// one dead endpoint opens only its own breaker
+	options := testClientOptions()
+	options.BreakerThreshold = 1
+	options.BreakerCooldown = time.Minute
+	options.EjectAfter = 0
+	client, err := NewLazyClient([]string{bad.URL, good1.URL}, "", options)
+	assert.NoError(err)
+	for i := 0; i < 6; i++ {
+		_, err = client.GetUUID()
+		assert.NoError(err)
+	}
+	assert.EqualValues(1, atomic.LoadInt32(badCalls))
+	assert.EqualValues(6, atomic.LoadInt32(calls1))
+	assert.Equal(BreakerClosed, client.BreakerState())
+	status := client.Endpoints()
+	assert.Equal("open", status[0].Breaker)
+	assert.Equal("closed", status[1].Breaker)
+
+	// under LeastLatency an endpoint not yet measured doesn't take
+	// everything
+	options.Balance = LeastLatency
+	client, err = NewLazyClient([]string{good1.URL, good2.URL}, "", options)
+	assert.NoError(err)
+	before := atomic.LoadInt32(calls1)
+	for i := 0; i < 2; i++ {
+		_, err = client.GetUUID()
+		assert.NoError(err)
+	}
+	assert.EqualValues(1, atomic.LoadInt32(calls1)-before)
+	assert.EqualValues(1, atomic.LoadInt32(calls2))
+}
+
+func TestClientChunking(t *testing.T) {
+	assert := assert.New(t)
+
+	// max count of 10; every third POST is rejected
+	var calls int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"statusCode":200,"type":"string","data":"hi"}`)
+		case "/capabilities":
+			fmt.Fprint(w, `{"statusCode":200,"type":"uuidcapabilities","data":{"maxCount":10}}`)
+		case "/uuids":
+			count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+			if count > 10 || atomic.AddInt32(&calls, 1)%3 == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"statusCode":400,"message":"no"}`)
+				return
+			}
+			uuids := make([]string, count)
+			for i := range uuids {
+				uuids[i] = `"` + piazza.NewUuid().String() + `"`
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"statusCode":201,"type":"string-list","data":[%s]}`, strings.Join(uuids, ","))
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	client, err := NewClientWithOptions(server.URL, "", testClientOptions())
+	assert.NoError(err)
+
+	data, err := client.PostUuids(25)
+	partial, ok := err.(*PartialError)
+	assert.True(ok)
+	assert.Equal(25, partial.Requested)
+	assert.Equal(len(*data), partial.Received)
+	assert.Len(partial.Errors, 1)
+	assert.True(partial.Received == 15 || partial.Received == 20)
+	assert.EqualValues(3, atomic.LoadInt32(&calls))
+}
+
+func TestClientCapabilitiesDown(t *testing.T) {
+	assert := assert.New(t)
+
+	var capabilities int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/capabilities" {
+			atomic.AddInt32(&capabilities, 1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"statusCode":503,"message":"try later"}`)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	options := testClientOptions()
+	options.MaxRetries = 1
+	options.BreakerThreshold = 0
+	client, err := NewLazyClient([]string{server.URL}, "", options)
+	assert.NoError(err)
+
+	// the server isn't asked again while it is down
+	for i := 0; i < 3; i++ {
+		_, err = client.PostUuids(1)
+		assert.Error(err)
+	}
+	assert.EqualValues(2, atomic.LoadInt32(&capabilities))
+}
+
+func TestMockClient(t *testing.T) {
+	assert := assert.New(t)
+
+	// same seed, same sequence
+	a, err := NewMockClientWithOptions(&MockOptions{Deterministic: true, Seed: 42})
+	assert.NoError(err)
+	b, err := NewMockClientWithOptions(&MockOptions{Deterministic: true, Seed: 42})
+	assert.NoError(err)
+	da, err := a.PostUuids(300)
+	assert.NoError(err)
+	db, err := b.PostUuids(300)
+	assert.NoError(err)
+	assert.Equal(*da, *db)
+	assert.True(ValidUuidV4((*da)[0]))
+
+	_, err = a.PostUuids(-1)
+	assert.Error(err)
+
+	// fault injection: every third call is a 503
+	mock, err := NewMockClientWithOptions(&MockOptions{FailEvery: 3})
+	assert.NoError(err)
+	for i := 1; i <= 6; i++ {
+		_, err = mock.GetUUID()
+		if i%3 == 0 {
+			assert.Equal(NewMockStatusError(503, "injected failure"), err)
+		} else {
+			assert.NoError(err)
+		}
+	}
+
+	// scripted responses, then back to generating
+	mock.Script(
+		MockResponse{Uuids: []string{"0f8fad5b-d9cb-469f-a165-70867728950e"}},
+		MockResponse{Err: NewMockStatusError(400, "nope")},
+	)
+	uuid, err := mock.GetUUID()
+	assert.NoError(err)
+	assert.Equal("0f8fad5b-d9cb-469f-a165-70867728950e", uuid)
+	_, err = mock.PostUuids(2)
+	assert.EqualError(err, "{400: nope}")
+
+	calls := mock.Calls()
+	assert.Len(calls, 8)
+	assert.Equal("PostUuids", calls[7].Method)
+	assert.Equal(2, calls[7].Count)
+	assert.Error(calls[7].Err)
+
+	// the ninth call is another injected failure
+	_, err = mock.GetStats()
+	assert.Error(err)
+	stats, err := mock.GetStats()
+	assert.NoError(err)
+	assert.Equal(5, stats.NumRequests)
+
+	// latency, and a context that runs out first
+	slow, err := NewMockClientWithOptions(&MockOptions{Latency: time.Second})
+	assert.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = slow.GetUUIDContext(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+}
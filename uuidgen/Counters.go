@@ -0,0 +1,385 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// Named counters hand out human-friendly numbers, such as "JOB-000123",
+// that go up by one each time. Every change is a compare-and-set on the
+// counter's version, so a value is never issued twice, even by instances
+// sharing a durable store.
+const (
+	// the most one increment may take
+	MaxCounterIncrement = 1000000
+
+	maxCounterName = 64
+
+	// compare-and-set attempts before giving up on a busy counter
+	counterAttempts = 32
+
+	counterType = "counter"
+)
+
+// Counter is the state of a named counter.
+type Counter struct {
+	Name      string    `json:"name"`
+	Format    string    `json:"format,omitempty"`
+	Value     int64     `json:"value"` // the last value issued
+	CreatedOn time.Time `json:"createdOn"`
+	UpdatedOn time.Time `json:"updatedOn"`
+	Version   int64     `json:"version"`
+}
+
+// CounterRequest is the body of a POST to /counters.
+type CounterRequest struct {
+	Name string `json:"name"`
+
+	// Format, if set, is a template with one integer verb, e.g. "JOB-%06d".
+	Format string `json:"format,omitempty"`
+
+	// Start is the first value issued; the default is 1.
+	Start int64 `json:"start,omitempty"`
+}
+
+// CounterRange is the values issued by one increment, First to Last
+// inclusive.
+type CounterRange struct {
+	Name   string `json:"name"`
+	Format string `json:"format,omitempty"`
+	First  int64  `json:"first"`
+	Last   int64  `json:"last"`
+}
+
+// Values returns the range's values, formatted.
+func (r *CounterRange) Values() []string {
+	out := make([]string, 0, r.Last-r.First+1)
+	for v := r.First; v <= r.Last; v++ {
+		out = append(out, FormatCounter(r.Format, v))
+	}
+	return out
+}
+
+// FormatCounter applies a counter's format to a value. With no format, it
+// is just the number.
+func FormatCounter(format string, value int64) string {
+	if format == "" {
+		return strconv.FormatInt(value, 10)
+	}
+	return fmt.Sprintf(format, value)
+}
+
+// validCounterFormat accepts a template with exactly one verb of the form
+// %d, %Nd or %0Nd, with N at most 20, plus any number of %%.
+func validCounterFormat(format string) bool {
+	verbs := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			continue
+		}
+		if i < len(format) && format[i] == '0' {
+			i++
+		}
+		width := 0
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			width = width*10 + int(format[i]-'0')
+			if width > 20 {
+				return false
+			}
+			i++
+		}
+		if i >= len(format) || format[i] != 'd' {
+			return false
+		}
+		verbs++
+	}
+	return verbs == 1
+}
+
+// validCounterName accepts letters, digits, '.', '-' and '_'.
+func validCounterName(name string) bool {
+	if len(name) == 0 || len(name) > maxCounterName {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') &&
+			c != '.' && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+//---------------------------------------------------------------------
+
+// CounterStore holds counters. Implementations must be safe for
+// concurrent use.
+type CounterStore interface {
+	// Get returns nil, and no error, for a counter it doesn't have.
+	Get(name string) (*Counter, error)
+
+	// Create adds a counter, unless one of that name exists; it reports
+	// whether it was added.
+	Create(counter *Counter) (bool, error)
+
+	// CompareAndSet stores counter only if the stored one's version is
+	// counter.Version-1; it reports whether it did.
+	CompareAndSet(counter *Counter) (bool, error)
+
+	// Durable reports whether counters outlast the process.
+	Durable() bool
+}
+
+// MemoryCounterStore is a CounterStore that lives in memory.
+type MemoryCounterStore struct {
+	sync.Mutex
+	counters map[string]*Counter
+}
+
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{counters: map[string]*Counter{}}
+}
+
+func (store *MemoryCounterStore) Get(name string) (*Counter, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	counter, ok := store.counters[name]
+	if !ok {
+		return nil, nil
+	}
+	out := *counter
+	return &out, nil
+}
+
+func (store *MemoryCounterStore) Create(counter *Counter) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.counters[counter.Name]; ok {
+		return false, nil
+	}
+	in := *counter
+	store.counters[counter.Name] = &in
+	return true, nil
+}
+
+func (store *MemoryCounterStore) CompareAndSet(counter *Counter) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	stored, ok := store.counters[counter.Name]
+	if !ok || stored.Version != counter.Version-1 {
+		return false, nil
+	}
+	in := *counter
+	store.counters[counter.Name] = &in
+	return true, nil
+}
+
+func (store *MemoryCounterStore) Durable() bool {
+	return false
+}
+
+//---------------------------------------------------------------------
+
+// ElasticCounterStore keeps counters in an Elasticsearch index. Writes
+// use Elasticsearch's external versioning, with the counter's version, so
+// a write based on a stale read is refused, whichever instance makes it.
+type ElasticCounterStore struct {
+	index DocumentIndex
+}
+
+// NewElasticCounterStore uses index, creating it if need be.
+func NewElasticCounterStore(index DocumentIndex) (*ElasticCounterStore, error) {
+	err := index.Prepare(counterType, "")
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticCounterStore{index: index}, nil
+}
+
+func (store *ElasticCounterStore) Get(name string) (*Counter, error) {
+	counter := &Counter{}
+	ok, err := getDocument(store.index, counterType, name, counter)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return counter, nil
+}
+
+func (store *ElasticCounterStore) Create(counter *Counter) (bool, error) {
+	return store.index.Put(counterType, counter.Name, counter.Version, counter, true)
+}
+
+func (store *ElasticCounterStore) CompareAndSet(counter *Counter) (bool, error) {
+	return store.index.Put(counterType, counter.Name, counter.Version, counter, false)
+}
+
+func (store *ElasticCounterStore) Durable() bool {
+	return true
+}
+
+//---------------------------------------------------------------------
+
+// counterError carries the HTTP status a counter operation failed with.
+type counterError struct {
+	statusCode int
+	message    string
+}
+
+func (e *counterError) Error() string {
+	return e.message
+}
+
+func newCounter(request *CounterRequest, now time.Time) (*Counter, error) {
+	if !validCounterName(request.Name) {
+		return nil, &counterError{http.StatusBadRequest, fmt.Sprintf("invalid counter name: %q", request.Name)}
+	}
+	if request.Format != "" && !validCounterFormat(request.Format) {
+		return nil, &counterError{http.StatusBadRequest, fmt.Sprintf("invalid counter format: %q", request.Format)}
+	}
+	if request.Start == 0 {
+		request.Start = 1
+	}
+	if request.Start < 0 {
+		return nil, &counterError{http.StatusBadRequest, fmt.Sprintf("start out of range: %d", request.Start)}
+	}
+	return &Counter{
+		Name:      request.Name,
+		Format:    request.Format,
+		Value:     request.Start - 1,
+		CreatedOn: now,
+		UpdatedOn: now,
+		Version:   1,
+	}, nil
+}
+
+func createCounter(store CounterStore, request *CounterRequest) (*Counter, error) {
+	counter, err := newCounter(request, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	ok, err := store.Create(counter)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &counterError{http.StatusConflict, "counter already exists: " + request.Name}
+	}
+	return counter, nil
+}
+
+func getCounter(store CounterStore, name string) (*Counter, error) {
+	counter, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if counter == nil {
+		return nil, &counterError{http.StatusNotFound, "counter not found: " + name}
+	}
+	return counter, nil
+}
+
+// incrementCounter takes the next n values, retrying while other callers
+// get in first.
+func incrementCounter(store CounterStore, name string, n int64) (*CounterRange, error) {
+	if n < 1 || n > MaxCounterIncrement {
+		return nil, &counterError{http.StatusBadRequest, fmt.Sprintf("count out of range: %d", n)}
+	}
+	for i := 0; i < counterAttempts; i++ {
+		counter, err := getCounter(store, name)
+		if err != nil {
+			return nil, err
+		}
+		if counter.Value > math.MaxInt64-n {
+			return nil, &counterError{http.StatusConflict, "counter exhausted: " + name}
+		}
+
+		first := counter.Value + 1
+		counter.Value += n
+		counter.Version++
+		counter.UpdatedOn = time.Now()
+
+		ok, err := store.CompareAndSet(counter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &CounterRange{Name: name, Format: counter.Format, First: first, Last: counter.Value}, nil
+		}
+	}
+	return nil, &counterError{http.StatusServiceUnavailable, "counter too busy, try again: " + name}
+}
+
+//---------------------------------------------------------------------
+
+func (service *Service) counterResponse(statusCode int, data interface{}, err error) *piazza.JsonResponse {
+	if err != nil {
+		if e, ok := err.(*counterError); ok {
+			return service.newErrorResponse(e.statusCode, e.message)
+		}
+		_ = service.syslogger.Error("uuidgen counter store failed: %s", err.Error())
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	resp := &piazza.JsonResponse{StatusCode: statusCode, Data: data}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+func (service *Service) PostCounters(request *CounterRequest) *piazza.JsonResponse {
+	counter, err := createCounter(service.counters, request)
+	if err == nil {
+		_ = service.syslogger.Info("uuidgen created counter %s", counter.Name)
+	}
+	return service.counterResponse(http.StatusCreated, counter, err)
+}
+
+func (service *Service) GetCounter(name string) *piazza.JsonResponse {
+	counter, err := getCounter(service.counters, name)
+	return service.counterResponse(http.StatusOK, counter, err)
+}
+
+// PostCounterIncrement takes the next values of a counter.
+//
+//	?count=INT  how many; the default is 1
+func (service *Service) PostCounterIncrement(name string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	count, err := params.GetCount(1)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	r, err := incrementCounter(service.counters, name, int64(count))
+	if err == nil {
+		atomic.AddInt64(&service.numRequests, 1)
+	}
+	return service.counterResponse(http.StatusOK, r, err)
+}
@@ -0,0 +1,136 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, good := range []string{"%d", "JOB-%06d", "%%%d%%", "x%20d"} {
+		assert.True(validCounterFormat(good), good)
+	}
+	for _, bad := range []string{"", "JOB", "%s", "%d-%d", "%x", "%021d", "%", "%-6d", "100%"} {
+		assert.False(validCounterFormat(bad), bad)
+	}
+
+	assert.Equal("JOB-000123", FormatCounter("JOB-%06d", 123))
+	assert.Equal("123", FormatCounter("", 123))
+
+	r := &CounterRange{Format: "T%d", First: 9, Last: 11}
+	assert.Equal([]string{"T9", "T10", "T11"}, r.Values())
+}
+
+func TestCounterStores(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := NewElasticCounterStore(NewMockDocumentIndex())
+	assert.NoError(err)
+	elastic, err := NewElasticCounterStore(NewDocumentIndex(newElasticEmulator("counters")))
+	assert.NoError(err)
+	assert.False(NewMemoryCounterStore().Durable())
+	assert.True(elastic.Durable())
+
+	for _, store := range []CounterStore{NewMemoryCounterStore(), mock, elastic} {
+		_, err := createCounter(store, &CounterRequest{Name: "jobs", Start: 100})
+		assert.NoError(err)
+		_, err = createCounter(store, &CounterRequest{Name: "jobs"})
+		assert.Equal(http.StatusConflict, err.(*counterError).statusCode)
+		_, err = createCounter(store, &CounterRequest{Name: "no spaces"})
+		assert.Equal(http.StatusBadRequest, err.(*counterError).statusCode)
+
+		// concurrent increments get disjoint ranges with no gaps
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		seen := map[int64]bool{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					r, err := incrementCounter(store, "jobs", 3)
+					if !assert.NoError(err) {
+						return
+					}
+					lock.Lock()
+					for v := r.First; v <= r.Last; v++ {
+						assert.False(seen[v])
+						seen[v] = true
+					}
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Len(seen, 8*20*3)
+
+		counter, err := getCounter(store, "jobs")
+		assert.NoError(err)
+		assert.Equal(int64(100+8*20*3-1), counter.Value)
+		for v := int64(100); v <= counter.Value; v++ {
+			assert.True(seen[v])
+		}
+
+		// a write from a stale read is refused
+		stale := *counter
+		counter.Version++
+		ok, err := store.CompareAndSet(counter)
+		assert.NoError(err)
+		assert.True(ok)
+		stale.Version++
+		ok, err = store.CompareAndSet(&stale)
+		assert.NoError(err)
+		assert.False(ok)
+
+		_, err = getCounter(store, "missing")
+		assert.Equal(http.StatusNotFound, err.(*counterError).statusCode)
+		_, err = incrementCounter(store, "jobs", 0)
+		assert.Equal(http.StatusBadRequest, err.(*counterError).statusCode)
+	}
+}
+
+func TestMockClientCounters(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	client, err := NewMockClient()
+	assert.NoError(err)
+
+	counter, err := client.CreateCounterContext(ctx, &CounterRequest{Name: "jobs", Format: "JOB-%06d"})
+	assert.NoError(err)
+	assert.Equal(int64(0), counter.Value)
+
+	r, err := client.IncrementCounterContext(ctx, "jobs", 2)
+	assert.NoError(err)
+	assert.Equal([]string{"JOB-000001", "JOB-000002"}, r.Values())
+
+	// errors look as they would from Client
+	_, err = client.CreateCounterContext(ctx, &CounterRequest{Name: "jobs"})
+	assert.Equal(NewMockStatusError(http.StatusConflict, "counter already exists: jobs"), err)
+	_, err = client.IncrementCounterContext(ctx, "nope", 1)
+	assert.Error(err)
+
+	calls := client.Calls()
+	assert.Len(calls, 4)
+	assert.Equal("IncrementCounter", calls[3].Method)
+	assert.Equal(err, calls[3].Err)
+}
@@ -0,0 +1,294 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// DocumentIndex is what the Elastic stores need of an index: versioned
+// writes, reads of many documents at once, and simple searches, each in
+// one round trip. NewDocumentIndex provides one over Elasticsearch, and
+// MockDocumentIndex one in memory. Implementations must be safe for
+// concurrent use.
+type DocumentIndex interface {
+	// Prepare creates the index if need be and, if mapping is not empty,
+	// sets it for typ unless typ has one already.
+	Prepare(typ string, mapping string) error
+
+	// Get returns the document's source, or nil if there is no document.
+	Get(typ string, id string) (json.RawMessage, error)
+
+	// MultiGet returns the sources of those of the documents that exist,
+	// by ID.
+	MultiGet(typ string, ids []string) (map[string]json.RawMessage, error)
+
+	// Put writes doc as id, and reports whether it did. If create, it
+	// doesn't if there is a document already. Otherwise, with a version
+	// above zero, it doesn't unless the stored document's version is below
+	// version; with version zero, it always does.
+	Put(typ string, id string, version int64, doc interface{}, create bool) (bool, error)
+
+	// Delete removes the document, if there is one.
+	Delete(typ string, id string) error
+
+	// Search returns the page of documents that query asks for, and how
+	// many match in all.
+	Search(typ string, query *DocumentQuery) ([]json.RawMessage, int, error)
+}
+
+// DocumentQuery picks the documents whose Field, if set, has one of Values
+// (or, for a list, contains one), and whose BeforeField, if set, holds a
+// time before Before. They are sorted by SortBy, if set, and From and Size
+// pick the page.
+type DocumentQuery struct {
+	Field       string
+	Values      []string
+	BeforeField string
+	Before      time.Time
+	SortBy      string
+	Descending  bool
+	From        int
+	Size        int
+}
+
+//---------------------------------------------------------------------
+
+// elasticDocumentIndex makes its calls through the index's DirectAccess,
+// as IIndex has no versioned writes, multi-gets or filtered searches.
+type elasticDocumentIndex struct {
+	index elasticsearch.IIndex
+}
+
+// NewDocumentIndex returns a DocumentIndex over index.
+func NewDocumentIndex(index elasticsearch.IIndex) DocumentIndex {
+	return &elasticDocumentIndex{index: index}
+}
+
+// elasticFailure is how Elasticsearch reports a failed call, in the body.
+type elasticFailure struct {
+	Status int         `json:"status"`
+	Error  interface{} `json:"error"`
+}
+
+func (di *elasticDocumentIndex) endpoint(typ string, rest string) string {
+	return fmt.Sprintf("/%s/%s/%s", di.index.IndexName(), typ, rest)
+}
+
+func (di *elasticDocumentIndex) Prepare(typ string, mapping string) error {
+	ok, err := di.index.IndexExists()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		err = di.index.Create("")
+		if err != nil {
+			return err
+		}
+	}
+	if mapping == "" {
+		return nil
+	}
+	ok, err = di.index.TypeExists(typ)
+	if err != nil || ok {
+		return err
+	}
+	return di.index.SetMapping(typ, piazza.JsonString(mapping))
+}
+
+func (di *elasticDocumentIndex) Get(typ string, id string) (json.RawMessage, error) {
+	var result struct {
+		elasticFailure
+		Found  bool            `json:"found"`
+		Source json.RawMessage `json:"_source"`
+	}
+	err := di.index.DirectAccess("GET", di.endpoint(typ, url.PathEscape(id)), nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("%s %s not read: %v", typ, id, result.Error)
+	}
+	if !result.Found {
+		return nil, nil
+	}
+	return result.Source, nil
+}
+
+func (di *elasticDocumentIndex) MultiGet(typ string, ids []string) (map[string]json.RawMessage, error) {
+	found := map[string]json.RawMessage{}
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	input := map[string][]string{"ids": ids}
+	var result struct {
+		elasticFailure
+		Docs []struct {
+			ID     string          `json:"_id"`
+			Found  bool            `json:"found"`
+			Source json.RawMessage `json:"_source"`
+		} `json:"docs"`
+	}
+	err := di.index.DirectAccess("POST", di.endpoint(typ, "_mget"), input, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("%s documents not read: %v", typ, result.Error)
+	}
+	for _, doc := range result.Docs {
+		if doc.Found {
+			found[doc.ID] = doc.Source
+		}
+	}
+	return found, nil
+}
+
+func (di *elasticDocumentIndex) Put(typ string, id string, version int64, doc interface{}, create bool) (bool, error) {
+	// with external versioning, the write succeeds only if version is
+	// above the stored one
+	params := url.Values{}
+	if version > 0 {
+		params.Set("version", fmt.Sprint(version))
+		params.Set("version_type", "external")
+	}
+	if create {
+		params.Set("op_type", "create")
+	}
+	endpoint := di.endpoint(typ, url.PathEscape(id))
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+
+	var result elasticFailure
+	err := di.index.DirectAccess("PUT", endpoint, doc, &result)
+	if err != nil {
+		return false, err
+	}
+	if result.Status == http.StatusConflict {
+		return false, nil
+	}
+	if result.Error != nil {
+		return false, fmt.Errorf("%s %s not stored: %v", typ, id, result.Error)
+	}
+	return true, nil
+}
+
+func (di *elasticDocumentIndex) Delete(typ string, id string) error {
+	var result elasticFailure
+	err := di.index.DirectAccess("DELETE", di.endpoint(typ, url.PathEscape(id)), nil, &result)
+	if err != nil {
+		return err
+	}
+	if result.Error != nil {
+		return fmt.Errorf("%s %s not deleted: %v", typ, id, result.Error)
+	}
+	return nil
+}
+
+func (di *elasticDocumentIndex) Search(typ string, query *DocumentQuery) ([]json.RawMessage, int, error) {
+	type object map[string]interface{}
+
+	var filters []interface{}
+	if query.Field != "" {
+		filters = append(filters, object{"terms": object{query.Field: query.Values}})
+	}
+	if query.BeforeField != "" {
+		filters = append(filters, object{"range": object{query.BeforeField: object{"lt": query.Before.Format(time.RFC3339Nano)}}})
+	}
+	input := object{
+		"query": object{"match_all": object{}},
+		"from":  query.From,
+		"size":  query.Size,
+	}
+	if len(filters) > 0 {
+		input["query"] = object{"bool": object{"filter": filters}}
+	}
+	if query.SortBy != "" {
+		order := "asc"
+		if query.Descending {
+			order = "desc"
+		}
+		input["sort"] = []interface{}{object{query.SortBy: object{"order": order}}}
+	}
+
+	var result struct {
+		elasticFailure
+		Hits struct {
+			Total int `json:"total"`
+			Hits  []struct {
+				Source json.RawMessage `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err := di.index.DirectAccess("POST", di.endpoint(typ, "_search"), input, &result)
+	if err != nil {
+		return nil, 0, err
+	}
+	if result.Error != nil {
+		return nil, 0, fmt.Errorf("%s search failed: %v", typ, result.Error)
+	}
+
+	docs := make([]json.RawMessage, len(result.Hits.Hits))
+	for i, hit := range result.Hits.Hits {
+		docs[i] = hit.Source
+	}
+	return docs, result.Hits.Total, nil
+}
+
+//---------------------------------------------------------------------
+
+// getDocument reads id into v, and reports whether there was a document.
+func getDocument(index DocumentIndex, typ string, id string, v interface{}) (bool, error) {
+	source, err := index.Get(typ, id)
+	if err != nil || source == nil {
+		return false, err
+	}
+	err = json.Unmarshal(source, v)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// searchAll calls fn with every document that query matches, fetching
+// perPage at a time. query should be sorted on a unique field, so that the
+// pages don't overlap.
+func searchAll(index DocumentIndex, typ string, query DocumentQuery, perPage int, fn func(json.RawMessage) error) error {
+	query.Size = perPage
+	for query.From = 0; ; query.From += perPage {
+		docs, total, err := index.Search(typ, &query)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			err = fn(doc)
+			if err != nil {
+				return err
+			}
+		}
+		if len(docs) == 0 || query.From+len(docs) >= total {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+)
+
+// elasticEmulator answers the DirectAccess calls NewDocumentIndex makes
+// as Elasticsearch would, from a MockDocumentIndex, so that the requests
+// it builds and the responses it parses are exercised without a server.
+type elasticEmulator struct {
+	*elasticsearch.MockIndex
+	docs *MockDocumentIndex
+}
+
+func newElasticEmulator(name string) *elasticEmulator {
+	return &elasticEmulator{MockIndex: elasticsearch.NewMockIndex(name), docs: NewMockDocumentIndex()}
+}
+
+func (emu *elasticEmulator) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != emu.IndexName() {
+		return fmt.Errorf("unexpected endpoint: %s", endpoint)
+	}
+	typ, id := parts[1], parts[2]
+
+	// the body goes over the wire as JSON
+	var body []byte
+	if input != nil {
+		body, err = json.Marshal(input)
+		if err != nil {
+			return err
+		}
+	}
+
+	var result interface{}
+	switch {
+	case verb == "GET":
+		source, err := emu.docs.Get(typ, id)
+		if err != nil {
+			return err
+		}
+		result = map[string]interface{}{"_id": id, "found": source != nil, "_source": source}
+
+	case verb == "PUT":
+		params := u.Query()
+		var version int64
+		if v := params.Get("version"); v != "" {
+			if params.Get("version_type") != "external" {
+				return fmt.Errorf("unexpected versioning: %s", endpoint)
+			}
+			version, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+		ok, err := emu.docs.Put(typ, id, version, json.RawMessage(body), params.Get("op_type") == "create")
+		if err != nil {
+			return err
+		}
+		result = map[string]interface{}{"_id": id, "created": true}
+		if !ok {
+			result = map[string]interface{}{
+				"error":  map[string]string{"type": "version_conflict_engine_exception"},
+				"status": http.StatusConflict,
+			}
+		}
+
+	case verb == "DELETE":
+		source, err := emu.docs.Get(typ, id)
+		if err != nil {
+			return err
+		}
+		err = emu.docs.Delete(typ, id)
+		if err != nil {
+			return err
+		}
+		result = map[string]interface{}{"_id": id, "found": source != nil}
+
+	case verb == "POST" && id == "_mget":
+		var request struct {
+			Ids []string `json:"ids"`
+		}
+		err = json.Unmarshal(body, &request)
+		if err != nil {
+			return err
+		}
+		found, err := emu.docs.MultiGet(typ, request.Ids)
+		if err != nil {
+			return err
+		}
+		var docs []interface{}
+		for _, id := range request.Ids {
+			source, ok := found[id]
+			docs = append(docs, map[string]interface{}{"_id": id, "found": ok, "_source": source})
+		}
+		result = map[string]interface{}{"docs": docs}
+
+	case verb == "POST" && id == "_search":
+		query, err := emulatedQuery(body)
+		if err != nil {
+			return err
+		}
+		docs, total, err := emu.docs.Search(typ, query)
+		if err != nil {
+			return err
+		}
+		var hits []interface{}
+		for _, doc := range docs {
+			hits = append(hits, map[string]interface{}{"_source": doc})
+		}
+		result = map[string]interface{}{"hits": map[string]interface{}{"total": total, "hits": hits}}
+
+	default:
+		return fmt.Errorf("unexpected call: %s %s", verb, endpoint)
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(out, output)
+}
+
+// emulatedQuery reads back the parts of the query DSL that
+// NewDocumentIndex uses.
+func emulatedQuery(body []byte) (*DocumentQuery, error) {
+	var request struct {
+		Query struct {
+			Bool struct {
+				Filter []struct {
+					Terms map[string][]string `json:"terms"`
+					Range map[string]struct {
+						Lt time.Time `json:"lt"`
+					} `json:"range"`
+				} `json:"filter"`
+			} `json:"bool"`
+		} `json:"query"`
+		Sort []map[string]struct {
+			Order string `json:"order"`
+		} `json:"sort"`
+		From int `json:"from"`
+		Size int `json:"size"`
+	}
+	err := json.Unmarshal(body, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &DocumentQuery{From: request.From, Size: request.Size}
+	for _, filter := range request.Query.Bool.Filter {
+		for field, values := range filter.Terms {
+			query.Field, query.Values = field, values
+		}
+		for field, r := range filter.Range {
+			query.BeforeField, query.Before = field, r.Lt
+		}
+	}
+	for _, sort := range request.Sort {
+		for field, s := range sort {
+			query.SortBy, query.Descending = field, s.Order == "desc"
+		}
+	}
+	return query, nil
+}
+
+//---------------------------------------------------------------------
+
+type testDoc struct {
+	Name    string    `json:"name"`
+	Tags    []string  `json:"tags"`
+	When    time.Time `json:"when"`
+	Version int64     `json:"version"`
+}
+
+func TestDocumentIndexes(t *testing.T) {
+	assert := assert.New(t)
+
+	indexes := map[string]DocumentIndex{
+		"mock":    NewMockDocumentIndex(),
+		"elastic": NewDocumentIndex(newElasticEmulator("docs")),
+	}
+	for name, index := range indexes {
+		assert.NoError(index.Prepare("doc", `{"doc": {}}`), name)
+
+		source, err := index.Get("doc", "a")
+		assert.NoError(err, name)
+		assert.Nil(source, name)
+
+		// a create happens once; a versioned write only with a newer version
+		ok, err := index.Put("doc", "a", 1, &testDoc{Name: "a", Version: 1}, true)
+		assert.True(ok, name)
+		assert.NoError(err, name)
+		ok, _ = index.Put("doc", "a", 1, &testDoc{Name: "a", Version: 1}, true)
+		assert.False(ok, name)
+		ok, _ = index.Put("doc", "a", 1, &testDoc{Name: "a", Version: 1}, false)
+		assert.False(ok, name)
+		ok, _ = index.Put("doc", "a", 2, &testDoc{Name: "a", Version: 2}, false)
+		assert.True(ok, name)
+		ok, _ = index.Put("doc", "a", 2, &testDoc{Name: "a", Version: 2}, false)
+		assert.False(ok, name)
+
+		doc := &testDoc{}
+		ok, err = getDocument(index, "doc", "a", doc)
+		assert.True(ok, name)
+		assert.NoError(err, name)
+		assert.EqualValues(2, doc.Version, name)
+
+		// unversioned writes always happen
+		base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i, tag := range []string{"x", "y", "x"} {
+			id := fmt.Sprintf("t%d", i)
+			doc := &testDoc{Name: id, Tags: []string{tag, "all"}, When: base.Add(time.Duration(i) * time.Hour)}
+			ok, err = index.Put("doc", id, 0, doc, false)
+			assert.True(ok, name)
+			assert.NoError(err, name)
+		}
+		ok, _ = index.Put("doc", "t0", 0, &testDoc{Name: "t0", Tags: []string{"x", "all"}, When: base}, false)
+		assert.True(ok, name)
+
+		found, err := index.MultiGet("doc", []string{"a", "t1", "none"})
+		assert.NoError(err, name)
+		assert.Len(found, 2, name)
+		assert.Contains(found, "t1", name)
+
+		names := func(docs []json.RawMessage) []string {
+			var out []string
+			for _, source := range docs {
+				doc := &testDoc{}
+				assert.NoError(json.Unmarshal(source, doc), name)
+				out = append(out, doc.Name)
+			}
+			return out
+		}
+
+		docs, total, err := index.Search("doc", &DocumentQuery{Field: "tags", Values: []string{"x"}, SortBy: "when", Descending: true, Size: 10})
+		assert.NoError(err, name)
+		assert.Equal(2, total, name)
+		assert.Equal([]string{"t2", "t0"}, names(docs), name)
+
+		docs, total, _ = index.Search("doc", &DocumentQuery{Field: "tags", Values: []string{"all"}, SortBy: "when", From: 1, Size: 1})
+		assert.Equal(3, total, name)
+		assert.Equal([]string{"t1"}, names(docs), name)
+
+		docs, total, _ = index.Search("doc", &DocumentQuery{BeforeField: "when", Before: base.Add(90 * time.Minute), SortBy: "name", Size: 10})
+		assert.Equal(3, total, name)
+		assert.Equal([]string{"a", "t0", "t1"}, names(docs), name)
+
+		var all []string
+		err = searchAll(index, "doc", DocumentQuery{SortBy: "name"}, 2, func(source json.RawMessage) error {
+			all = append(all, names([]json.RawMessage{source})...)
+			return nil
+		})
+		assert.NoError(err, name)
+		assert.Equal([]string{"a", "t0", "t1", "t2"}, all, name)
+
+		// deleting twice is fine
+		assert.NoError(index.Delete("doc", "a"), name)
+		assert.NoError(index.Delete("doc", "a"), name)
+		source, _ = index.Get("doc", "a")
+		assert.Nil(source, name)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// stringListType is what JsonResponse.SetType gives a []string.
+const stringListType = "string-list"
+
+// room for a full batch of UUIDs and the envelope
+const encodeBufferSize = 64 + 39*DefaultMaxCount
+
+var encodeBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, encodeBufferSize)
+		return &b
+	},
+}
+
+// ginReturnStringList is piazza.GinReturnJson for a response whose data is a
+// []string, as returned by PostUuids. It writes the envelope directly, and
+// produces exactly the bytes gin's JSON rendering would. Any response it
+// can't write that way is passed on to GinReturnJson.
+func ginReturnStringList(c *gin.Context, resp *piazza.JsonResponse) {
+	data, ok := resp.Data.([]string)
+	if !ok || resp.Type != stringListType || resp.Pagination != nil ||
+		resp.Message != "" || resp.Origin != "" || resp.Inner != nil || resp.Metadata != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	bufp := encodeBuffers.Get().(*[]byte)
+	defer encodeBuffers.Put(bufp)
+
+	buf, ok := appendStringList((*bufp)[:0], resp.StatusCode, data)
+	if !ok {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	*bufp = buf
+
+	c.Writer.Header()["Content-Type"] = []string{"application/json; charset=utf-8"}
+	c.Status(resp.StatusCode)
+	_, _ = c.Writer.Write(buf)
+}
+
+// appendStringList appends what json.Encoder would write for a JsonResponse
+// holding just a status code and a string list. It reports false, having
+// appended nothing useful, if any string needs escaping.
+func appendStringList(dst []byte, statusCode int, data []string) ([]byte, bool) {
+	dst = append(dst, `{"statusCode":`...)
+	dst = strconv.AppendInt(dst, int64(statusCode), 10)
+	dst = append(dst, `,"type":"`+stringListType+`"`...)
+
+	// data is an interface, so omitempty doesn't apply to an empty list
+	if data == nil {
+		dst = append(dst, `,"data":null`...)
+	} else {
+		dst = append(dst, `,"data":[`...)
+		for i, s := range data {
+			if !plainJsonString(s) {
+				return dst, false
+			}
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, '"')
+			dst = append(dst, s...)
+			dst = append(dst, '"')
+		}
+		dst = append(dst, ']')
+	}
+
+	dst = append(dst, "}\n"...)
+	return dst, true
+}
+
+// plainJsonString reports whether encoding/json would write s as is, with no
+// escapes. UUIDs always qualify.
+func plainJsonString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if b < 0x20 || b >= 0x80 || b == '"' || b == '\\' || b == '<' || b == '>' || b == '&' {
+			return false
+		}
+	}
+	return true
+}
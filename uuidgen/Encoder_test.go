@@ -0,0 +1,111 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// serveBoth renders resp through both the generic and the specialized path.
+func serveBoth(resp *piazza.JsonResponse) (generic *httptest.ResponseRecorder, special *httptest.ResponseRecorder) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.GET("/generic", func(c *gin.Context) { piazza.GinReturnJson(c, resp) })
+	router.GET("/special", func(c *gin.Context) { ginReturnStringList(c, resp) })
+
+	generic = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/generic", nil)
+	router.ServeHTTP(generic, req)
+
+	special = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/special", nil)
+	router.ServeHTTP(special, req)
+
+	return generic, special
+}
+
+func TestStringListEncoder(t *testing.T) {
+	assert := assert.New(t)
+
+	uuids, err := newUuids(NewSeededSource(5), DefaultMaxCount)
+	assert.NoError(err)
+
+	cases := [][]string{
+		uuids,
+		uuids[:1],
+		{},
+		nil,
+		{"a\"b", "<&>", "é", "tab\there"}, // not plain: falls back
+	}
+
+	for _, data := range cases {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusCreated, Type: stringListType, Data: data}
+		generic, special := serveBoth(resp)
+		assert.Equal(generic.Code, special.Code)
+		assert.Equal(generic.Header().Get("Content-Type"), special.Header().Get("Content-Type"))
+		assert.Equal(generic.Body.String(), special.Body.String())
+
+		// and the client can still read it
+		var jresp piazza.JsonResponse
+		assert.NoError(json.Unmarshal(special.Body.Bytes(), &jresp))
+		var out []string
+		if len(data) > 0 {
+			assert.NoError(jresp.ExtractData(&out))
+			assert.Equal(data, out)
+		}
+	}
+
+	// anything else in the envelope also falls back
+	resp := &piazza.JsonResponse{StatusCode: http.StatusCreated, Type: stringListType, Data: uuids[:3], Origin: "here"}
+	generic, special := serveBoth(resp)
+	assert.Equal(generic.Body.String(), special.Body.String())
+}
+
+//---------------------------------------------------------------------
+
+func benchmarkReturn(b *testing.B, write func(*gin.Context, *piazza.JsonResponse)) {
+	uuids, err := newUuids(NewCryptoSource(), DefaultMaxCount)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		write(c, &piazza.JsonResponse{StatusCode: http.StatusCreated, Type: stringListType, Data: uuids})
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkGinReturnJson255(b *testing.B) {
+	benchmarkReturn(b, piazza.GinReturnJson)
+}
+
+func BenchmarkGinReturnStringList255(b *testing.B) {
+	benchmarkReturn(b, ginReturnStringList)
+}
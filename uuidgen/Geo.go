@@ -0,0 +1,436 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// Geo IDs are version 8 UUIDs that sort by place, then by time. The 128
+// bits are, from the top:
+//
+//	48  cell, high bits
+//	 4  version, 8
+//	 4  marker, 0xc
+//	 8  cell, low bits
+//	 2  variant, 10
+//	 1  scheme: 0 geohash, 1 quadkey
+//	 5  precision: geohash characters, or quadkey level
+//	40  milliseconds since geoEpoch
+//	16  random
+//
+// The 56-bit cell is left-aligned and zero-filled, so a cell's IDs sort
+// next to those of the cells inside it.
+const (
+	GeoGeohash = "geohash"
+	GeoQuadkey = "quadkey"
+
+	MaxGeohashPrecision = 11 // about 15cm
+	MaxQuadkeyLevel     = 28 // about 15cm at the equator
+
+	DefaultGeohashPrecision = 8
+	DefaultQuadkeyLevel     = 18
+
+	geoCellBits = 56
+	geoMarker   = 0xc
+	geoTimeBits = 40
+
+	// the edge of the Web Mercator square
+	maxMercatorLat = 85.05112878
+)
+
+// geoEpoch is when geo ID time starts; 40 bits of milliseconds last until
+// 2050.
+var geoEpoch = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// GeoCell is what a geo ID says about where and when it was made.
+type GeoCell struct {
+	Uuid      string     `json:"uuid"`
+	Scheme    string     `json:"scheme"`
+	Precision int        `json:"precision"`
+	Cell      string     `json:"cell"` // geohash, or quadkey digits
+	Bbox      [4]float64 `json:"bbox"` // west, south, east, north
+	CreatedOn time.Time  `json:"createdOn"`
+}
+
+//---------------------------------------------------------------------
+
+// geoBitsPer is the number of cell bits in one unit of precision.
+func geoBitsPer(scheme string) uint {
+	if scheme == GeoQuadkey {
+		return 2
+	}
+	return 5
+}
+
+func maxGeoPrecision(scheme string) int {
+	if scheme == GeoQuadkey {
+		return MaxQuadkeyLevel
+	}
+	return MaxGeohashPrecision
+}
+
+// geoCellOf returns the cell holding a point, as right-aligned bits.
+func geoCellOf(scheme string, lat float64, lon float64, precision int) uint64 {
+	if scheme == GeoQuadkey {
+		return quadkeyOf(lat, lon, precision)
+	}
+	return geohashOf(lat, lon, precision)
+}
+
+func geohashOf(lat float64, lon float64, precision int) uint64 {
+	latLo, latHi := -90.0, 90.0
+	lonLo, lonHi := -180.0, 180.0
+	var cell uint64
+	for i := 0; i < 5*precision; i++ {
+		cell <<= 1
+		if i%2 == 0 {
+			mid := (lonLo + lonHi) / 2
+			if lon >= mid {
+				cell |= 1
+				lonLo = mid
+			} else {
+				lonHi = mid
+			}
+		} else {
+			mid := (latLo + latHi) / 2
+			if lat >= mid {
+				cell |= 1
+				latLo = mid
+			} else {
+				latHi = mid
+			}
+		}
+	}
+	return cell
+}
+
+func quadkeyOf(lat float64, lon float64, level int) uint64 {
+	lat = math.Max(-maxMercatorLat, math.Min(maxMercatorLat, lat))
+	sinLat := math.Sin(lat * math.Pi / 180)
+	x := (lon + 180) / 360
+	y := 0.5 - math.Log((1+sinLat)/(1-sinLat))/(4*math.Pi)
+
+	n := float64(uint64(1) << uint(level))
+	tx := uint64(math.Max(0, math.Min(n-1, math.Floor(x*n))))
+	ty := uint64(math.Max(0, math.Min(n-1, math.Floor(y*n))))
+
+	var cell uint64
+	for i := level - 1; i >= 0; i-- {
+		cell = cell<<2 | ((ty>>uint(i))&1)<<1 | (tx>>uint(i))&1
+	}
+	return cell
+}
+
+// geoBbox returns the west, south, east and north edges of a cell.
+func geoBbox(scheme string, cell uint64, precision int) [4]float64 {
+	if scheme == GeoQuadkey {
+		var tx, ty uint64
+		for i := 0; i < precision; i++ {
+			digit := cell >> uint(2*(precision-1-i)) & 3
+			tx = tx<<1 | digit&1
+			ty = ty<<1 | digit>>1
+		}
+		n := float64(uint64(1) << uint(precision))
+		lat := func(y float64) float64 {
+			return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi
+		}
+		return [4]float64{
+			float64(tx)/n*360 - 180, lat(float64(ty + 1)),
+			float64(tx+1)/n*360 - 180, lat(float64(ty)),
+		}
+	}
+
+	latLo, latHi := -90.0, 90.0
+	lonLo, lonHi := -180.0, 180.0
+	nbits := 5 * precision
+	for i := 0; i < nbits; i++ {
+		bit := cell >> uint(nbits-1-i) & 1
+		if i%2 == 0 {
+			mid := (lonLo + lonHi) / 2
+			if bit == 1 {
+				lonLo = mid
+			} else {
+				lonHi = mid
+			}
+		} else {
+			mid := (latLo + latHi) / 2
+			if bit == 1 {
+				latLo = mid
+			} else {
+				latHi = mid
+			}
+		}
+	}
+	return [4]float64{lonLo, latLo, lonHi, latHi}
+}
+
+// geoCellString is the usual text form of a cell.
+func geoCellString(scheme string, cell uint64, precision int) string {
+	bitsPer := geoBitsPer(scheme)
+	out := make([]byte, precision)
+	for i := range out {
+		digit := cell >> (bitsPer * uint(precision-1-i)) & (1<<bitsPer - 1)
+		if scheme == GeoQuadkey {
+			out[i] = byte('0' + digit)
+		} else {
+			out[i] = geohashAlphabet[digit]
+		}
+	}
+	return string(out)
+}
+
+// geoBboxCell returns the smallest cell, no finer than precision, that
+// holds the whole box. Cells are rectangles, so that is the longest common
+// prefix of the cells of two opposite corners.
+func geoBboxCell(scheme string, bbox [4]float64, precision int) (uint64, int) {
+	sw := geoCellOf(scheme, bbox[1], bbox[0], precision)
+	ne := geoCellOf(scheme, bbox[3], bbox[2], precision)
+	if scheme == GeoQuadkey {
+		// y runs north to south, so the corners are NW and SE
+		sw = geoCellOf(scheme, bbox[3], bbox[0], precision)
+		ne = geoCellOf(scheme, bbox[1], bbox[2], precision)
+	}
+	bitsPer := geoBitsPer(scheme)
+	for sw != ne {
+		sw >>= bitsPer
+		ne >>= bitsPer
+		precision--
+	}
+	return sw, precision
+}
+
+//---------------------------------------------------------------------
+
+// newGeoUuid lays out a geo ID; see above.
+func newGeoUuid(src RandomSource, scheme string, cell uint64, precision int, now time.Time) (string, error) {
+	random := make([]byte, 2)
+	_, err := io.ReadFull(src, random)
+	if err != nil {
+		return "", err
+	}
+
+	field := cell << (geoCellBits - geoBitsPer(scheme)*uint(precision))
+	hi := field>>8<<16 | 0x8<<12 | geoMarker<<8 | field&0xff
+
+	var schemeBit uint64
+	if scheme == GeoQuadkey {
+		schemeBit = 1
+	}
+	ms := uint64(now.Sub(geoEpoch)/time.Millisecond) & (1<<geoTimeBits - 1)
+	lo := uint64(0x2)<<62 | schemeBit<<61 | uint64(precision)<<56 | ms<<16 | uint64(binary.BigEndian.Uint16(random))
+
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, hi)
+	binary.BigEndian.PutUint64(b[8:], lo)
+	out := make([]byte, 36)
+	encodeUuid(out, b)
+	return string(out), nil
+}
+
+// DecodeGeoUuid recovers the cell and time from a geo ID. It checks the
+// layout, but other version 8 IDs can pass by chance; only the service's
+// records say for sure that an ID is a geo ID.
+func DecodeGeoUuid(uuid string) (*GeoCell, error) {
+	b, ok := parseUuid(uuid)
+	if !ok {
+		return nil, fmt.Errorf("invalid uuid: %s", uuid)
+	}
+	hi := binary.BigEndian.Uint64(b)
+	lo := binary.BigEndian.Uint64(b[8:])
+	if hi>>12&0xf != 0x8 || hi>>8&0xf != geoMarker || lo>>62 != 0x2 {
+		return nil, fmt.Errorf("not a geo uuid: %s", uuid)
+	}
+
+	scheme := GeoGeohash
+	if lo>>61&1 == 1 {
+		scheme = GeoQuadkey
+	}
+	precision := int(lo >> 56 & 0x1f)
+	if precision > maxGeoPrecision(scheme) {
+		return nil, fmt.Errorf("not a geo uuid: %s", uuid)
+	}
+
+	field := hi>>16<<8 | hi&0xff
+	shift := geoCellBits - geoBitsPer(scheme)*uint(precision)
+	if field&(1<<shift-1) != 0 {
+		return nil, fmt.Errorf("not a geo uuid: %s", uuid)
+	}
+	cell := field >> shift
+
+	ms := int64(lo >> 16 & (1<<geoTimeBits - 1))
+	return &GeoCell{
+		Uuid:      uuid,
+		Scheme:    scheme,
+		Precision: precision,
+		Cell:      geoCellString(scheme, cell, precision),
+		Bbox:      geoBbox(scheme, cell, precision),
+		CreatedOn: geoEpoch.Add(time.Duration(ms) * time.Millisecond).UTC(),
+	}, nil
+}
+
+//---------------------------------------------------------------------
+
+// PostGeoUuids generates geo IDs for a point or a box.
+//
+//	?count=INT        as for PostUuids
+//	?lat=NUM&lon=NUM  the point
+//	?bbox=W,S,E,N     or the box: the IDs get the smallest cell holding it
+//	?scheme=STRING    "geohash" (the default) or "quadkey"
+//	?precision=INT    geohash characters, or quadkey level
+func (service *Service) PostGeoUuids(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	count, err := params.GetCount(1)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if count < 0 || count > service.maxCount {
+		s := fmt.Sprintf("query argument out of range: %d", count)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+
+	scheme, err := params.GetAsString("scheme", GeoGeohash)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	defaultPrecision := DefaultGeohashPrecision
+	switch scheme {
+	case GeoGeohash:
+	case GeoQuadkey:
+		defaultPrecision = DefaultQuadkeyLevel
+	default:
+		return service.newErrorResponse(http.StatusBadRequest, "invalid scheme: "+scheme)
+	}
+	precision, err := params.GetAsInt("precision", defaultPrecision)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if precision < 1 || precision > maxGeoPrecision(scheme) {
+		s := fmt.Sprintf("precision out of range: %d", precision)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+
+	bbox, err := geoParams(params)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	cell, precision := geoBboxCell(scheme, bbox, precision)
+
+	generate := func(n int) ([]string, error) {
+		now := time.Now()
+		uuids := make([]string, n)
+		for i := range uuids {
+			uuid, err := newGeoUuid(service.random, scheme, cell, precision, now)
+			if err != nil {
+				return nil, err
+			}
+			uuids[i] = uuid
+		}
+		return uuids, nil
+	}
+
+	// with only 16 random bits in a cell, a claim could take one
+	uuids, err := generate(count)
+	if err == nil {
+		uuids, err = service.skipKnown(uuids, generate)
+	}
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen could not make geo uuids: %s", err.Error())
+		return service.newErrorResponse(http.StatusServiceUnavailable, err.Error())
+	}
+	err = service.noteIssued(uuids)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	atomic.AddInt64(&service.numUUIDs, int64(count))
+	atomic.AddInt64(&service.numRequests, 1)
+
+	return &piazza.JsonResponse{StatusCode: http.StatusCreated, Type: stringListType, Data: uuids}
+}
+
+// geoParams reads a point, as a box with no size, or a box.
+func geoParams(params *piazza.HttpQueryParams) ([4]float64, error) {
+	var bbox [4]float64
+
+	spec, err := params.GetAsString("bbox", "")
+	if err != nil {
+		return bbox, err
+	}
+	if spec != "" {
+		parts := strings.Split(spec, ",")
+		if len(parts) != 4 {
+			return bbox, fmt.Errorf("invalid bbox: %s", spec)
+		}
+		for i, part := range parts {
+			bbox[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return bbox, fmt.Errorf("invalid bbox: %s", spec)
+			}
+		}
+		if bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+			return bbox, fmt.Errorf("invalid bbox, edges out of order: %s", spec)
+		}
+	} else {
+		var lat, lon float64
+		for _, p := range []struct {
+			key   string
+			value *float64
+		}{{"lat", &lat}, {"lon", &lon}} {
+			s, err := params.GetAsString(p.key, "")
+			if err != nil {
+				return bbox, err
+			}
+			if s == "" {
+				return bbox, fmt.Errorf("need lat and lon, or bbox")
+			}
+			*p.value, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				return bbox, fmt.Errorf("invalid %s: %s", p.key, s)
+			}
+		}
+		bbox = [4]float64{lon, lat, lon, lat}
+	}
+
+	if bbox[0] < -180 || bbox[2] > 180 || bbox[1] < -90 || bbox[3] > 90 {
+		return bbox, fmt.Errorf("coordinates out of range")
+	}
+	return bbox, nil
+}
+
+// GetGeoUuid decodes a geo ID.
+func (service *Service) GetGeoUuid(uuid string) *piazza.JsonResponse {
+	cell, err := DecodeGeoUuid(uuid)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: cell}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
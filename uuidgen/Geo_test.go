@@ -0,0 +1,117 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+func TestGeoCells(t *testing.T) {
+	assert := assert.New(t)
+
+	// the example from the geohash article on Wikipedia
+	cell := geohashOf(57.64911, 10.40744, 11)
+	assert.Equal("u4pruydqqvj", geoCellString(GeoGeohash, cell, 11))
+	bbox := geoBbox(GeoGeohash, cell, 11)
+	assert.InDelta(10.40744, (bbox[0]+bbox[2])/2, 1e-5)
+	assert.InDelta(57.64911, (bbox[1]+bbox[3])/2, 1e-5)
+
+	// and from Bing Maps' tile system article: tile x=3, y=5 at level 3
+	bbox = geoBbox(GeoQuadkey, 0x27, 3) // 2, 1, 3
+	assert.Equal(-45.0, bbox[0])
+	assert.Equal(0.0, bbox[2])
+	cell = quadkeyOf((bbox[1]+bbox[3])/2, (bbox[0]+bbox[2])/2, 3)
+	assert.Equal("213", geoCellString(GeoQuadkey, cell, 3))
+
+	// a box gets the smallest cell holding it
+	cell, precision := geoBboxCell(GeoGeohash, [4]float64{10.40, 57.64, 10.41, 57.65}, 8)
+	assert.Equal("u4pru", geoCellString(GeoGeohash, cell, precision))
+	_, precision = geoBboxCell(GeoGeohash, [4]float64{-1, -1, 1, 1}, 8)
+	assert.Equal(0, precision)
+}
+
+func TestGeoUuids(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 11, 5, 12, 0, 0, 0, time.UTC)
+	src := NewSeededSource(47)
+
+	for _, scheme := range []string{GeoGeohash, GeoQuadkey} {
+		for _, precision := range []int{0, 1, 5, maxGeoPrecision(scheme)} {
+			cell := geoCellOf(scheme, -33.8688, 151.2093, precision)
+			uuid, err := newGeoUuid(src, scheme, cell, precision, now)
+			assert.NoError(err)
+			assert.True(ValidUuid(uuid))
+
+			decoded, err := DecodeGeoUuid(uuid)
+			assert.NoError(err)
+			assert.Equal(scheme, decoded.Scheme)
+			assert.Equal(precision, decoded.Precision)
+			assert.Equal(geoCellString(scheme, cell, precision), decoded.Cell)
+			assert.True(decoded.Bbox[0] <= 151.2093 && 151.2093 <= decoded.Bbox[2])
+			assert.True(decoded.Bbox[1] <= -33.8688 && -33.8688 <= decoded.Bbox[3])
+			assert.Equal(now, decoded.CreatedOn)
+		}
+	}
+
+	// sorted, IDs group by cell, and by time within one
+	var uuids []string
+	for i, p := range [][2]float64{{57.64911, 10.40744}, {-33.8688, 151.2093}, {57.64912, 10.40745}} {
+		uuid, err := newGeoUuid(src, GeoGeohash, geohashOf(p[0], p[1], 8), 8, now.Add(time.Duration(i)*time.Second))
+		assert.NoError(err)
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	first, _ := DecodeGeoUuid(uuids[0])
+	second, _ := DecodeGeoUuid(uuids[1])
+	third, _ := DecodeGeoUuid(uuids[2])
+	assert.Equal("r3gx2f77", first.Cell)
+	assert.Equal(second.Cell, third.Cell)
+	assert.True(second.CreatedOn.Before(third.CreatedOn))
+
+	plain, _ := newUuids(src, 1)
+	_, err := DecodeGeoUuid(plain[0])
+	assert.Error(err)
+}
+
+func TestPostGeoUuids(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+	post := func(query string) *piazza.JsonResponse {
+		req, _ := http.NewRequest("POST", "/geo-uuids?"+query, nil)
+		return service.PostGeoUuids(piazza.NewQueryParams(req))
+	}
+
+	resp := post("count=3&lat=57.64911&lon=10.40744&precision=6")
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	for _, uuid := range resp.Data.([]string) {
+		resp := service.GetGeoUuid(uuid)
+		assert.Equal("u4pruy", resp.Data.(*GeoCell).Cell)
+	}
+
+	resp = post("bbox=10.40,57.64,10.41,57.65&scheme=quadkey")
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+
+	for _, bad := range []string{"lat=1", "lat=x&lon=1", "lat=91&lon=0", "bbox=1,2,3", "bbox=3,0,1,1", "lat=0&lon=0&scheme=h3", "lat=0&lon=0&precision=12"} {
+		assert.Equal(http.StatusBadRequest, post(bad).StatusCode, bad)
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// The health tests follow NIST SP 800-90B section 4.4, treating each byte
+// as one sample, plus a monobit test on 20,000-bit blocks. All three are
+// set for the same false-positive rate, so a healthy source fails one about
+// once every 2^30 samples or blocks; a continuous failure only counts as a
+// source failure if healthFailureLimit reads in a row fail.
+const (
+	// assumed min-entropy per byte of the source
+	healthEntropyBits = 7.0
+
+	// false-positive rate of each test: 2^-30
+	healthAlphaLog2 = 30.0
+
+	// consecutive failed reads that mark a source as failed for good
+	healthFailureLimit = 3
+
+	// samples per adaptive proportion test window (non-binary sources)
+	proportionWindow = 512
+
+	// monobit: 20,000 bits per block. FIPS 140-2's bounds, 9725 to 10275,
+	// fail a healthy source once in about 10^4 blocks, too often to run
+	// on every byte; the bounds used are from monobitCutoff.
+	monobitBlockBytes = 2500
+
+	// bytes drawn from the source and tested before it is first used
+	startupSampleBytes = 4096
+)
+
+// ErrEntropyFailure is returned by a HealthCheckedSource once any of its
+// tests has failed. The failure is latched: the source stays unusable.
+var ErrEntropyFailure = errors.New("random source failed its health tests")
+
+// HealthReport describes the state of a HealthCheckedSource, for the
+// diagnostics endpoint.
+type HealthReport struct {
+	Healthy          bool      `json:"healthy"`
+	KnownAnswerTests bool      `json:"knownAnswerTests"`
+	StartupTests     bool      `json:"startupTests"`
+	Failure          string    `json:"failure,omitempty"`
+	FailedOn         time.Time `json:"failedOn,omitempty"`
+	BytesTested      int64     `json:"bytesTested"`
+	MonobitBlocks    int64     `json:"monobitBlocks"`
+	RepetitionCutoff int       `json:"repetitionCutoff"`
+	ProportionCutoff int       `json:"proportionCutoff"`
+	ProportionWindow int       `json:"proportionWindow"`
+	MonobitCutoff    int       `json:"monobitCutoff"`
+
+	// TransientFailures counts reads that failed a continuous test and
+	// were discarded, without failing the source.
+	TransientFailures int64 `json:"transientFailures"`
+}
+
+//---------------------------------------------------------------------
+
+// healthTester runs the three continuous tests over a stream of bytes.
+type healthTester struct {
+	repetitionCutoff int
+	proportionCutoff int
+	monobitCutoff    int
+
+	// repetition count test
+	last     byte
+	runCount int
+	started  bool
+
+	// adaptive proportion test
+	windowFirst byte
+	windowIndex int
+	windowCount int
+
+	// monobit test
+	blockIndex int
+	blockOnes  int
+
+	bytesTested   int64
+	monobitBlocks int64
+}
+
+func newHealthTester() *healthTester {
+	return &healthTester{
+		repetitionCutoff: repetitionCutoff(healthEntropyBits, healthAlphaLog2),
+		proportionCutoff: proportionCutoff(proportionWindow, healthEntropyBits, healthAlphaLog2),
+		monobitCutoff:    monobitCutoff(monobitBlockBytes*8, healthAlphaLog2),
+	}
+}
+
+// reset starts the tests afresh, keeping the counts of what was tested.
+func (t *healthTester) reset() {
+	*t = healthTester{
+		repetitionCutoff: t.repetitionCutoff,
+		proportionCutoff: t.proportionCutoff,
+		monobitCutoff:    t.monobitCutoff,
+		bytesTested:      t.bytesTested,
+		monobitBlocks:    t.monobitBlocks,
+	}
+}
+
+// repetitionCutoff is C = 1 + ceil(-log2(alpha) / H), per 800-90B 4.4.1.
+func repetitionCutoff(h float64, alphaLog2 float64) int {
+	return 1 + int(math.Ceil(alphaLog2/h))
+}
+
+// proportionCutoff is the smallest C with P(X >= C) <= alpha, where X is
+// the number of times the window's first sample recurs in the remaining
+// window-1 samples, X ~ Binomial(window-1, 2^-H). See 800-90B 4.4.2.
+func proportionCutoff(window int, h float64, alphaLog2 float64) int {
+	n := window - 1
+	p := math.Pow(2, -h)
+	alpha := math.Pow(2, -alphaLog2)
+
+	logPmf := func(k int) float64 {
+		lc, _ := math.Lgamma(float64(n + 1))
+		lk, _ := math.Lgamma(float64(k + 1))
+		lnk, _ := math.Lgamma(float64(n - k + 1))
+		return lc - lk - lnk + float64(k)*math.Log(p) + float64(n-k)*math.Log(1-p)
+	}
+
+	// walk down from the top, accumulating the upper tail
+	tail := 0.0
+	for c := n; c >= 0; c-- {
+		tail += math.Exp(logPmf(c))
+		if tail > alpha {
+			return c + 2 // c+1 is the last value whose tail is within alpha; +1 for the first sample
+		}
+	}
+	return 1
+}
+
+// monobitCutoff is the largest distance of the ones count in a block of n
+// bits from n/2 that a fair source exceeds with probability alpha, by the
+// normal approximation: P(|Z| > z) = erfc(z/sqrt(2)) = alpha. For 2^-30
+// and 20,000 bits it is 433, where FIPS 140-2 uses 275.
+func monobitCutoff(n int, alphaLog2 float64) int {
+	z := math.Sqrt2 * math.Erfcinv(math.Pow(2, -alphaLog2))
+	return int(math.Ceil(z * math.Sqrt(float64(n)) / 2))
+}
+
+// check feeds bytes through the tests, returning a description of the
+// first failure.
+func (t *healthTester) check(b []byte) error {
+	for _, x := range b {
+		t.bytesTested++
+
+		// repetition count
+		if t.started && x == t.last {
+			t.runCount++
+			if t.runCount >= t.repetitionCutoff {
+				return fmt.Errorf("repetition count test: byte 0x%02x repeated %d times", x, t.runCount)
+			}
+		} else {
+			t.last = x
+			t.runCount = 1
+			t.started = true
+		}
+
+		// adaptive proportion
+		if t.windowIndex == 0 {
+			t.windowFirst = x
+			t.windowCount = 1
+		} else if x == t.windowFirst {
+			t.windowCount++
+			if t.windowCount >= t.proportionCutoff {
+				return fmt.Errorf("adaptive proportion test: byte 0x%02x seen %d times in %d", x, t.windowCount, proportionWindow)
+			}
+		}
+		t.windowIndex++
+		if t.windowIndex == proportionWindow {
+			t.windowIndex = 0
+		}
+
+		// monobit
+		t.blockOnes += bits.OnesCount8(x)
+		t.blockIndex++
+		if t.blockIndex == monobitBlockBytes {
+			ones := t.blockOnes
+			t.blockIndex = 0
+			t.blockOnes = 0
+			t.monobitBlocks++
+			if ones-monobitBlockBytes*4 > t.monobitCutoff || monobitBlockBytes*4-ones > t.monobitCutoff {
+				return fmt.Errorf("monobit test: %d ones in %d bits", ones, monobitBlockBytes*8)
+			}
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+
+// knownAnswerTests checks that the testers themselves work: each must reject
+// a stream it is designed to catch, and all must pass a reasonable stream.
+func knownAnswerTests() error {
+	expectFailure := func(name string, stream []byte) error {
+		if newHealthTester().check(stream) == nil {
+			return fmt.Errorf("known-answer test: %s not detected", name)
+		}
+		return nil
+	}
+
+	stuck := make([]byte, 64)
+	for i := range stuck {
+		stuck[i] = 0xa5
+	}
+	err := expectFailure("stuck-at value", stuck)
+	if err != nil {
+		return err
+	}
+
+	// no long runs, but one value in every other position
+	biased := make([]byte, proportionWindow)
+	for i := range biased {
+		if i%2 == 0 {
+			biased[i] = 0x3c
+		} else {
+			biased[i] = byte(i)
+		}
+	}
+	err = expectFailure("biased value", biased)
+	if err != nil {
+		return err
+	}
+
+	// every byte different from its neighbours and from the first in the
+	// window, but with too many bits set
+	heavy := make([]byte, monobitBlockBytes)
+	ones := []byte{0xfe, 0xfd, 0xfb, 0xf7, 0xef, 0xdf, 0xbf, 0x7f}
+	for i := range heavy {
+		heavy[i] = ones[i%len(ones)]
+	}
+	heavy[0] = 0xff
+	err = expectFailure("monobit bias", heavy)
+	if err != nil {
+		return err
+	}
+
+	good := make([]byte, 4*monobitBlockBytes)
+	_, err = io.ReadFull(NewSeededSource(20161001), good)
+	if err != nil {
+		return err
+	}
+	err = newHealthTester().check(good)
+	if err != nil {
+		return fmt.Errorf("known-answer test: good stream rejected: %s", err.Error())
+	}
+
+	return nil
+}
+
+//---------------------------------------------------------------------
+
+// HealthCheckedSource wraps a RandomSource and runs every byte it produces
+// through the continuous health tests. A read that fails them is discarded
+// and read again; once healthFailureLimit reads in a row fail, or the
+// startup tests fail, every read returns ErrEntropyFailure.
+type HealthCheckedSource struct {
+	sync.Mutex
+	source      RandomSource
+	tester      *healthTester
+	report      HealthReport
+	consecutive int // failed reads in a row
+	onFailure   func(reason string)
+}
+
+// NewHealthCheckedSource runs the known-answer tests and the startup tests
+// on source. onFailure, if not nil, is called once, on the first failure.
+// A failure at startup is not an error here: the source is simply unusable,
+// and says why in its report.
+func NewHealthCheckedSource(source RandomSource, onFailure func(reason string)) *HealthCheckedSource {
+	src := &HealthCheckedSource{
+		source:    source,
+		tester:    newHealthTester(),
+		onFailure: onFailure,
+	}
+	src.report.Healthy = true
+	src.report.RepetitionCutoff = src.tester.repetitionCutoff
+	src.report.ProportionCutoff = src.tester.proportionCutoff
+	src.report.ProportionWindow = proportionWindow
+	src.report.MonobitCutoff = src.tester.monobitCutoff
+
+	src.Lock()
+	defer src.Unlock()
+
+	err := knownAnswerTests()
+	if err != nil {
+		src.fail(err.Error())
+		return src
+	}
+	src.report.KnownAnswerTests = true
+
+	sample := make([]byte, startupSampleBytes)
+	_, err = io.ReadFull(src.source, sample)
+	if err == nil {
+		err = src.tester.check(sample)
+	}
+	if err != nil {
+		src.fail("startup test: " + err.Error())
+		return src
+	}
+	src.report.StartupTests = true
+
+	return src
+}
+
+// must be called with the lock held
+func (src *HealthCheckedSource) fail(reason string) {
+	if !src.report.Healthy {
+		return
+	}
+	src.report.Healthy = false
+	src.report.Failure = reason
+	src.report.FailedOn = time.Now()
+	if src.onFailure != nil {
+		src.onFailure(reason)
+	}
+}
+
+func (src *HealthCheckedSource) Read(b []byte) (int, error) {
+	src.Lock()
+	defer src.Unlock()
+
+	if !src.report.Healthy {
+		return 0, ErrEntropyFailure
+	}
+
+	for {
+		n, err := io.ReadFull(src.source, b)
+		if err != nil {
+			return n, err
+		}
+
+		err = src.tester.check(b)
+		if err == nil {
+			src.consecutive = 0
+			return n, nil
+		}
+
+		src.report.TransientFailures++
+		src.consecutive++
+		if src.consecutive >= healthFailureLimit {
+			src.fail(err.Error())
+			return 0, ErrEntropyFailure
+		}
+		src.tester.reset()
+	}
+}
+
+// Report returns the current state of the tests.
+func (src *HealthCheckedSource) Report() *HealthReport {
+	src.Lock()
+	defer src.Unlock()
+
+	report := src.report
+	report.BytesTested = src.tester.bytesTested
+	report.MonobitBlocks = src.tester.monobitBlocks
+	return &report
+}
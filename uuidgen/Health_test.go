@@ -0,0 +1,79 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+// glitchySource is a healthy source that returns zeros on a few reads.
+type glitchySource struct {
+	good   RandomSource
+	reads  int
+	glitch map[int]bool
+}
+
+func (src *glitchySource) Read(b []byte) (int, error) {
+	src.reads++
+	if src.glitch[src.reads] {
+		for i := range b {
+			b[i] = 0
+		}
+		return len(b), nil
+	}
+	return src.good.Read(b)
+}
+
+func TestHealthCutoffs(t *testing.T) {
+	assert := assert.New(t)
+
+	tester := newHealthTester()
+	assert.Equal(6, tester.repetitionCutoff)
+	assert.Equal(433, tester.monobitCutoff)
+	assert.NoError(knownAnswerTests())
+}
+
+func TestHealthTransientFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	var failures []string
+	onFailure := func(reason string) { failures = append(failures, reason) }
+
+	// the reads after the startup sample: one bad read is discarded, and
+	// later two in a row are, but the source stays healthy
+	src := &glitchySource{good: NewSeededSource(3), glitch: map[int]bool{3: true, 6: true, 7: true}}
+	checked := NewHealthCheckedSource(src, onFailure)
+	b := make([]byte, 16)
+	for i := 0; i < 5; i++ {
+		_, err := checked.Read(b)
+		assert.NoError(err)
+		assert.NotEqual(make([]byte, 16), b)
+	}
+	report := checked.Report()
+	assert.True(report.Healthy)
+	assert.EqualValues(3, report.TransientFailures)
+	assert.Empty(failures)
+
+	// three in a row fail it for good
+	src.glitch = map[int]bool{src.reads + 1: true, src.reads + 2: true, src.reads + 3: true}
+	_, err := checked.Read(b)
+	assert.Equal(ErrEntropyFailure, err)
+	assert.False(checked.Report().Healthy)
+	assert.Len(failures, 1)
+	_, err = checked.Read(b)
+	assert.Equal(ErrEntropyFailure, err)
+}
@@ -0,0 +1,367 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IdState is where an ID is in its life.
+type IdState string
+
+const (
+	IdIssued    IdState = "issued"    // handed out as a child of another ID
+	IdClaimed   IdState = "claimed"   // minted elsewhere, and registered here
+	IdReserved  IdState = "reserved"  // handed out, awaiting confirm or release
+	IdConfirmed IdState = "confirmed" // reserved, then used
+	IdReleased  IdState = "released"  // reserved, then given back
+	IdAbandoned IdState = "abandoned" // reserved, and the reservation expired
+	IdUnknown   IdState = "unknown"   // not issued by this service, but revoked
+)
+
+// IdRecord is what the service knows about one ID. IDs handed out by POST
+// /uuids and the like have no record of their own, only an entry in the
+// IssuedStore: records are kept for those that are claimed, reserved,
+// packed, linked to a parent or revoked.
+type IdRecord struct {
+	Uuid        string    `json:"uuid"`
+	State       IdState   `json:"state"`
+	Reservation string    `json:"reservation,omitempty"` // or pack
+	Owner       string    `json:"owner,omitempty"`       // of a claimed ID
+	CreatedOn   time.Time `json:"createdOn"`
+	UpdatedOn   time.Time `json:"updatedOn"`
+	ExpiresOn   time.Time `json:"expiresOn,omitempty"`
+
+	// a child ID names the ID it was issued from; derived children also
+	// have their index, from 1
+	Parent string `json:"parent,omitempty"`
+	Index  int    `json:"index,omitempty"`
+
+	// a revoked ID must not be accepted or reused, whatever its state
+	Revoked    bool        `json:"revoked"`
+	Revocation *Revocation `json:"revocation,omitempty"`
+}
+
+// Revocation says who revoked an ID, and why.
+type Revocation struct {
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason"`
+	RevokedOn time.Time `json:"revokedOn"`
+}
+
+// settle applies any change that is due by now: a reservation that has
+// expired is abandoned. Stores call it on every record they read, so
+// expiry needs no background work.
+func (r *IdRecord) settle(now time.Time) {
+	if r.State == IdReserved && !r.ExpiresOn.IsZero() && now.After(r.ExpiresOn) {
+		r.State = IdAbandoned
+		r.UpdatedOn = r.ExpiresOn
+	}
+}
+
+// IdStore holds IdRecords, keyed by UUID. Implementations must be safe for
+// concurrent use, and must settle records before returning or updating them.
+type IdStore interface {
+	// Get returns nil, and no error, for an ID it doesn't have.
+	Get(uuid string) (*IdRecord, error)
+
+	// Known returns those of uuids that have records.
+	Known(uuids []string) ([]string, error)
+
+	// Insert adds the records whose IDs are not already present, and
+	// returns the IDs that were. Each record is added atomically; the list
+	// as a whole may not be.
+	Insert(records []*IdRecord) ([]string, error)
+
+	// Update applies fn to a copy of the record and, if fn succeeds,
+	// stores the result. It returns nil, and no error, for an unknown ID.
+	Update(uuid string, fn func(*IdRecord) error) (*IdRecord, error)
+
+	// Children returns the records whose parent is parent, in no
+	// particular order.
+	Children(parent string) ([]*IdRecord, error)
+}
+
+//---------------------------------------------------------------------
+
+// MemoryIdStore is an IdStore that lives in memory.
+type MemoryIdStore struct {
+	sync.Mutex
+	records  map[string]*IdRecord
+	children map[string][]string // by parent
+}
+
+func NewMemoryIdStore() *MemoryIdStore {
+	return &MemoryIdStore{
+		records:  map[string]*IdRecord{},
+		children: map[string][]string{},
+	}
+}
+
+// must be called with the lock held
+func (store *MemoryIdStore) unlink(r *IdRecord) {
+	siblings := store.children[r.Parent]
+	for i, uuid := range siblings {
+		if uuid == r.Uuid {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(store.children, r.Parent)
+	} else {
+		store.children[r.Parent] = siblings
+	}
+}
+
+// must be called with the lock held
+func (store *MemoryIdStore) get(uuid string, now time.Time) *IdRecord {
+	r, ok := store.records[uuid]
+	if !ok {
+		return nil
+	}
+	r.settle(now)
+	return r
+}
+
+func (store *MemoryIdStore) Get(uuid string) (*IdRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	r := store.get(uuid, time.Now())
+	if r == nil {
+		return nil, nil
+	}
+	out := *r
+	return &out, nil
+}
+
+func (store *MemoryIdStore) Known(uuids []string) ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	var known []string
+	for _, uuid := range uuids {
+		if _, ok := store.records[uuid]; ok {
+			known = append(known, uuid)
+		}
+	}
+	return known, nil
+}
+
+func (store *MemoryIdStore) Insert(records []*IdRecord) ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	var existing []string
+	for _, r := range records {
+		if _, ok := store.records[r.Uuid]; ok {
+			existing = append(existing, r.Uuid)
+			continue
+		}
+		in := *r
+		store.records[r.Uuid] = &in
+		if r.Parent != "" {
+			store.children[r.Parent] = append(store.children[r.Parent], r.Uuid)
+		}
+	}
+	return existing, nil
+}
+
+func (store *MemoryIdStore) Update(uuid string, fn func(*IdRecord) error) (*IdRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	r := store.get(uuid, time.Now())
+	if r == nil {
+		return nil, nil
+	}
+
+	out := *r
+	err := fn(&out)
+	if err != nil {
+		return nil, err
+	}
+	if out.Parent != r.Parent {
+		if r.Parent != "" {
+			store.unlink(r)
+		}
+		if out.Parent != "" {
+			store.children[out.Parent] = append(store.children[out.Parent], r.Uuid)
+		}
+	}
+	*r = out
+	return &out, nil
+}
+
+func (store *MemoryIdStore) Children(parent string) ([]*IdRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now()
+	out := []*IdRecord{}
+	for _, uuid := range store.children[parent] {
+		copied := *store.get(uuid, now)
+		out = append(out, &copied)
+	}
+	return out, nil
+}
+
+//---------------------------------------------------------------------
+
+const idRecordType = "idrecord"
+
+// the uuid and parent are exact values, not text, so that children can be
+// found with a term query
+const idRecordMapping = `{
+	"idrecord": {
+		"properties": {
+			"uuid": {"type": "string", "index": "not_analyzed"},
+			"parent": {"type": "string", "index": "not_analyzed"}
+		}
+	}
+}`
+
+// idRecordsPerPage is the page size when listing children.
+const idRecordsPerPage = 100
+
+// elasticIdRecord is how an IdRecord is stored: the parent is copied out,
+// always present, for the children query, and the version is for
+// conditional writes.
+type elasticIdRecord struct {
+	Uuid    string    `json:"uuid"`
+	Parent  string    `json:"parent"`
+	Version int64     `json:"version"`
+	Record  *IdRecord `json:"record"`
+}
+
+// ElasticIdStore keeps IdRecords in an Elasticsearch index, so that
+// claims, revocations and links survive restarts and are shared between
+// instances. Each record is written conditionally, as for
+// ElasticCounterStore, so Insert is atomic for each record rather than for
+// the whole list, and Update never loses a concurrent change.
+type ElasticIdStore struct {
+	index DocumentIndex
+}
+
+// NewElasticIdStore uses index, creating it if need be.
+func NewElasticIdStore(index DocumentIndex) (*ElasticIdStore, error) {
+	err := index.Prepare(idRecordType, idRecordMapping)
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticIdStore{index: index}, nil
+}
+
+func (store *ElasticIdStore) get(uuid string) (*elasticIdRecord, error) {
+	doc := &elasticIdRecord{}
+	ok, err := getDocument(store.index, idRecordType, uuid, doc)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if doc.Record == nil {
+		return nil, fmt.Errorf("id record %s has no content", uuid)
+	}
+	doc.Record.settle(time.Now())
+	return doc, nil
+}
+
+func (store *ElasticIdStore) Get(uuid string) (*IdRecord, error) {
+	doc, err := store.get(uuid)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	return doc.Record, nil
+}
+
+func (store *ElasticIdStore) Known(uuids []string) ([]string, error) {
+	// one round trip for the lot
+	found, err := store.index.MultiGet(idRecordType, uuids)
+	if err != nil {
+		return nil, err
+	}
+	var known []string
+	for _, uuid := range uuids {
+		if _, ok := found[uuid]; ok {
+			known = append(known, uuid)
+		}
+	}
+	return known, nil
+}
+
+func (store *ElasticIdStore) Insert(records []*IdRecord) ([]string, error) {
+	var existing []string
+	for _, r := range records {
+		in := *r
+		doc := &elasticIdRecord{Uuid: r.Uuid, Parent: r.Parent, Version: 1, Record: &in}
+		ok, err := store.index.Put(idRecordType, r.Uuid, doc.Version, doc, true)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			existing = append(existing, r.Uuid)
+		}
+	}
+	return existing, nil
+}
+
+func (store *ElasticIdStore) Update(uuid string, fn func(*IdRecord) error) (*IdRecord, error) {
+	for i := 0; i < counterAttempts; i++ {
+		doc, err := store.get(uuid)
+		if err != nil || doc == nil {
+			return nil, err
+		}
+
+		err = fn(doc.Record)
+		if err != nil {
+			return nil, err
+		}
+		doc.Parent = doc.Record.Parent
+		doc.Version++
+
+		ok, err := store.index.Put(idRecordType, uuid, doc.Version, doc, false)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return doc.Record, nil
+		}
+		// another instance changed it since we read it
+	}
+	return nil, fmt.Errorf("id record too busy, try again: %s", uuid)
+}
+
+func (store *ElasticIdStore) Children(parent string) ([]*IdRecord, error) {
+	now := time.Now()
+	out := []*IdRecord{}
+	query := DocumentQuery{Field: "parent", Values: []string{parent}, SortBy: "uuid"}
+	err := searchAll(store.index, idRecordType, query, idRecordsPerPage, func(source json.RawMessage) error {
+		doc := &elasticIdRecord{}
+		err := json.Unmarshal(source, doc)
+		if err != nil || doc.Record == nil {
+			return err
+		}
+		doc.Record.settle(now)
+		out = append(out, doc.Record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"sync"
+	"time"
+)
+
+// IdempotencyHeader carries the client's key for a POST /uuids request.
+const IdempotencyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyWindow is how long a key is remembered, if not configured.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// longest key we accept; they are used as document IDs
+const maxIdempotencyKey = 255
+
+// IdempotencyRecord is the remembered result of a keyed POST /uuids.
+type IdempotencyRecord struct {
+	Key        string    `json:"key"`
+	Count      int       `json:"count"`
+	StatusCode int       `json:"statusCode"`
+	Uuids      []string  `json:"uuids"`
+	CreatedOn  time.Time `json:"createdOn"`
+	Version    int64     `json:"version"`
+}
+
+// IdempotencyStore holds IdempotencyRecords. Get returns nil, and no error,
+// for a key it does not have. Stores need not expire old records: the
+// service ignores any older than its window, and replaces them.
+//
+// Create and CompareAndSet report whether they stored the record, so that
+// when instances answer one key at once only the first answer stands.
+type IdempotencyStore interface {
+	Get(key string) (*IdempotencyRecord, error)
+
+	// Create stores the record only if its key has none.
+	Create(record *IdempotencyRecord) (bool, error)
+
+	// CompareAndSet stores the record only if the stored one's version is
+	// record.Version-1.
+	CompareAndSet(record *IdempotencyRecord) (bool, error)
+}
+
+//---------------------------------------------------------------------
+
+// MemoryIdempotencyStore keeps records in memory, dropping those older
+// than the window.
+type MemoryIdempotencyStore struct {
+	sync.Mutex
+	window    time.Duration
+	records   map[string]*IdempotencyRecord
+	lastSweep time.Time
+}
+
+func NewMemoryIdempotencyStore(window time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		window:    window,
+		records:   map[string]*IdempotencyRecord{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (store *MemoryIdempotencyStore) Get(key string) (*IdempotencyRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+	return store.records[key], nil
+}
+
+// Put stores the record, whatever the store has for its key.
+func (store *MemoryIdempotencyStore) Put(record *IdempotencyRecord) error {
+	store.Lock()
+	defer store.Unlock()
+	store.put(record)
+	return nil
+}
+
+func (store *MemoryIdempotencyStore) Create(record *IdempotencyRecord) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.records[record.Key]; ok {
+		return false, nil
+	}
+	store.put(record)
+	return true, nil
+}
+
+func (store *MemoryIdempotencyStore) CompareAndSet(record *IdempotencyRecord) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	stored, ok := store.records[record.Key]
+	if !ok || stored.Version != record.Version-1 {
+		return false, nil
+	}
+	store.put(record)
+	return true, nil
+}
+
+// must be called with the lock held
+func (store *MemoryIdempotencyStore) put(record *IdempotencyRecord) {
+	// sweep at most a few times per window, so Put stays cheap
+	now := time.Now()
+	if now.Sub(store.lastSweep) > store.window/4 {
+		for key, r := range store.records {
+			if now.Sub(r.CreatedOn) > store.window {
+				delete(store.records, key)
+			}
+		}
+		store.lastSweep = now
+	}
+
+	store.records[record.Key] = record
+}
+
+//---------------------------------------------------------------------
+
+const idempotencyType = "idempotency"
+
+// ElasticIdempotencyStore persists records in an Elasticsearch index, so
+// that keys survive a restart and are shared between instances. Writes are
+// versioned as for ElasticCounterStore.
+type ElasticIdempotencyStore struct {
+	index DocumentIndex
+}
+
+// NewElasticIdempotencyStore uses index, creating it if need be.
+func NewElasticIdempotencyStore(index DocumentIndex) (*ElasticIdempotencyStore, error) {
+	err := index.Prepare(idempotencyType, "")
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticIdempotencyStore{index: index}, nil
+}
+
+func (store *ElasticIdempotencyStore) Get(key string) (*IdempotencyRecord, error) {
+	record := &IdempotencyRecord{}
+	ok, err := getDocument(store.index, idempotencyType, key, record)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (store *ElasticIdempotencyStore) Create(record *IdempotencyRecord) (bool, error) {
+	return store.index.Put(idempotencyType, record.Key, record.Version, record, true)
+}
+
+func (store *ElasticIdempotencyStore) CompareAndSet(record *IdempotencyRecord) (bool, error) {
+	return store.index.Put(idempotencyType, record.Key, record.Version, record, false)
+}
+
+//---------------------------------------------------------------------
+
+// validIdempotencyKey accepts up to 255 printable ASCII characters.
+func validIdempotencyKey(key string) bool {
+	if len(key) == 0 || len(key) > maxIdempotencyKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// IssuedStore notes the IDs handed out without an IdRecord of their own,
+// e.g. by POST /uuids, so that they can't be claimed and can be looked up.
+// Implementations must be safe for concurrent use.
+type IssuedStore interface {
+	// Add notes a batch of IDs, in one write.
+	Add(uuids []string, issuedOn time.Time) error
+
+	// Find returns when each of those of uuids that were noted was issued.
+	Find(uuids []string) (map[string]time.Time, error)
+}
+
+//---------------------------------------------------------------------
+
+// MemoryIssuedStore is an IssuedStore that lives in memory. It keeps
+// every ID it is given, so it suits tests and short-lived services.
+type MemoryIssuedStore struct {
+	sync.Mutex
+	issued map[string]time.Time
+}
+
+func NewMemoryIssuedStore() *MemoryIssuedStore {
+	return &MemoryIssuedStore{issued: map[string]time.Time{}}
+}
+
+func (store *MemoryIssuedStore) Add(uuids []string, issuedOn time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, uuid := range uuids {
+		store.issued[uuid] = issuedOn
+	}
+	return nil
+}
+
+func (store *MemoryIssuedStore) Find(uuids []string) (map[string]time.Time, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	found := map[string]time.Time{}
+	for _, uuid := range uuids {
+		if t, ok := store.issued[uuid]; ok {
+			found[uuid] = t
+		}
+	}
+	return found, nil
+}
+
+//---------------------------------------------------------------------
+
+const issuedType = "issued"
+
+// the uuids are exact values, not text, so that a terms query finds the
+// batch holding each
+const issuedMapping = `{
+	"issued": {
+		"properties": {
+			"uuids": {"type": "string", "index": "not_analyzed"},
+			"issuedOn": {"type": "date"}
+		}
+	}
+}`
+
+// issuedBatch is how the IDs are stored: one document for each batch
+// issued, named after its first ID.
+type issuedBatch struct {
+	Uuids    []string  `json:"uuids"`
+	IssuedOn time.Time `json:"issuedOn"`
+}
+
+// ElasticIssuedStore keeps issued IDs in an Elasticsearch index, so that
+// they survive restarts and are shared between instances. A batch is
+// found by Find once the index has refreshed, normally within a second.
+type ElasticIssuedStore struct {
+	index DocumentIndex
+}
+
+// NewElasticIssuedStore uses index, creating it if need be.
+func NewElasticIssuedStore(index DocumentIndex) (*ElasticIssuedStore, error) {
+	err := index.Prepare(issuedType, issuedMapping)
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticIssuedStore{index: index}, nil
+}
+
+func (store *ElasticIssuedStore) Add(uuids []string, issuedOn time.Time) error {
+	if len(uuids) == 0 {
+		return nil
+	}
+	_, err := store.index.Put(issuedType, uuids[0], 0, &issuedBatch{Uuids: uuids, IssuedOn: issuedOn}, false)
+	return err
+}
+
+func (store *ElasticIssuedStore) Find(uuids []string) (map[string]time.Time, error) {
+	found := map[string]time.Time{}
+	if len(uuids) == 0 {
+		return found, nil
+	}
+
+	// each ID is in at most one batch, so there are no more hits than IDs
+	docs, _, err := store.index.Search(issuedType, &DocumentQuery{Field: "uuids", Values: uuids, Size: len(uuids)})
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, uuid := range uuids {
+		wanted[uuid] = true
+	}
+	for _, doc := range docs {
+		batch := &issuedBatch{}
+		err = json.Unmarshal(doc, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, uuid := range batch.Uuids {
+			if wanted[uuid] {
+				found[uuid] = batch.IssuedOn
+			}
+		}
+	}
+	return found, nil
+}
+
+//---------------------------------------------------------------------
+
+// noteIssued records a batch of freshly generated IDs as issued. They must
+// not be handed out unless it succeeds.
+func (service *Service) noteIssued(uuids []string) error {
+	err := service.issued.Add(uuids, time.Now())
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen issued store failed: %s", err.Error())
+	}
+	return err
+}
+
+// getId returns the record for uuid or, for an ID issued without one, a
+// record in the issued state. It returns nil for an ID it doesn't know.
+func (service *Service) getId(uuid string) (*IdRecord, error) {
+	record, err := service.ids.Get(uuid)
+	if err != nil || record != nil {
+		return record, err
+	}
+	return service.issuedRecord(uuid)
+}
+
+// issuedRecord returns a record, in the issued state, for an ID issued
+// without one, or nil.
+func (service *Service) issuedRecord(uuid string) (*IdRecord, error) {
+	found, err := service.issued.Find([]string{uuid})
+	if err != nil {
+		return nil, err
+	}
+	issuedOn, ok := found[uuid]
+	if !ok {
+		return nil, nil
+	}
+	return &IdRecord{Uuid: uuid, State: IdIssued, CreatedOn: issuedOn, UpdatedOn: issuedOn}, nil
+}
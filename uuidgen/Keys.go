@@ -0,0 +1,363 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownKey is returned when something was signed with a key that is
+// not in the ring.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// minimum length of a signing key, in bytes
+const minKeyLength = 16
+
+// KeyRing holds the HMAC keys the service signs with, by key ID. New
+// signatures use the current key; any key in the ring verifies. To rotate,
+// add a new key and make it current, and drop the old one once nothing
+// signed with it is still in use.
+type KeyRing struct {
+	sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: map[string][]byte{}}
+}
+
+// ParseKeyRing reads keys in the form "id1:base64key1,id2:base64key2".
+// The first is current.
+func ParseKeyRing(spec string) (*KeyRing, error) {
+	ring := NewKeyRing()
+	for i, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid key: %q", item)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %s", parts[0], err.Error())
+		}
+		err = ring.Add(parts[0], key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			err = ring.SetCurrent(parts[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ring, nil
+}
+
+// Add puts a key in the ring. The first key added becomes current.
+func (ring *KeyRing) Add(id string, key []byte) error {
+	if id == "" || strings.ContainsAny(id, ":,.") {
+		return fmt.Errorf("invalid key id: %q", id)
+	}
+	if len(key) < minKeyLength {
+		return fmt.Errorf("key %s is too short: %d bytes", id, len(key))
+	}
+
+	ring.Lock()
+	defer ring.Unlock()
+
+	ring.keys[id] = append([]byte(nil), key...)
+	if ring.current == "" {
+		ring.current = id
+	}
+	return nil
+}
+
+// SetCurrent makes the key with the given ID the one new signatures use.
+func (ring *KeyRing) SetCurrent(id string) error {
+	ring.Lock()
+	defer ring.Unlock()
+
+	if _, ok := ring.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+	ring.current = id
+	return nil
+}
+
+// Remove drops a key. The current key can't be removed.
+func (ring *KeyRing) Remove(id string) error {
+	ring.Lock()
+	defer ring.Unlock()
+
+	if id == ring.current {
+		return fmt.Errorf("cannot remove the current key: %s", id)
+	}
+	delete(ring.keys, id)
+	return nil
+}
+
+// CurrentId returns the ID of the current key, or "" if the ring is empty.
+func (ring *KeyRing) CurrentId() string {
+	ring.RLock()
+	defer ring.RUnlock()
+	return ring.current
+}
+
+// Sign returns the HMAC-SHA256 of message under the current key, and that
+// key's ID.
+func (ring *KeyRing) Sign(message []byte) (string, []byte, error) {
+	ring.RLock()
+	defer ring.RUnlock()
+
+	if ring.current == "" {
+		return "", nil, ErrUnknownKey
+	}
+	return ring.current, mac(ring.keys[ring.current], message), nil
+}
+
+// Has reports whether the ring holds a key with the given ID.
+func (ring *KeyRing) Has(id string) bool {
+	ring.RLock()
+	defer ring.RUnlock()
+	_, ok := ring.keys[id]
+	return ok
+}
+
+// Ids returns the IDs of the keys in the ring, sorted.
+func (ring *KeyRing) Ids() []string {
+	ring.RLock()
+	defer ring.RUnlock()
+
+	ids := make([]string, 0, len(ring.keys))
+	for id := range ring.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Len returns the number of keys in the ring.
+func (ring *KeyRing) Len() int {
+	ring.RLock()
+	defer ring.RUnlock()
+	return len(ring.keys)
+}
+
+// Replace makes the ring hold the same keys as other, with the same one
+// current.
+func (ring *KeyRing) Replace(other *KeyRing) {
+	stored := other.toStored()
+
+	ring.Lock()
+	defer ring.Unlock()
+	ring.keys, ring.current = stored.decode()
+}
+
+// Verify checks that tag is the HMAC-SHA256 of message under the given key,
+// or a prefix of it at least minTag bytes long.
+func (ring *KeyRing) Verify(keyId string, message []byte, tag []byte, minTag int) error {
+	ring.RLock()
+	key, ok := ring.keys[keyId]
+	ring.RUnlock()
+
+	if !ok {
+		return ErrUnknownKey
+	}
+	if len(tag) < minTag || len(tag) > sha256.Size {
+		return errors.New("invalid signature")
+	}
+	if !hmac.Equal(mac(key, message)[:len(tag)], tag) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func mac(key []byte, message []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(message)
+	return h.Sum(nil)
+}
+
+//---------------------------------------------------------------------
+
+// storedKeyRing is how a KeyRing is persisted.
+type storedKeyRing struct {
+	Keys    map[string]string `json:"keys"` // base64
+	Current string            `json:"current"`
+	Version int64             `json:"version"`
+}
+
+func (ring *KeyRing) toStored() *storedKeyRing {
+	ring.RLock()
+	defer ring.RUnlock()
+
+	stored := &storedKeyRing{Keys: map[string]string{}, Current: ring.current}
+	for id, key := range ring.keys {
+		stored.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	return stored
+}
+
+// decode skips keys that don't decode, which only a hand-edited document
+// would have.
+func (stored *storedKeyRing) decode() (map[string][]byte, string) {
+	keys := map[string][]byte{}
+	for id, s := range stored.Keys {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err == nil {
+			keys[id] = key
+		}
+	}
+	current := stored.Current
+	if _, ok := keys[current]; !ok {
+		current = ""
+	}
+	return keys, current
+}
+
+func (stored *storedKeyRing) ring() *KeyRing {
+	ring := NewKeyRing()
+	ring.keys, ring.current = stored.decode()
+	return ring
+}
+
+// KeyStore persists the key ring, so that keys added or retired at runtime
+// outlast the process and are shared between instances.
+type KeyStore interface {
+	// Get returns the stored ring, or nil, and no error, if there is none.
+	Get() (*KeyRing, error)
+
+	// Update applies fn to a copy of the stored ring, or to an empty one
+	// if there is none, and, if fn succeeds, stores the result.
+	Update(fn func(*KeyRing) error) (*KeyRing, error)
+}
+
+// MemoryKeyStore is a KeyStore that lives in memory.
+type MemoryKeyStore struct {
+	sync.Mutex
+	stored *storedKeyRing
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{}
+}
+
+func (store *MemoryKeyStore) Get() (*KeyRing, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.stored == nil {
+		return nil, nil
+	}
+	return store.stored.ring(), nil
+}
+
+func (store *MemoryKeyStore) Update(fn func(*KeyRing) error) (*KeyRing, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	ring := NewKeyRing()
+	if store.stored != nil {
+		ring = store.stored.ring()
+	}
+	err := fn(ring)
+	if err != nil {
+		return nil, err
+	}
+	store.stored = ring.toStored()
+	return store.stored.ring(), nil
+}
+
+//---------------------------------------------------------------------
+
+const (
+	keyRingType = "keyring"
+	keyRingId   = "keyring"
+)
+
+// ElasticKeyStore keeps the key ring as one document in an Elasticsearch
+// index. Updates are conditional on the document's version, as for
+// ElasticCounterStore. The keys are stored as they are given in
+// UUIDGEN_SIGNING_KEYS, so the index needs the same protection.
+type ElasticKeyStore struct {
+	index DocumentIndex
+}
+
+// NewElasticKeyStore uses index, creating it if need be.
+func NewElasticKeyStore(index DocumentIndex) (*ElasticKeyStore, error) {
+	err := index.Prepare(keyRingType, "")
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticKeyStore{index: index}, nil
+}
+
+func (store *ElasticKeyStore) get() (*storedKeyRing, error) {
+	stored := &storedKeyRing{}
+	ok, err := getDocument(store.index, keyRingType, keyRingId, stored)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (store *ElasticKeyStore) Get() (*KeyRing, error) {
+	stored, err := store.get()
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	return stored.ring(), nil
+}
+
+func (store *ElasticKeyStore) Update(fn func(*KeyRing) error) (*KeyRing, error) {
+	// counterAttempts is plenty: keys change rarely
+	for i := 0; i < counterAttempts; i++ {
+		stored, err := store.get()
+		if err != nil {
+			return nil, err
+		}
+		ring := NewKeyRing()
+		var version int64
+		if stored != nil {
+			ring = stored.ring()
+			version = stored.Version
+		}
+
+		err = fn(ring)
+		if err != nil {
+			return nil, err
+		}
+
+		next := ring.toStored()
+		next.Version = version + 1
+		ok, err := store.index.Put(keyRingType, keyRingId, next.Version, next, stored == nil)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return next.ring(), nil
+		}
+		// another instance changed the keys since we read them
+	}
+	return nil, errors.New("key ring too busy, try again")
+}
@@ -33,6 +33,10 @@ type Kit struct {
 }
 
 func NewKit(sys *piazza.SystemConfig, logWriter pzsyslog.Writer, auditWriter pzsyslog.Writer) (*Kit, error) {
+	return NewKitWithOptions(sys, logWriter, auditWriter, &ServiceOptions{})
+}
+
+func NewKitWithOptions(sys *piazza.SystemConfig, logWriter pzsyslog.Writer, auditWriter pzsyslog.Writer, options *ServiceOptions) (*Kit, error) {
 	var err error
 
 	kit := &Kit{}
@@ -41,7 +45,7 @@ func NewKit(sys *piazza.SystemConfig, logWriter pzsyslog.Writer, auditWriter pzs
 	kit.AuditWriter = auditWriter
 	kit.Sys = sys
 
-	err = kit.Service.Init(sys, logWriter, auditWriter)
+	err = kit.Service.InitWithOptions(sys, logWriter, auditWriter, options)
 	if err != nil {
 		return nil, err
 	}
@@ -76,3 +80,12 @@ func (kit *Kit) Wait() error {
 func (kit *Kit) Stop() error {
 	return kit.GenericServer.Stop()
 }
+
+// Bench runs the load-test harness against this (already started) kit.
+func (kit *Kit) Bench(config *BenchConfig) (*BenchResult, error) {
+	client, err := NewClient(kit.Url, "")
+	if err != nil {
+		return nil, err
+	}
+	return RunBench(client, config)
+}
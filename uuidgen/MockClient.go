@@ -15,57 +15,260 @@
 package uuidgen
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/venicegeo/pz-gocommon/gocommon"
 )
 
+// MockOptions controls the behaviour of a MockClient.
+type MockOptions struct {
+	// Deterministic makes the generated IDs a pure function of Seed.
+	Deterministic bool
+	Seed          int64
+
+	// Latency is added to every call.
+	Latency time.Duration
+
+	// FailEvery makes every Nth call fail with FailWith (by default, a 503).
+	FailEvery int
+	FailWith  error
+}
+
+// MockCall records one call made to a MockClient.
+type MockCall struct {
+	Method string
+	Count  int
+	Err    error
+}
+
+// MockResponse is a scripted answer to a PostUuids call.
+type MockResponse struct {
+	Uuids []string
+	Err   error
+}
+
+// MockClient implements IClient without a server. It applies the same
+// validation as Client and is safe for concurrent use.
 type MockClient struct {
-	stats Stats
+	sync.Mutex
+	options  MockOptions
+	stats    Stats
+	random   RandomSource
+	script   []MockResponse
+	calls    []MockCall
+	numCalls int
+	counters *MemoryCounterStore
+}
+
+// NewMockStatusError returns the error a Client reports for the given
+// HTTP status and message.
+func NewMockStatusError(statusCode int, message string) error {
+	resp := &piazza.JsonResponse{StatusCode: statusCode, Message: message}
+	return resp.ToError()
 }
 
 func NewMockClient() (*MockClient, error) {
+	return NewMockClientWithOptions(&MockOptions{})
+}
+
+func NewMockClientWithOptions(options *MockOptions) (*MockClient, error) {
 	var _ IClient = new(MockClient)
+	var _ ICounterClient = new(MockClient)
 
-	client := &MockClient{}
+	client := &MockClient{options: *options, counters: NewMemoryCounterStore()}
+
+	client.random = NewCryptoSource()
+	if client.options.Deterministic {
+		client.random = NewSeededSource(client.options.Seed)
+	}
+	if client.options.FailWith == nil {
+		client.options.FailWith = NewMockStatusError(http.StatusServiceUnavailable, "injected failure")
+	}
 
 	client.stats.CreatedOn = time.Now()
 
 	return client, nil
 }
 
+// Script queues responses to be returned, in order, by the next PostUuids calls.
+func (c *MockClient) Script(responses ...MockResponse) {
+	c.Lock()
+	defer c.Unlock()
+	c.script = append(c.script, responses...)
+}
+
+// Calls returns a copy of every call made so far.
+func (c *MockClient) Calls() []MockCall {
+	c.Lock()
+	defer c.Unlock()
+	out := make([]MockCall, len(c.calls))
+	copy(out, c.calls)
+	return out
+}
+
+// begin waits out the configured latency, records the call and decides
+// whether it is one that fails. It returns the index of the call record.
+func (c *MockClient) begin(ctx context.Context, method string, count int) (int, error) {
+	if c.options.Latency > 0 {
+		timer := time.NewTimer(c.options.Latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	err := ctx.Err()
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.numCalls++
+	if err == nil && c.options.FailEvery > 0 && c.numCalls%c.options.FailEvery == 0 {
+		err = c.options.FailWith
+	}
+	c.calls = append(c.calls, MockCall{Method: method, Count: count, Err: err})
+	return len(c.calls) - 1, err
+}
+
+//---------------------------------------------------------------------
+
 func (c *MockClient) GetVersion() (*piazza.Version, error) {
+	return c.GetVersionContext(context.Background())
+}
+
+func (c *MockClient) GetVersionContext(ctx context.Context) (*piazza.Version, error) {
+	if _, err := c.begin(ctx, "GetVersion", 0); err != nil {
+		return nil, err
+	}
 	version := piazza.Version{Version: Version}
 	return &version, nil
 }
 
 func (c *MockClient) PostUuids(count int) (*[]string, error) {
+	return c.PostUuidsContext(context.Background(), count)
+}
 
-	if count < 0 || count > 255 {
-		return nil, errors.New("invalid count value")
+func (c *MockClient) PostUuidsContext(ctx context.Context, count int) (*[]string, error) {
+	call, err := c.begin(ctx, "PostUuids", count)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// same rule as Client, which splits up counts the server won't take
+	if count < 0 {
+		err = fmt.Errorf("query argument out of range: %d", count)
+		c.calls[call].Err = err
+		return nil, err
 	}
 
-	data := make([]string, count)
-	for i := 0; i < count; i++ {
-		data[i] = piazza.NewUuid().String()
-		//		data[i] = uuid.New()
+	var data []string
+	if len(c.script) > 0 {
+		next := c.script[0]
+		c.script = c.script[1:]
+		if next.Err != nil {
+			c.calls[call].Err = next.Err
+			return nil, next.Err
+		}
+		data = next.Uuids
+	} else {
+		data = make([]string, count)
+		for i := 0; i < count; i++ {
+			uuid, err := newUuid(c.random)
+			if err != nil {
+				c.calls[call].Err = err
+				return nil, err
+			}
+			data[i] = uuid.String()
+		}
 	}
 
-	c.stats.NumUUIDs += count
+	c.stats.NumUUIDs += len(data)
 	c.stats.NumRequests++
 
 	return &data, nil
 }
 
 func (c *MockClient) GetStats() (*Stats, error) {
-	return &c.stats, nil
+	return c.GetStatsContext(context.Background())
+}
+
+func (c *MockClient) GetStatsContext(ctx context.Context) (*Stats, error) {
+	if _, err := c.begin(ctx, "GetStats", 0); err != nil {
+		return nil, err
+	}
+	c.Lock()
+	stats := c.stats
+	c.Unlock()
+	return &stats, nil
 }
 
 func (c *MockClient) GetUUID() (string, error) {
-	data, err := c.PostUuids(1)
+	return c.GetUUIDContext(context.Background())
+}
+
+func (c *MockClient) GetUUIDContext(ctx context.Context) (string, error) {
+	data, err := c.PostUuidsContext(ctx, 1)
 	if err != nil {
 		return "", err
 	}
+	if len(*data) == 0 {
+		return "", fmt.Errorf("no uuid returned")
+	}
 	return (*data)[0], nil
 }
+
+//---------------------------------------------------------------------
+
+// mockCounterError turns the service's counter errors into what Client
+// would report.
+func mockCounterError(err error) error {
+	if e, ok := err.(*counterError); ok {
+		return NewMockStatusError(e.statusCode, e.message)
+	}
+	return err
+}
+
+func (c *MockClient) CreateCounterContext(ctx context.Context, request *CounterRequest) (*Counter, error) {
+	call, err := c.begin(ctx, "CreateCounter", 0)
+	if err != nil {
+		return nil, err
+	}
+	counter, err := createCounter(c.counters, request)
+	return counter, c.fail(call, mockCounterError(err))
+}
+
+func (c *MockClient) GetCounterContext(ctx context.Context, name string) (*Counter, error) {
+	call, err := c.begin(ctx, "GetCounter", 0)
+	if err != nil {
+		return nil, err
+	}
+	counter, err := getCounter(c.counters, name)
+	return counter, c.fail(call, mockCounterError(err))
+}
+
+func (c *MockClient) IncrementCounterContext(ctx context.Context, name string, count int) (*CounterRange, error) {
+	call, err := c.begin(ctx, "IncrementCounter", count)
+	if err != nil {
+		return nil, err
+	}
+	r, err := incrementCounter(c.counters, name, int64(count))
+	return r, c.fail(call, mockCounterError(err))
+}
+
+// fail records err, if any, against the call, and returns it.
+func (c *MockClient) fail(call int, err error) error {
+	if err != nil {
+		c.Lock()
+		c.calls[call].Err = err
+		c.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,233 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MockDocumentIndex implements DocumentIndex in memory. It refuses writes
+// as Elasticsearch does under external versioning, so that the stores'
+// compare-and-set loops are exercised, and is safe for concurrent use.
+type MockDocumentIndex struct {
+	sync.Mutex
+	types map[string]map[string]*mockDocument
+}
+
+type mockDocument struct {
+	version int64
+	source  json.RawMessage
+}
+
+func NewMockDocumentIndex() *MockDocumentIndex {
+	return &MockDocumentIndex{types: map[string]map[string]*mockDocument{}}
+}
+
+// documents must be called with the lock held.
+func (di *MockDocumentIndex) documents(typ string) map[string]*mockDocument {
+	docs, ok := di.types[typ]
+	if !ok {
+		docs = map[string]*mockDocument{}
+		di.types[typ] = docs
+	}
+	return docs
+}
+
+func (di *MockDocumentIndex) Prepare(typ string, mapping string) error {
+	di.Lock()
+	defer di.Unlock()
+
+	di.documents(typ)
+	return nil
+}
+
+func (di *MockDocumentIndex) Get(typ string, id string) (json.RawMessage, error) {
+	di.Lock()
+	defer di.Unlock()
+
+	doc, ok := di.documents(typ)[id]
+	if !ok {
+		return nil, nil
+	}
+	return doc.source, nil
+}
+
+func (di *MockDocumentIndex) MultiGet(typ string, ids []string) (map[string]json.RawMessage, error) {
+	di.Lock()
+	defer di.Unlock()
+
+	docs := di.documents(typ)
+	found := map[string]json.RawMessage{}
+	for _, id := range ids {
+		if doc, ok := docs[id]; ok {
+			found[id] = doc.source
+		}
+	}
+	return found, nil
+}
+
+func (di *MockDocumentIndex) Put(typ string, id string, version int64, doc interface{}, create bool) (bool, error) {
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+
+	di.Lock()
+	defer di.Unlock()
+
+	docs := di.documents(typ)
+	stored, ok := docs[id]
+	if ok && (create || (version > 0 && version <= stored.version)) {
+		return false, nil
+	}
+	if version == 0 {
+		version = 1
+		if ok {
+			version = stored.version + 1
+		}
+	}
+	docs[id] = &mockDocument{version: version, source: source}
+	return true, nil
+}
+
+func (di *MockDocumentIndex) Delete(typ string, id string) error {
+	di.Lock()
+	defer di.Unlock()
+
+	delete(di.documents(typ), id)
+	return nil
+}
+
+func (di *MockDocumentIndex) Search(typ string, query *DocumentQuery) ([]json.RawMessage, int, error) {
+	di.Lock()
+	defer di.Unlock()
+
+	type hit struct {
+		id     string
+		fields map[string]interface{}
+		source json.RawMessage
+	}
+
+	var hits []*hit
+	for id, doc := range di.documents(typ) {
+		fields := map[string]interface{}{}
+		err := json.Unmarshal(doc.source, &fields)
+		if err != nil {
+			return nil, 0, err
+		}
+		if query.Field != "" && !mockMatches(fields[query.Field], query.Values) {
+			continue
+		}
+		if query.BeforeField != "" {
+			t, ok := mockTime(fields[query.BeforeField])
+			if !ok || !t.Before(query.Before) {
+				continue
+			}
+		}
+		hits = append(hits, &hit{id: id, fields: fields, source: doc.source})
+	}
+
+	// ties, and everything when unsorted, go by ID so that pages are stable
+	sort.Slice(hits, func(i, j int) bool {
+		if query.SortBy != "" {
+			a, b := hits[i].fields[query.SortBy], hits[j].fields[query.SortBy]
+			if c := mockCompare(a, b); c != 0 {
+				return (c < 0) != query.Descending
+			}
+		}
+		return hits[i].id < hits[j].id
+	})
+
+	total := len(hits)
+	from, to := query.From, query.From+query.Size
+	if from > total {
+		from = total
+	}
+	if to > total {
+		to = total
+	}
+	docs := make([]json.RawMessage, 0, to-from)
+	for _, h := range hits[from:to] {
+		docs = append(docs, h.source)
+	}
+	return docs, total, nil
+}
+
+// mockMatches reports whether value, or for a list one of its elements,
+// is one of values.
+func mockMatches(value interface{}, values []string) bool {
+	if list, ok := value.([]interface{}); ok {
+		for _, v := range list {
+			if mockMatches(v, values) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range values {
+		if fmt.Sprint(value) == v {
+			return true
+		}
+	}
+	return false
+}
+
+func mockTime(value interface{}) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+// mockCompare orders times as times, numbers as numbers, and anything
+// else as text.
+func mockCompare(a interface{}, b interface{}) int {
+	if ta, ok := mockTime(a); ok {
+		if tb, ok := mockTime(b); ok {
+			switch {
+			case ta.Before(tb):
+				return -1
+			case tb.Before(ta):
+				return 1
+			}
+			return 0
+		}
+	}
+	if fa, ok := a.(float64); ok {
+		if fb, ok := b.(float64); ok {
+			switch {
+			case fa < fb:
+				return -1
+			case fb < fa:
+				return 1
+			}
+			return 0
+		}
+	}
+	sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+	switch {
+	case sa < sb:
+		return -1
+	case sb < sa:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,308 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// Nonces are random values for replay protection: each is issued for a
+// scope, and can be redeemed in that scope once, before it expires.
+const (
+	DefaultNonceTTL = 5 * time.Minute
+	MaxNonceTTL     = 24 * time.Hour
+
+	// random bytes in a nonce, which is their unpadded base64url encoding
+	nonceBytes = 32
+
+	nonceType = "nonce"
+)
+
+// Nonce is one issued nonce. RedeemedOn is zero until it is redeemed.
+type Nonce struct {
+	Value      string    `json:"value"`
+	Scope      string    `json:"scope,omitempty"`
+	IssuedOn   time.Time `json:"issuedOn"`
+	ExpiresOn  time.Time `json:"expiresOn"`
+	RedeemedOn time.Time `json:"redeemedOn,omitempty"`
+	Version    int64     `json:"version"`
+}
+
+// Expired reports whether the nonce can no longer be redeemed for want of
+// time. A redeemed nonce never expires.
+func (nonce *Nonce) Expired(now time.Time) bool {
+	return nonce.RedeemedOn.IsZero() && !now.Before(nonce.ExpiresOn)
+}
+
+//---------------------------------------------------------------------
+
+// NonceStore holds nonces, by value. Implementations must be safe for
+// concurrent use.
+type NonceStore interface {
+	// Get returns nil, and no error, for a nonce it doesn't have. A store
+	// may forget nonces once they have expired.
+	Get(value string) (*Nonce, error)
+
+	// Create adds nonce unless one with its value is already there; it
+	// reports whether it did.
+	Create(nonce *Nonce) (bool, error)
+
+	// CompareAndSet stores nonce only if the stored version is
+	// nonce.Version-1; it reports whether it did.
+	CompareAndSet(nonce *Nonce) (bool, error)
+}
+
+// MemoryNonceStore is a NonceStore that does not survive restarts. It
+// forgets nonces a while after they expire or are redeemed.
+type MemoryNonceStore struct {
+	sync.Mutex
+	nonces    map[string]*Nonce
+	lastSweep time.Time
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: map[string]*Nonce{}, lastSweep: time.Now()}
+}
+
+func (store *MemoryNonceStore) Get(value string) (*Nonce, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	nonce, ok := store.nonces[value]
+	if !ok {
+		return nil, nil
+	}
+	out := *nonce
+	return &out, nil
+}
+
+func (store *MemoryNonceStore) Create(nonce *Nonce) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	// sweep at most once a TTL, keeping spent nonces for one more, so
+	// that late redemptions still get a clear answer
+	now := time.Now()
+	if now.Sub(store.lastSweep) > DefaultNonceTTL {
+		for value, n := range store.nonces {
+			if now.Sub(n.ExpiresOn) > DefaultNonceTTL {
+				delete(store.nonces, value)
+			}
+		}
+		store.lastSweep = now
+	}
+
+	if _, ok := store.nonces[nonce.Value]; ok {
+		return false, nil
+	}
+	in := *nonce
+	store.nonces[nonce.Value] = &in
+	return true, nil
+}
+
+func (store *MemoryNonceStore) CompareAndSet(nonce *Nonce) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	stored, ok := store.nonces[nonce.Value]
+	if !ok || stored.Version != nonce.Version-1 {
+		return false, nil
+	}
+	in := *nonce
+	store.nonces[nonce.Value] = &in
+	return true, nil
+}
+
+//---------------------------------------------------------------------
+
+// ElasticNonceStore keeps nonces in an Elasticsearch index, so that they
+// survive restarts and can be redeemed at any instance. Writes are
+// versioned as for ElasticCounterStore. Expired nonces are not deleted;
+// the service refuses them.
+type ElasticNonceStore struct {
+	index DocumentIndex
+}
+
+// NewElasticNonceStore uses index, creating it if need be.
+func NewElasticNonceStore(index DocumentIndex) (*ElasticNonceStore, error) {
+	err := index.Prepare(nonceType, "")
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticNonceStore{index: index}, nil
+}
+
+func (store *ElasticNonceStore) Get(value string) (*Nonce, error) {
+	nonce := &Nonce{}
+	ok, err := getDocument(store.index, nonceType, value, nonce)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func (store *ElasticNonceStore) Create(nonce *Nonce) (bool, error) {
+	return store.index.Put(nonceType, nonce.Value, nonce.Version, nonce, true)
+}
+
+func (store *ElasticNonceStore) CompareAndSet(nonce *Nonce) (bool, error) {
+	return store.index.Put(nonceType, nonce.Value, nonce.Version, nonce, false)
+}
+
+//---------------------------------------------------------------------
+
+func newNonceValue(src RandomSource) (string, error) {
+	b := make([]byte, nonceBytes)
+	_, err := io.ReadFull(src, b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validNonceValue(value string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	return err == nil && len(b) == nonceBytes
+}
+
+// PostNonces issues nonces.
+//
+//	?count=INT     as for PostUuids
+//	?scope=STRING  where they may be redeemed; the default is none
+//	?ttl=DURATION  how long they may be redeemed for, up to MaxNonceTTL;
+//	               the default is DefaultNonceTTL
+func (service *Service) PostNonces(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	count, err := params.GetCount(1)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if count < 0 || count > service.maxCount {
+		s := fmt.Sprintf("query argument out of range: %d", count)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+	scope, err := params.GetAsString("scope", "")
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if scope != "" && !validCounterName(scope) {
+		return service.newErrorResponse(http.StatusBadRequest, fmt.Sprintf("invalid scope: %q", scope))
+	}
+	ttl := DefaultNonceTTL
+	s, err := params.GetAsString("ttl", "")
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if s != "" {
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 || ttl > MaxNonceTTL {
+			return service.newErrorResponse(http.StatusBadRequest, "invalid ttl: "+s)
+		}
+	}
+
+	now := time.Now()
+	nonces := make([]*Nonce, 0, count)
+	for len(nonces) < count {
+		value, err := newNonceValue(service.random)
+		if err != nil {
+			_ = service.syslogger.Error("uuidgen random source failed: %s", err.Error())
+			return service.newErrorResponse(http.StatusServiceUnavailable, "random source failure: "+err.Error())
+		}
+		nonce := &Nonce{
+			Value:     value,
+			Scope:     scope,
+			IssuedOn:  now,
+			ExpiresOn: now.Add(ttl),
+			Version:   1,
+		}
+		ok, err := service.nonces.Create(nonce)
+		if err != nil {
+			_ = service.syslogger.Error("uuidgen nonce store failed: %s", err.Error())
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		// a collision means a broken random source, but costs nothing to
+		// skip
+		if ok {
+			nonces = append(nonces, nonce)
+		}
+	}
+
+	atomic.AddInt64(&service.numRequests, 1)
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusCreated, Data: nonces}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// PostNonceRedeem redeems a nonce. Only the first redemption succeeds;
+// later ones get a 409, and one after expiry a 410. A nonce from another
+// scope is not found.
+//
+//	?scope=STRING  the scope the nonce was issued for
+func (service *Service) PostNonceRedeem(value string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	scope, err := params.GetAsString("scope", "")
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	var nonce *Nonce
+	if validNonceValue(value) {
+		nonce, err = service.nonces.Get(value)
+		if err != nil {
+			_ = service.syslogger.Error("uuidgen nonce store failed: %s", err.Error())
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+	}
+	if nonce == nil || nonce.Scope != scope {
+		return service.newErrorResponse(http.StatusNotFound, "nonce not found")
+	}
+
+	now := time.Now()
+	if !nonce.RedeemedOn.IsZero() {
+		return service.newErrorResponse(http.StatusConflict, "nonce already redeemed")
+	}
+	if nonce.Expired(now) {
+		return service.newErrorResponse(http.StatusGone, "nonce expired")
+	}
+
+	nonce.RedeemedOn = now
+	nonce.Version++
+	ok, err := service.nonces.CompareAndSet(nonce)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen nonce store failed: %s", err.Error())
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if !ok {
+		// the only change a nonce has is its redemption
+		return service.newErrorResponse(http.StatusConflict, "nonce already redeemed")
+	}
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: nonce}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
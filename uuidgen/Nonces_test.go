@@ -0,0 +1,110 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+func nonceParams(t *testing.T, query string) *piazza.HttpQueryParams {
+	req, err := http.NewRequest("POST", "/?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return piazza.NewQueryParams(req)
+}
+
+func TestNonces(t *testing.T) {
+	assert := assert.New(t)
+
+	elastic, err := NewElasticNonceStore(NewMockDocumentIndex())
+	assert.NoError(err)
+
+	for _, store := range []NonceStore{NewMemoryNonceStore(), elastic} {
+		service := newTestService(t)
+		service.nonces = store
+
+		resp := service.PostNonces(nonceParams(t, "count=3&scope=jobs&ttl=1m"))
+		assert.Equal(http.StatusCreated, resp.StatusCode)
+		nonces := resp.Data.([]*Nonce)
+		assert.Len(nonces, 3)
+		assert.True(validNonceValue(nonces[0].Value))
+		assert.NotEqual(nonces[0].Value, nonces[1].Value)
+		assert.Equal(time.Minute, nonces[0].ExpiresOn.Sub(nonces[0].IssuedOn))
+
+		// of many concurrent redemptions, exactly one succeeds
+		var wins int32
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp := service.PostNonceRedeem(nonces[0].Value, nonceParams(t, "scope=jobs"))
+				if resp.StatusCode == http.StatusOK {
+					atomic.AddInt32(&wins, 1)
+				} else {
+					assert.Equal(http.StatusConflict, resp.StatusCode)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(int32(1), wins)
+
+		// the wrong scope, or none, doesn't find it
+		assert.Equal(http.StatusNotFound, service.PostNonceRedeem(nonces[1].Value, nonceParams(t, "")).StatusCode)
+		assert.Equal(http.StatusNotFound, service.PostNonceRedeem(nonces[1].Value, nonceParams(t, "scope=data")).StatusCode)
+		assert.Equal(http.StatusNotFound, service.PostNonceRedeem("nonsense", nonceParams(t, "scope=jobs")).StatusCode)
+
+		resp = service.PostNonceRedeem(nonces[1].Value, nonceParams(t, "scope=jobs"))
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.False(resp.Data.(*Nonce).RedeemedOn.IsZero())
+
+		// expired
+		expired := nonces[2]
+		expired.ExpiresOn = time.Now().Add(-time.Second)
+		expired.Version++
+		ok, err := store.CompareAndSet(expired)
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal(http.StatusGone, service.PostNonceRedeem(expired.Value, nonceParams(t, "scope=jobs")).StatusCode)
+
+		for _, bad := range []string{"count=-1", "ttl=0s", "ttl=25h", "ttl=soon", "scope=a%20b"} {
+			assert.Equal(http.StatusBadRequest, service.PostNonces(nonceParams(t, bad)).StatusCode, bad)
+		}
+	}
+}
+
+type drySource struct{}
+
+func (drySource) Read(b []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestNonceRandomFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+	service.random = drySource{}
+	resp := service.PostNonces(nonceParams(t, ""))
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+}
@@ -0,0 +1,542 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const (
+	MaxPackSize         = 10000
+	DefaultPackValidity = 7 * 24 * time.Hour
+	MaxPackValidity     = 90 * 24 * time.Hour
+
+	// PackGrace is how long after its validity a pack can still be
+	// reconciled. After that it is dropped, and its unreported IDs are
+	// abandoned.
+	PackGrace = 30 * 24 * time.Hour
+)
+
+// IdPack is a batch of IDs issued for use offline, signed so that it can be
+// checked with VerifyPack.
+type IdPack struct {
+	Id         string    `json:"id"`
+	Instance   string    `json:"instance"`
+	IssuedTo   string    `json:"issuedTo"`
+	IssuedOn   time.Time `json:"issuedOn"`
+	ValidUntil time.Time `json:"validUntil"`
+	Uuids      []string  `json:"uuids"`
+	KeyId      string    `json:"keyId"`
+	Signature  string    `json:"signature"`
+}
+
+// PackRequest is the body of a pack export.
+type PackRequest struct {
+	Count    int    `json:"count"`
+	Validity string `json:"validity,omitempty"` // e.g. "72h"; default a week
+	IssuedTo string `json:"issuedTo"`
+}
+
+// PackReconciliation reports how a pack was used. Used IDs are confirmed,
+// and unused ones released.
+type PackReconciliation struct {
+	Pack    string   `json:"pack"`
+	Used    int      `json:"used"`
+	Unused  []string `json:"unused"`
+	Unknown []string `json:"unknown,omitempty"` // reported used, but not in the pack
+	Expired bool     `json:"expired"`           // reconciled after the pack's validity
+}
+
+// packMessage is what a pack's signature covers: its fields, one per
+// line, in a fixed order. The key ID needn't be covered, since no other
+// key gives the same signature.
+func packMessage(pack *IdPack) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("pz-uuidgen-pack-v1\n")
+	for _, s := range []string{
+		pack.Id,
+		pack.Instance,
+		pack.IssuedTo,
+		pack.IssuedOn.UTC().Format(time.RFC3339Nano),
+		pack.ValidUntil.UTC().Format(time.RFC3339Nano),
+	} {
+		buf.WriteString(s)
+		buf.WriteByte('\n')
+	}
+	for _, uuid := range pack.Uuids {
+		buf.WriteString(uuid)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// VerifyPack checks a pack's signature against the ring. Packs are signed
+// with the whole HMAC, so a shorter signature is refused.
+func VerifyPack(ring *KeyRing, pack *IdPack) error {
+	tag, err := base64.StdEncoding.DecodeString(pack.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err.Error())
+	}
+	return ring.Verify(pack.KeyId, packMessage(pack), tag, sha256.Size)
+}
+
+//---------------------------------------------------------------------
+
+// PackRecord is what is kept of an exported pack, until it is swept.
+type PackRecord struct {
+	Id           string    `json:"id"`
+	IssuedTo     string    `json:"issuedTo"`
+	ValidUntil   time.Time `json:"validUntil"`
+	Uuids        []string  `json:"uuids"`
+	ReconciledOn time.Time `json:"reconciledOn,omitempty"`
+	DueOn        time.Time `json:"dueOn"` // when the sweep drops it
+	Version      int64     `json:"version"`
+}
+
+// reconciled closes the pack, and keeps it for ReservationRetention.
+func (r *PackRecord) reconciled(now time.Time) {
+	r.ReconciledOn = now
+	r.DueOn = now.Add(ReservationRetention)
+}
+
+// PackStore holds PackRecords. Implementations must be safe for concurrent
+// use.
+type PackStore interface {
+	// Get returns nil, and no error, for a pack it doesn't have.
+	Get(id string) (*PackRecord, error)
+
+	Put(record *PackRecord) error
+
+	// Update applies fn to a copy of the record and, if fn succeeds,
+	// stores the result. It returns nil, and no error, for an unknown
+	// pack.
+	Update(id string, fn func(*PackRecord) error) (*PackRecord, error)
+
+	// Due returns the records due to be dropped before t.
+	Due(t time.Time) ([]*PackRecord, error)
+
+	Delete(id string) error
+}
+
+//---------------------------------------------------------------------
+
+// MemoryPackStore is a PackStore that lives in memory.
+type MemoryPackStore struct {
+	sync.Mutex
+	records map[string]*PackRecord
+}
+
+func NewMemoryPackStore() *MemoryPackStore {
+	return &MemoryPackStore{records: map[string]*PackRecord{}}
+}
+
+func (store *MemoryPackStore) Get(id string) (*PackRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	r, ok := store.records[id]
+	if !ok {
+		return nil, nil
+	}
+	out := *r
+	return &out, nil
+}
+
+func (store *MemoryPackStore) Put(record *PackRecord) error {
+	store.Lock()
+	defer store.Unlock()
+
+	in := *record
+	store.records[record.Id] = &in
+	return nil
+}
+
+func (store *MemoryPackStore) Update(id string, fn func(*PackRecord) error) (*PackRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	r, ok := store.records[id]
+	if !ok {
+		return nil, nil
+	}
+	out := *r
+	err := fn(&out)
+	if err != nil {
+		return nil, err
+	}
+	out.Version++
+	*r = out
+	return &out, nil
+}
+
+func (store *MemoryPackStore) Due(t time.Time) ([]*PackRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	var due []*PackRecord
+	for _, r := range store.records {
+		if r.DueOn.Before(t) {
+			out := *r
+			due = append(due, &out)
+		}
+	}
+	return due, nil
+}
+
+func (store *MemoryPackStore) Delete(id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	delete(store.records, id)
+	return nil
+}
+
+//---------------------------------------------------------------------
+
+const packType = "pack"
+
+const packMapping = `{
+	"pack": {
+		"properties": {
+			"id": {"type": "string", "index": "not_analyzed"},
+			"uuids": {"type": "string", "index": "not_analyzed"},
+			"dueOn": {"type": "date"}
+		}
+	}
+}`
+
+// packsPerPage is the page size when sweeping.
+const packsPerPage = 100
+
+// ElasticPackStore keeps packs in an Elasticsearch index, so that they
+// can be reconciled after a restart, or on another instance. Updates are
+// versioned as for ElasticCounterStore.
+type ElasticPackStore struct {
+	index DocumentIndex
+}
+
+// NewElasticPackStore uses index, creating it if need be.
+func NewElasticPackStore(index DocumentIndex) (*ElasticPackStore, error) {
+	err := index.Prepare(packType, packMapping)
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticPackStore{index: index}, nil
+}
+
+func (store *ElasticPackStore) Get(id string) (*PackRecord, error) {
+	record := &PackRecord{}
+	ok, err := getDocument(store.index, packType, id, record)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (store *ElasticPackStore) Put(record *PackRecord) error {
+	ok, err := store.index.Put(packType, record.Id, record.Version, record, true)
+	if err == nil && !ok {
+		err = fmt.Errorf("pack already exists: %s", record.Id)
+	}
+	return err
+}
+
+func (store *ElasticPackStore) Update(id string, fn func(*PackRecord) error) (*PackRecord, error) {
+	for i := 0; i < counterAttempts; i++ {
+		record, err := store.Get(id)
+		if err != nil || record == nil {
+			return nil, err
+		}
+
+		err = fn(record)
+		if err != nil {
+			return nil, err
+		}
+		record.Version++
+
+		ok, err := store.index.Put(packType, id, record.Version, record, false)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return record, nil
+		}
+		// another instance changed it since we read it
+	}
+	return nil, fmt.Errorf("pack too busy, try again: %s", id)
+}
+
+func (store *ElasticPackStore) Due(t time.Time) ([]*PackRecord, error) {
+	var due []*PackRecord
+	query := DocumentQuery{BeforeField: "dueOn", Before: t, SortBy: "id"}
+	err := searchAll(store.index, packType, query, packsPerPage, func(doc json.RawMessage) error {
+		record := &PackRecord{}
+		err := json.Unmarshal(doc, record)
+		if err != nil {
+			return err
+		}
+		due = append(due, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return due, nil
+}
+
+func (store *ElasticPackStore) Delete(id string) error {
+	return store.index.Delete(packType, id)
+}
+
+//---------------------------------------------------------------------
+
+// checkAdmin returns an error response unless apiKey is the admin key. With
+// no admin key configured, admin operations are refused.
+func (service *Service) checkAdmin(apiKey string) *piazza.JsonResponse {
+	if service.adminKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(service.adminKey)) != 1 {
+		return service.newErrorResponse(http.StatusForbidden, "not authorized")
+	}
+	return nil
+}
+
+// PostPacks issues a signed pack of IDs for offline use. apiKey must be
+// the admin key.
+func (service *Service) PostPacks(apiKey string, request *PackRequest) *piazza.JsonResponse {
+	if resp := service.checkAdmin(apiKey); resp != nil {
+		return resp
+	}
+	if request.Count < 1 || request.Count > MaxPackSize {
+		s := fmt.Sprintf("count out of range: %d", request.Count)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+	if request.IssuedTo == "" {
+		return service.newErrorResponse(http.StatusBadRequest, "issuedTo is required")
+	}
+	validity := DefaultPackValidity
+	if request.Validity != "" {
+		var err error
+		validity, err = time.ParseDuration(request.Validity)
+		if err != nil || validity <= 0 || validity > MaxPackValidity {
+			return service.newErrorResponse(http.StatusBadRequest, "invalid validity: "+request.Validity)
+		}
+	}
+
+	uuids, err := newUuids(service.random, request.Count)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen random source failed: %s", err.Error())
+		return service.newErrorResponse(http.StatusServiceUnavailable, "random source failure: "+err.Error())
+	}
+
+	ids, err := service.randomUuids(1)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen random source failed: %s", err.Error())
+		return service.newErrorResponse(http.StatusServiceUnavailable, "random source failure: "+err.Error())
+	}
+
+	now := time.Now()
+	pack := &IdPack{
+		Id:         ids[0],
+		Instance:   service.instance,
+		IssuedTo:   request.IssuedTo,
+		IssuedOn:   now,
+		ValidUntil: now.Add(validity),
+	}
+
+	pack.Uuids, err = service.recordNew(uuids, service.randomUuids, func(uuid string) *IdRecord {
+		return &IdRecord{
+			Uuid:        uuid,
+			State:       IdReserved,
+			Reservation: pack.Id,
+			CreatedOn:   now,
+			UpdatedOn:   now,
+		}
+	})
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	var tag []byte
+	service.refreshKeys()
+	pack.KeyId, tag, err = service.keys.Sign(packMessage(pack))
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	pack.Signature = base64.StdEncoding.EncodeToString(tag)
+
+	err = service.packs.Put(&PackRecord{
+		Id:         pack.Id,
+		IssuedTo:   pack.IssuedTo,
+		ValidUntil: pack.ValidUntil,
+		Uuids:      pack.Uuids,
+		DueOn:      pack.ValidUntil.Add(PackGrace),
+		Version:    1,
+	})
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen pack store failed: %s", err.Error())
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	service.sweepPacks(now)
+
+	atomic.AddInt64(&service.numUUIDs, int64(len(pack.Uuids)))
+	atomic.AddInt64(&service.numRequests, 1)
+
+	_ = service.syslogger.Audit(request.IssuedTo, "exportPack", pack.Id, "uuidgen exported pack %s of %d uuids to %s, valid until %s",
+		pack.Id, len(pack.Uuids), request.IssuedTo, pack.ValidUntil.Format(time.RFC3339))
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusCreated, Data: pack}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// PostPackReconcile takes the IDs of a pack that were used. Those are
+// confirmed, the rest of the pack is released, and the pack is closed.
+func (service *Service) PostPackReconcile(id string, registration *Registration) *piazza.JsonResponse {
+	// closing the pack first means only one reconcile goes on to the IDs
+	now := time.Now()
+	record, err := service.packs.Update(id, func(r *PackRecord) error {
+		if !r.ReconciledOn.IsZero() {
+			return &conflictError{"pack already reconciled: " + id}
+		}
+		r.reconciled(now)
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(*conflictError); ok {
+			return service.newErrorResponse(http.StatusConflict, err.Error())
+		}
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if record == nil {
+		return service.newErrorResponse(http.StatusNotFound, "pack not found: "+id)
+	}
+
+	member := make(map[string]bool, len(record.Uuids))
+	for _, uuid := range record.Uuids {
+		member[uuid] = true
+	}
+
+	result := &PackReconciliation{Pack: id, Unused: []string{}, Expired: now.After(record.ValidUntil)}
+	used := map[string]bool{}
+	for _, uuid := range registration.Uuids {
+		if !member[uuid] {
+			result.Unknown = append(result.Unknown, uuid)
+			continue
+		}
+		used[uuid] = true
+	}
+	result.Used = len(used)
+
+	for _, uuid := range record.Uuids {
+		next := IdReleased
+		if used[uuid] {
+			next = IdConfirmed
+		} else {
+			result.Unused = append(result.Unused, uuid)
+		}
+		_, err := service.ids.Update(uuid, func(r *IdRecord) error {
+			if r.State == IdReserved {
+				r.State = next
+				r.UpdatedOn = now
+			}
+			return nil
+		})
+		if err != nil {
+			// reopen the pack, so that the reconcile can be tried again
+			_, reopenErr := service.packs.Update(id, func(r *PackRecord) error {
+				r.ReconciledOn = time.Time{}
+				r.DueOn = r.ValidUntil.Add(PackGrace)
+				return nil
+			})
+			if reopenErr != nil {
+				_ = service.syslogger.Error("uuidgen could not reopen pack %s: %s", id, reopenErr.Error())
+			}
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	_ = service.syslogger.Audit(record.IssuedTo, "reconcilePack", record.Id, "uuidgen reconciled pack %s: %d used, %d unused, %d unknown",
+		record.Id, result.Used, len(result.Unused), len(result.Unknown))
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: result}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// sweepPacks drops packs reconciled more than ReservationRetention ago, and
+// those not reconciled within PackGrace of their validity, abandoning
+// their IDs. It runs at most a few times per retention period.
+func (service *Service) sweepPacks(now time.Time) {
+	service.packLock.Lock()
+	due := now.Sub(service.packsSwept) >= ReservationRetention/4
+	if due {
+		service.packsSwept = now
+	}
+	service.packLock.Unlock()
+	if !due {
+		return
+	}
+
+	records, err := service.packs.Due(now)
+	if err != nil {
+		_ = service.syslogger.Warning("uuidgen pack sweep failed: %s", err.Error())
+		return
+	}
+	for _, record := range records {
+		if record.ReconciledOn.IsZero() {
+			var err error
+			for _, uuid := range record.Uuids {
+				_, err = service.ids.Update(uuid, func(r *IdRecord) error {
+					if r.State == IdReserved {
+						r.State = IdAbandoned
+						r.UpdatedOn = now
+					}
+					return nil
+				})
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				// keep it, and try again next sweep
+				_ = service.syslogger.Error("uuidgen could not abandon pack %s: %s", record.Id, err.Error())
+				continue
+			}
+			_ = service.syslogger.Warning("uuidgen dropped pack %s, never reconciled", record.Id)
+		}
+
+		err = service.packs.Delete(record.Id)
+		if err != nil {
+			_ = service.syslogger.Warning("uuidgen pack sweep failed: %s", err.Error())
+			return
+		}
+	}
+}
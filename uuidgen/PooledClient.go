@@ -0,0 +1,223 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// errEmptyBatch is a refill error: the wrapped client returned no IDs.
+var errEmptyBatch = errors.New("pz-uuidgen returned no uuids")
+
+// PoolOptions controls how a PooledClient keeps itself stocked.
+type PoolOptions struct {
+	// BatchSize is the count asked for on each refill request.
+	BatchSize int
+
+	// Capacity is the number of IDs a refill tops the pool up to.
+	Capacity int
+
+	// LowWater is the level below which a background refill is started.
+	LowWater int
+
+	// RefillTimeout bounds each refill request.
+	RefillTimeout time.Duration
+}
+
+func DefaultPoolOptions() *PoolOptions {
+	return &PoolOptions{
+		BatchSize:     100,
+		Capacity:      200,
+		LowWater:      50,
+		RefillTimeout: 10 * time.Second,
+	}
+}
+
+// PooledClient wraps another IClient and hands out IDs from a local pool,
+// which it refills asynchronously in batches. Refill errors are only
+// reported to callers when the pool has run dry. It is safe for concurrent use.
+type PooledClient struct {
+	sync.Mutex
+	client  IClient
+	options PoolOptions
+	ids     []string
+	lastErr error
+	refill  chan struct{} // non-nil while a refill is running; closed when it ends
+}
+
+func NewPooledClient(client IClient, options *PoolOptions) (*PooledClient, error) {
+	var _ IClient = new(PooledClient)
+
+	if options.BatchSize < 1 {
+		return nil, fmt.Errorf("pool batch size out of range: %d", options.BatchSize)
+	}
+	if options.Capacity < options.BatchSize || options.LowWater < 0 || options.LowWater >= options.Capacity {
+		return nil, fmt.Errorf("invalid pool sizes: capacity %d, low water %d", options.Capacity, options.LowWater)
+	}
+
+	pool := &PooledClient{
+		client:  client,
+		options: *options,
+		ids:     make([]string, 0, options.Capacity),
+	}
+
+	pool.Lock()
+	pool.startRefill()
+	pool.Unlock()
+
+	return pool, nil
+}
+
+// Available returns the number of IDs currently held.
+func (pool *PooledClient) Available() int {
+	pool.Lock()
+	defer pool.Unlock()
+	return len(pool.ids)
+}
+
+// startRefill must be called with the lock held. It returns a channel that
+// is closed when the current refill ends.
+func (pool *PooledClient) startRefill() chan struct{} {
+	if pool.refill != nil {
+		return pool.refill
+	}
+	done := make(chan struct{})
+	pool.refill = done
+	go pool.doRefill(done)
+	return done
+}
+
+func (pool *PooledClient) doRefill(done chan struct{}) {
+	var err error
+
+	for {
+		pool.Lock()
+		full := len(pool.ids) >= pool.options.Capacity
+		pool.Unlock()
+		if full {
+			break
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), pool.options.RefillTimeout)
+		var data *[]string
+		data, err = pool.client.PostUuidsContext(ctx, pool.options.BatchSize)
+		cancel()
+		if err != nil {
+			break
+		}
+		if data == nil || len(*data) == 0 {
+			// asking again would get the same
+			err = errEmptyBatch
+			break
+		}
+
+		pool.Lock()
+		pool.ids = append(pool.ids, *data...)
+		pool.Unlock()
+	}
+
+	pool.Lock()
+	pool.lastErr = err
+	pool.refill = nil
+	pool.Unlock()
+	close(done)
+}
+
+// take removes count IDs from the pool, waiting for a refill if there are
+// not enough.
+func (pool *PooledClient) take(ctx context.Context, count int) ([]string, error) {
+	for {
+		pool.Lock()
+		if len(pool.ids) >= count {
+			out := make([]string, count)
+			copy(out, pool.ids)
+			pool.ids = pool.ids[count:]
+			if len(pool.ids) < pool.options.LowWater {
+				pool.startRefill()
+			}
+			pool.Unlock()
+			return out, nil
+		}
+		done := pool.startRefill()
+		pool.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		pool.Lock()
+		err := pool.lastErr
+		short := len(pool.ids) < count
+		pool.Unlock()
+		if err != nil && short {
+			return nil, err
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+
+func (pool *PooledClient) GetUUID() (string, error) {
+	return pool.GetUUIDContext(context.Background())
+}
+
+func (pool *PooledClient) GetUUIDContext(ctx context.Context) (string, error) {
+	ids, err := pool.take(ctx, 1)
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+func (pool *PooledClient) PostUuids(count int) (*[]string, error) {
+	return pool.PostUuidsContext(context.Background(), count)
+}
+
+// PostUuidsContext serves counts up to the batch size from the pool; larger
+// (or invalid) counts go straight to the wrapped client.
+func (pool *PooledClient) PostUuidsContext(ctx context.Context, count int) (*[]string, error) {
+	if count < 0 || count > pool.options.BatchSize {
+		return pool.client.PostUuidsContext(ctx, count)
+	}
+	ids, err := pool.take(ctx, count)
+	if err != nil {
+		return nil, err
+	}
+	return &ids, nil
+}
+
+func (pool *PooledClient) GetStats() (*Stats, error) {
+	return pool.client.GetStats()
+}
+
+func (pool *PooledClient) GetStatsContext(ctx context.Context) (*Stats, error) {
+	return pool.client.GetStatsContext(ctx)
+}
+
+func (pool *PooledClient) GetVersion() (*piazza.Version, error) {
+	return pool.client.GetVersion()
+}
+
+func (pool *PooledClient) GetVersionContext(ctx context.Context) (*piazza.Version, error) {
+	return pool.client.GetVersionContext(ctx)
+}
@@ -0,0 +1,167 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"crypto/rand"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"sync"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// RandomSource supplies the random bytes behind every generated ID. It has
+// the same contract as io.Reader; implementations must be safe for
+// concurrent use.
+type RandomSource interface {
+	Read(b []byte) (int, error)
+}
+
+// NewCryptoSource returns the operating system's CSPRNG (crypto/rand).
+func NewCryptoSource() RandomSource {
+	return rand.Reader
+}
+
+//---------------------------------------------------------------------
+
+// SeededSource is a deterministic source, for tests only.
+type SeededSource struct {
+	sync.Mutex
+	random *mathrand.Rand
+}
+
+func NewSeededSource(seed int64) *SeededSource {
+	return &SeededSource{random: mathrand.New(mathrand.NewSource(seed))}
+}
+
+func (src *SeededSource) Read(b []byte) (int, error) {
+	src.Lock()
+	defer src.Unlock()
+	return src.random.Read(b)
+}
+
+//---------------------------------------------------------------------
+
+// FileSource reads from a file or device, such as a hardware RNG exposed at
+// /dev/hwrng. Reaching the end of a regular file is an error, not a wrap-around.
+type FileSource struct {
+	sync.Mutex
+	file *os.File
+}
+
+func NewFileSource(path string) (*FileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSource{file: file}, nil
+}
+
+func (src *FileSource) Read(b []byte) (int, error) {
+	src.Lock()
+	defer src.Unlock()
+	return io.ReadFull(src.file, b)
+}
+
+func (src *FileSource) Close() error {
+	return src.file.Close()
+}
+
+//---------------------------------------------------------------------
+
+// newUuid makes a random (version 4) UUID from src. Unlike piazza.NewUuid,
+// a failing source is reported rather than panicking.
+func newUuid(src RandomSource) (piazza.Uuid, error) {
+	uuid := make(piazza.Uuid, 16)
+	_, err := io.ReadFull(src, uuid)
+	if err != nil {
+		return nil, err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // Version 4
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // Variant is 10
+	return uuid, nil
+}
+
+//---------------------------------------------------------------------
+
+const hexDigits = "0123456789abcdef"
+
+// randomBuffers holds scratch space for newUuids, big enough for a batch of
+// DefaultMaxCount.
+var randomBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 16*DefaultMaxCount)
+		return &b
+	},
+}
+
+// newUuids makes count version 4 UUIDs, in their string form, from a single
+// read of src. All the strings share one backing string, so the number of
+// allocations does not grow with the size of the batch.
+func newUuids(src RandomSource, count int) ([]string, error) {
+	if count <= 0 {
+		return []string{}, nil
+	}
+
+	bufp := randomBuffers.Get().(*[]byte)
+	if cap(*bufp) < 16*count {
+		*bufp = make([]byte, 16*count)
+	}
+	raw := (*bufp)[:16*count]
+	defer func() {
+		// the next user mustn't see the bits behind these IDs
+		for i := range raw {
+			raw[i] = 0
+		}
+		randomBuffers.Put(bufp)
+	}()
+
+	_, err := io.ReadFull(src, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 36*count)
+	for i := 0; i < count; i++ {
+		uuid := raw[16*i : 16*i+16]
+		uuid[6] = (uuid[6] & 0x0f) | 0x40 // Version 4
+		uuid[8] = (uuid[8] & 0x3f) | 0x80 // Variant is 10
+		encodeUuid(out[36*i:36*i+36], uuid)
+	}
+
+	text := string(out)
+
+	uuids := make([]string, count)
+	for i := range uuids {
+		uuids[i] = text[36*i : 36*i+36]
+	}
+	return uuids, nil
+}
+
+// encodeUuid writes the canonical 8-4-4-4-12 form of uuid into dst.
+func encodeUuid(dst []byte, uuid []byte) {
+	j := 0
+	for i, b := range uuid {
+		if i == 4 || i == 6 || i == 8 || i == 10 {
+			dst[j] = '-'
+			j++
+		}
+		dst[j] = hexDigits[b>>4]
+		dst[j+1] = hexDigits[b&0x0f]
+		j += 2
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// Integer ranges are leased out in blocks, for hi/lo key allocation: a
+// client takes a block and hands out its values locally. A range's high
+// water mark is a counter in the service's CounterStore, so a block is
+// never issued twice; the leases themselves are kept for bookkeeping.
+// Ranges are refused unless that store is durable.
+const (
+	DefaultBlockSize = 10000
+	MaxBlockSize     = MaxCounterIncrement
+
+	// range counters live alongside the named counters, under a prefix
+	// that no counter name can have
+	rangeKeyPrefix = "range:"
+
+	leaseType = "lease"
+
+	// the page size when listing a range's leases
+	leasesPerPage = 100
+)
+
+// the range is an exact value, not text, so that a range's leases can be
+// found with a term query
+const leaseMapping = `{
+	"lease": {
+		"properties": {
+			"id": {"type": "string", "index": "not_analyzed"},
+			"range": {"type": "string", "index": "not_analyzed"}
+		}
+	}
+}`
+
+// BlockLease is one block of a range, First to Last inclusive.
+type BlockLease struct {
+	Id         string    `json:"id"`
+	Range      string    `json:"range"`
+	Holder     string    `json:"holder,omitempty"`
+	First      int64     `json:"first"`
+	Last       int64     `json:"last"`
+	LeasedOn   time.Time `json:"leasedOn"`
+	ReleasedOn time.Time `json:"releasedOn,omitempty"`
+
+	// Used, if the holder said on release, is how many values it used.
+	Used *int64 `json:"used,omitempty"`
+}
+
+// IntRange is the state of a range: the first value not yet leased, and
+// the leases not yet released.
+type IntRange struct {
+	Name        string        `json:"name"`
+	Next        int64         `json:"next"`
+	Outstanding []*BlockLease `json:"outstanding"`
+}
+
+// BlockRelease is the optional body of a POST to
+// /ranges/{name}/blocks/{id}/release.
+type BlockRelease struct {
+	Used int64 `json:"used"`
+}
+
+//---------------------------------------------------------------------
+
+// LeaseStore holds block leases. Implementations must be safe for
+// concurrent use.
+type LeaseStore interface {
+	// Get returns nil, and no error, for a lease it doesn't have.
+	Get(id string) (*BlockLease, error)
+	Put(lease *BlockLease) error
+	List(rangeName string) ([]*BlockLease, error)
+}
+
+// MemoryLeaseStore is a LeaseStore that lives in memory.
+type MemoryLeaseStore struct {
+	sync.Mutex
+	leases map[string]*BlockLease
+}
+
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: map[string]*BlockLease{}}
+}
+
+func (store *MemoryLeaseStore) Get(id string) (*BlockLease, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	lease, ok := store.leases[id]
+	if !ok {
+		return nil, nil
+	}
+	out := *lease
+	return &out, nil
+}
+
+func (store *MemoryLeaseStore) Put(lease *BlockLease) error {
+	store.Lock()
+	defer store.Unlock()
+
+	in := *lease
+	store.leases[lease.Id] = &in
+	return nil
+}
+
+func (store *MemoryLeaseStore) List(rangeName string) ([]*BlockLease, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	var out []*BlockLease
+	for _, lease := range store.leases {
+		if lease.Range == rangeName {
+			copied := *lease
+			out = append(out, &copied)
+		}
+	}
+	return out, nil
+}
+
+//---------------------------------------------------------------------
+
+// ElasticLeaseStore keeps leases in an Elasticsearch index, so that they
+// survive restarts and can be released at any instance. Writes are not
+// versioned: the values are spent however a lease is recorded, so two
+// instances releasing the same lease at once lose only a used count.
+type ElasticLeaseStore struct {
+	index DocumentIndex
+}
+
+// NewElasticLeaseStore uses index, creating it if need be.
+func NewElasticLeaseStore(index DocumentIndex) (*ElasticLeaseStore, error) {
+	err := index.Prepare(leaseType, leaseMapping)
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticLeaseStore{index: index}, nil
+}
+
+func (store *ElasticLeaseStore) Get(id string) (*BlockLease, error) {
+	lease := &BlockLease{}
+	ok, err := getDocument(store.index, leaseType, id, lease)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (store *ElasticLeaseStore) Put(lease *BlockLease) error {
+	_, err := store.index.Put(leaseType, lease.Id, 0, lease, false)
+	return err
+}
+
+func (store *ElasticLeaseStore) List(rangeName string) ([]*BlockLease, error) {
+	var out []*BlockLease
+	query := DocumentQuery{Field: "range", Values: []string{rangeName}, SortBy: "id"}
+	err := searchAll(store.index, leaseType, query, leasesPerPage, func(doc json.RawMessage) error {
+		lease := &BlockLease{}
+		err := json.Unmarshal(doc, lease)
+		if err != nil {
+			return err
+		}
+		out = append(out, lease)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//---------------------------------------------------------------------
+
+// PostBlocks leases the next block of a range, creating the range, from
+// 1, if need be.
+//
+//	?size=INT      values in the block; the default is DefaultBlockSize
+//	?holder=STRING who the block is for
+func (service *Service) PostBlocks(name string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	if resp := service.checkRanges(); resp != nil {
+		return resp
+	}
+	if !validCounterName(name) {
+		return service.newErrorResponse(http.StatusBadRequest, fmt.Sprintf("invalid range name: %q", name))
+	}
+	size, err := params.GetAsInt("size", DefaultBlockSize)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if size < 1 || size > MaxBlockSize {
+		s := fmt.Sprintf("size out of range: %d", size)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+	holder, err := params.GetAsString("holder", "")
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	key := rangeKeyPrefix + name
+	now := time.Now()
+	_, err = service.counters.Create(&Counter{Name: key, CreatedOn: now, UpdatedOn: now, Version: 1})
+	if err != nil {
+		return service.counterResponse(0, nil, err)
+	}
+	r, err := incrementCounter(service.counters, key, int64(size))
+	if err != nil {
+		return service.counterResponse(0, nil, err)
+	}
+
+	ids, err := service.randomUuids(1)
+	if err != nil {
+		return service.newErrorResponse(http.StatusServiceUnavailable, err.Error())
+	}
+	lease := &BlockLease{
+		Id:       ids[0],
+		Range:    name,
+		Holder:   holder,
+		First:    r.First,
+		Last:     r.Last,
+		LeasedOn: now,
+	}
+	err = service.leases.Put(lease)
+	if err != nil {
+		// the block is spent either way: it is never issued again
+		_ = service.syslogger.Error("uuidgen could not record lease of %s %d-%d: %s", name, r.First, r.Last, err.Error())
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	_ = service.syslogger.Info("uuidgen leased %s %d-%d to %q", name, r.First, r.Last, holder)
+
+	return service.counterResponse(http.StatusCreated, lease, nil)
+}
+
+// GetRange reports a range's next value and its outstanding leases, in
+// order.
+func (service *Service) GetRange(name string) *piazza.JsonResponse {
+	if resp := service.checkRanges(); resp != nil {
+		return resp
+	}
+	counter, err := service.counters.Get(rangeKeyPrefix + name)
+	if err != nil {
+		return service.counterResponse(0, nil, err)
+	}
+	if counter == nil {
+		return service.newErrorResponse(http.StatusNotFound, "range not found: "+name)
+	}
+
+	leases, err := service.leases.List(name)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	outstanding := []*BlockLease{}
+	for _, lease := range leases {
+		if lease.ReleasedOn.IsZero() {
+			outstanding = append(outstanding, lease)
+		}
+	}
+	sort.Slice(outstanding, func(i, j int) bool { return outstanding[i].First < outstanding[j].First })
+
+	data := &IntRange{Name: name, Next: counter.Value + 1, Outstanding: outstanding}
+	return service.counterResponse(http.StatusOK, data, nil)
+}
+
+// PostBlockRelease ends a lease. Its unused values are not issued again.
+// release may be nil.
+func (service *Service) PostBlockRelease(name string, id string, release *BlockRelease) *piazza.JsonResponse {
+	if resp := service.checkRanges(); resp != nil {
+		return resp
+	}
+	service.leaseLock.Lock()
+	defer service.leaseLock.Unlock()
+
+	lease, err := service.leases.Get(id)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if lease == nil || lease.Range != name {
+		return service.newErrorResponse(http.StatusNotFound, "lease not found: "+id)
+	}
+	if !lease.ReleasedOn.IsZero() {
+		return service.newErrorResponse(http.StatusConflict, "lease already released: "+id)
+	}
+	if release != nil {
+		if release.Used < 0 || release.Used > lease.Last-lease.First+1 {
+			s := fmt.Sprintf("used out of range: %d", release.Used)
+			return service.newErrorResponse(http.StatusBadRequest, s)
+		}
+		used := release.Used
+		lease.Used = &used
+	}
+	lease.ReleasedOn = time.Now()
+
+	err = service.leases.Put(lease)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return service.counterResponse(http.StatusOK, lease, nil)
+}
+
+// checkRanges refuses integer ranges when counters are kept in memory: a
+// restart would lease the same blocks again.
+func (service *Service) checkRanges() *piazza.JsonResponse {
+	if service.counters.Durable() {
+		return nil
+	}
+	return service.newErrorResponse(http.StatusServiceUnavailable,
+		"integer ranges need a durable counter store; set UUIDGEN_COUNTER_INDEX")
+}
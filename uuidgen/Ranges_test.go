@@ -0,0 +1,243 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// newRangeService is a Service that allows integer ranges, with its
+// counters and leases on MockDocumentIndexes.
+func newRangeService(t testing.TB) *Service {
+	counters, err := NewElasticCounterStore(NewMockDocumentIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases, err := NewElasticLeaseStore(NewMockDocumentIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &Service{}
+	sys := &piazza.SystemConfig{Name: piazza.PzUuidgen}
+	err = service.InitWithOptions(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, &ServiceOptions{Counters: counters, Leases: leases})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// serviceBlockClient is an IBlockClient that calls a Service directly.
+type serviceBlockClient struct {
+	service *Service
+	fail    bool
+}
+
+func (c *serviceBlockClient) LeaseBlockContext(ctx context.Context, name string, size int, holder string) (*BlockLease, error) {
+	if c.fail {
+		return nil, errors.New("unreachable")
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("/?size=%d&holder=%s", size, url.QueryEscape(holder)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := c.service.PostBlocks(name, piazza.NewQueryParams(req))
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	return resp.Data.(*BlockLease), nil
+}
+
+func (c *serviceBlockClient) ReleaseBlockContext(ctx context.Context, lease *BlockLease, used int64) (*BlockLease, error) {
+	resp := c.service.PostBlockRelease(lease.Range, lease.Id, &BlockRelease{Used: used})
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	return resp.Data.(*BlockLease), nil
+}
+
+func TestBlockLeases(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newRangeService(t)
+	client := &serviceBlockClient{service: service}
+	ctx := context.Background()
+
+	a, err := client.LeaseBlockContext(ctx, "orders", 100, "a")
+	assert.NoError(err)
+	assert.Equal(int64(1), a.First)
+	assert.Equal(int64(100), a.Last)
+	b, err := client.LeaseBlockContext(ctx, "orders", 10, "b")
+	assert.NoError(err)
+	assert.Equal(int64(101), b.First)
+	assert.Equal(int64(110), b.Last)
+
+	// ranges are independent of each other and of the named counters
+	c, err := client.LeaseBlockContext(ctx, "invoices", 5, "")
+	assert.NoError(err)
+	assert.Equal(int64(1), c.First)
+	_, err = createCounter(service.counters, &CounterRequest{Name: "orders"})
+	assert.NoError(err)
+
+	resp := service.GetRange("orders")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	state := resp.Data.(*IntRange)
+	assert.Equal(int64(111), state.Next)
+	assert.Len(state.Outstanding, 2)
+	assert.Equal(a.Id, state.Outstanding[0].Id)
+
+	released, err := client.ReleaseBlockContext(ctx, a, 40)
+	assert.NoError(err)
+	assert.Equal(int64(40), *released.Used)
+	_, err = client.ReleaseBlockContext(ctx, a, 40)
+	assert.Error(err)
+	assert.Equal(http.StatusConflict, service.PostBlockRelease("orders", a.Id, nil).StatusCode)
+	assert.Equal(http.StatusNotFound, service.PostBlockRelease("invoices", b.Id, nil).StatusCode)
+	assert.Equal(http.StatusBadRequest, service.PostBlockRelease("orders", b.Id, &BlockRelease{Used: 11}).StatusCode)
+
+	// released values are never leased again
+	state = service.GetRange("orders").Data.(*IntRange)
+	assert.Len(state.Outstanding, 1)
+	d, err := client.LeaseBlockContext(ctx, "orders", 1, "")
+	assert.NoError(err)
+	assert.Equal(int64(111), d.First)
+
+	assert.Equal(http.StatusNotFound, service.GetRange("missing").StatusCode)
+	_, err = client.LeaseBlockContext(ctx, "orders", MaxBlockSize+1, "")
+	assert.Error(err)
+	_, err = client.LeaseBlockContext(ctx, "bad name", 1, "")
+	assert.Error(err)
+}
+
+func TestBlockAllocator(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newRangeService(t)
+	client := &serviceBlockClient{service: service}
+
+	options := DefaultAllocatorOptions()
+	options.BlockSize = 50
+	options.LowWater = 10
+	allocator, err := NewBlockAllocator(client, "keys", options)
+	assert.NoError(err)
+
+	var mutex sync.Mutex
+	seen := map[int64]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 60; j++ {
+				v, err := allocator.Next(context.Background())
+				if !assert.NoError(err) {
+					return
+				}
+				mutex.Lock()
+				assert.False(seen[v])
+				seen[v] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(seen, 480)
+
+	assert.NoError(allocator.Close())
+	_, err = allocator.Next(context.Background())
+	assert.Equal(ErrAllocatorClosed, err)
+
+	// the spent blocks are released in the background
+	var state *IntRange
+	for i := 0; i < 100; i++ {
+		state = service.GetRange("keys").Data.(*IntRange)
+		if len(state.Outstanding) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(state.Outstanding)
+	for v := int64(1); v <= 480; v++ {
+		assert.True(seen[v])
+	}
+
+	_, err = NewBlockAllocator(client, "keys", &AllocatorOptions{BlockSize: 10, LowWater: 10})
+	assert.Error(err)
+}
+
+func TestRangesNeedDurableCounters(t *testing.T) {
+	assert := assert.New(t)
+
+	// a restart would lease the same blocks again
+	service := newTestService(t)
+	req, _ := http.NewRequest("POST", "/?size=10", nil)
+	assert.Equal(http.StatusServiceUnavailable, service.PostBlocks("orders", piazza.NewQueryParams(req)).StatusCode)
+	assert.Equal(http.StatusServiceUnavailable, service.GetRange("orders").StatusCode)
+	assert.Equal(http.StatusServiceUnavailable, service.PostBlockRelease("orders", "0f8fad5b-d9cb-469f-a165-70867728950e", nil).StatusCode)
+}
+
+func TestLeaseStores(t *testing.T) {
+	assert := assert.New(t)
+
+	elastic, err := NewElasticLeaseStore(NewMockDocumentIndex())
+	assert.NoError(err)
+
+	for _, store := range []LeaseStore{NewMemoryLeaseStore(), elastic} {
+		lease, err := store.Get("a")
+		assert.NoError(err)
+		assert.Nil(lease)
+
+		now := time.Now().UTC()
+		assert.NoError(store.Put(&BlockLease{Id: "a", Range: "orders", First: 1, Last: 10, LeasedOn: now}))
+		assert.NoError(store.Put(&BlockLease{Id: "b", Range: "orders", First: 11, Last: 20, LeasedOn: now}))
+		assert.NoError(store.Put(&BlockLease{Id: "c", Range: "invoices", First: 1, Last: 5, LeasedOn: now}))
+
+		used := int64(4)
+		assert.NoError(store.Put(&BlockLease{Id: "a", Range: "orders", First: 1, Last: 10, LeasedOn: now, ReleasedOn: now, Used: &used}))
+		lease, err = store.Get("a")
+		assert.NoError(err)
+		assert.Equal(int64(4), *lease.Used)
+		assert.False(lease.ReleasedOn.IsZero())
+
+		leases, err := store.List("orders")
+		assert.NoError(err)
+		assert.Len(leases, 2)
+		leases, err = store.List("missing")
+		assert.NoError(err)
+		assert.Empty(leases)
+	}
+}
+
+func TestBlockAllocatorDry(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &serviceBlockClient{service: newTestService(t), fail: true}
+	allocator, err := NewBlockAllocator(client, "keys", DefaultAllocatorOptions())
+	assert.NoError(err)
+
+	_, err = allocator.Next(context.Background())
+	assert.EqualError(err, "unreachable")
+	assert.NoError(allocator.Close())
+}
@@ -0,0 +1,692 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const (
+	DefaultReservationTTL = time.Hour
+	MaxReservationTTL     = 7 * 24 * time.Hour
+
+	// ReservationRetention is how long a reservation can still be looked
+	// up once all its IDs are settled, or it has expired.
+	ReservationRetention = time.Hour
+
+	// MaxReservationsPerPage bounds ?perPage when listing reservations.
+	MaxReservationsPerPage = 1000
+)
+
+// ReservationMixed is the state of a reservation whose IDs are not all in
+// the same state, e.g. some confirmed and the rest released.
+const ReservationMixed IdState = "mixed"
+
+// Reservation is a batch of IDs handed out together, and the state of each.
+type Reservation struct {
+	Id        string             `json:"id"`
+	State     IdState            `json:"state"`
+	CreatedOn time.Time          `json:"createdOn"`
+	ExpiresOn time.Time          `json:"expiresOn"`
+	Uuids     []string           `json:"uuids"`
+	States    map[string]IdState `json:"states"`
+}
+
+// conflictError is a request that the ID's state doesn't allow.
+type conflictError struct {
+	message string
+}
+
+func (e *conflictError) Error() string {
+	return e.message
+}
+
+//---------------------------------------------------------------------
+
+// ReservationRecord is what is kept of a reservation; the states of its IDs
+// live in the IdStore.
+type ReservationRecord struct {
+	Id        string    `json:"id"`
+	CreatedOn time.Time `json:"createdOn"`
+	ExpiresOn time.Time `json:"expiresOn"`
+	SettledOn time.Time `json:"settledOn,omitempty"` // when none of its IDs were left reserved
+	DoneOn    time.Time `json:"doneOn"`              // the earlier of ExpiresOn and SettledOn
+	Uuids     []string  `json:"uuids"`
+	Version   int64     `json:"version"`
+}
+
+// settle notes that none of the reservation's IDs is still reserved.
+func (r *ReservationRecord) settle(now time.Time) {
+	if !r.SettledOn.IsZero() {
+		return
+	}
+	r.SettledOn = now
+	if now.Before(r.DoneOn) {
+		r.DoneOn = now
+	}
+}
+
+// ReservationStore holds ReservationRecords. Implementations must be safe
+// for concurrent use.
+type ReservationStore interface {
+	// Get returns nil, and no error, for a reservation it doesn't have.
+	Get(id string) (*ReservationRecord, error)
+
+	Put(record *ReservationRecord) error
+
+	// Update applies fn to a copy of the record and, if fn succeeds,
+	// stores the result. It returns nil, and no error, for an unknown
+	// reservation.
+	Update(id string, fn func(*ReservationRecord) error) (*ReservationRecord, error)
+
+	// List returns a page of the records, by creation time in the order
+	// format asks for, and how many there are in all.
+	List(format *piazza.JsonPagination) ([]*ReservationRecord, int, error)
+
+	// Sweep drops the records done before t.
+	Sweep(t time.Time) error
+}
+
+//---------------------------------------------------------------------
+
+// MemoryReservationStore is a ReservationStore that lives in memory.
+type MemoryReservationStore struct {
+	sync.Mutex
+	records map[string]*ReservationRecord
+}
+
+func NewMemoryReservationStore() *MemoryReservationStore {
+	return &MemoryReservationStore{records: map[string]*ReservationRecord{}}
+}
+
+func (store *MemoryReservationStore) Get(id string) (*ReservationRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	r, ok := store.records[id]
+	if !ok {
+		return nil, nil
+	}
+	out := *r
+	return &out, nil
+}
+
+func (store *MemoryReservationStore) Put(record *ReservationRecord) error {
+	store.Lock()
+	defer store.Unlock()
+
+	in := *record
+	store.records[record.Id] = &in
+	return nil
+}
+
+func (store *MemoryReservationStore) Update(id string, fn func(*ReservationRecord) error) (*ReservationRecord, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	r, ok := store.records[id]
+	if !ok {
+		return nil, nil
+	}
+	out := *r
+	err := fn(&out)
+	if err != nil {
+		return nil, err
+	}
+	out.Version++
+	*r = out
+	return &out, nil
+}
+
+func (store *MemoryReservationStore) List(format *piazza.JsonPagination) ([]*ReservationRecord, int, error) {
+	store.Lock()
+	all := make([]*ReservationRecord, 0, len(store.records))
+	for _, r := range store.records {
+		out := *r
+		all = append(all, &out)
+	}
+	store.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if format.Order == piazza.SortOrderAscending {
+			return all[i].CreatedOn.Before(all[j].CreatedOn)
+		}
+		return all[i].CreatedOn.After(all[j].CreatedOn)
+	})
+
+	start, end := format.StartIndex(), format.EndIndex()
+	if start > len(all) {
+		start = len(all)
+	}
+	if end > len(all) {
+		end = len(all)
+	}
+	return all[start:end], len(all), nil
+}
+
+func (store *MemoryReservationStore) Sweep(t time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for id, r := range store.records {
+		if r.DoneOn.Before(t) {
+			delete(store.records, id)
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+
+const reservationType = "reservation"
+
+const reservationMapping = `{
+	"reservation": {
+		"properties": {
+			"id": {"type": "string", "index": "not_analyzed"},
+			"createdOn": {"type": "date"},
+			"doneOn": {"type": "date"},
+			"uuids": {"type": "string", "index": "not_analyzed"}
+		}
+	}
+}`
+
+// reservationsPerPage is the page size when sweeping.
+const reservationsPerPage = 100
+
+// ElasticReservationStore keeps reservations in an Elasticsearch index, so
+// that they survive restarts and are shared between instances. Updates
+// are versioned as for ElasticCounterStore.
+type ElasticReservationStore struct {
+	index DocumentIndex
+}
+
+// NewElasticReservationStore uses index, creating it if need be.
+func NewElasticReservationStore(index DocumentIndex) (*ElasticReservationStore, error) {
+	err := index.Prepare(reservationType, reservationMapping)
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticReservationStore{index: index}, nil
+}
+
+func (store *ElasticReservationStore) Get(id string) (*ReservationRecord, error) {
+	record := &ReservationRecord{}
+	ok, err := getDocument(store.index, reservationType, id, record)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (store *ElasticReservationStore) Put(record *ReservationRecord) error {
+	ok, err := store.index.Put(reservationType, record.Id, record.Version, record, true)
+	if err == nil && !ok {
+		err = fmt.Errorf("reservation already exists: %s", record.Id)
+	}
+	return err
+}
+
+func (store *ElasticReservationStore) Update(id string, fn func(*ReservationRecord) error) (*ReservationRecord, error) {
+	for i := 0; i < counterAttempts; i++ {
+		record, err := store.Get(id)
+		if err != nil || record == nil {
+			return nil, err
+		}
+
+		err = fn(record)
+		if err != nil {
+			return nil, err
+		}
+		record.Version++
+
+		ok, err := store.index.Put(reservationType, id, record.Version, record, false)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return record, nil
+		}
+		// another instance changed it since we read it
+	}
+	return nil, fmt.Errorf("reservation too busy, try again: %s", id)
+}
+
+func (store *ElasticReservationStore) List(format *piazza.JsonPagination) ([]*ReservationRecord, int, error) {
+	query := &DocumentQuery{
+		SortBy:     "createdOn",
+		Descending: format.Order != piazza.SortOrderAscending,
+		From:       format.StartIndex(),
+		Size:       format.PerPage,
+	}
+	docs, total, err := store.index.Search(reservationType, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	out := []*ReservationRecord{}
+	for _, doc := range docs {
+		record := &ReservationRecord{}
+		err = json.Unmarshal(doc, record)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, record)
+	}
+	return out, total, nil
+}
+
+func (store *ElasticReservationStore) Sweep(t time.Time) error {
+	// find them all before deleting any, so that the pages don't shift
+	var due []string
+	query := DocumentQuery{BeforeField: "doneOn", Before: t, SortBy: "id"}
+	err := searchAll(store.index, reservationType, query, reservationsPerPage, func(doc json.RawMessage) error {
+		record := &ReservationRecord{}
+		err := json.Unmarshal(doc, record)
+		if err != nil {
+			return err
+		}
+		due = append(due, record.Id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range due {
+		err = store.index.Delete(reservationType, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+
+// PostReservations generates IDs in the reserved state. Each must be
+// confirmed or released before the TTL runs out, or it is abandoned.
+//
+//	?count=INT  number of IDs, as for PostUuids
+//	?ttl=DUR    e.g. "30m"; default one hour, at most a week
+func (service *Service) PostReservations(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	count, err := params.GetCount(1)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if count < 1 || count > service.maxCount {
+		s := fmt.Sprintf("query argument out of range: %d", count)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+
+	ttl := DefaultReservationTTL
+	s, err := params.GetAsString("ttl", "")
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if s != "" {
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 || ttl > MaxReservationTTL {
+			return service.newErrorResponse(http.StatusBadRequest, "invalid ttl: "+s)
+		}
+	}
+
+	uuids, err := newUuids(service.random, count)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen random source failed: %s", err.Error())
+		return service.newErrorResponse(http.StatusServiceUnavailable, "random source failure: "+err.Error())
+	}
+
+	ids, err := service.randomUuids(1)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen random source failed: %s", err.Error())
+		return service.newErrorResponse(http.StatusServiceUnavailable, "random source failure: "+err.Error())
+	}
+
+	now := time.Now()
+	res := &ReservationRecord{
+		Id:        ids[0],
+		CreatedOn: now,
+		ExpiresOn: now.Add(ttl),
+		Version:   1,
+	}
+	res.DoneOn = res.ExpiresOn
+
+	res.Uuids, err = service.recordNew(uuids, service.randomUuids, func(uuid string) *IdRecord {
+		return &IdRecord{
+			Uuid:        uuid,
+			State:       IdReserved,
+			Reservation: res.Id,
+			CreatedOn:   now,
+			UpdatedOn:   now,
+			ExpiresOn:   res.ExpiresOn,
+		}
+	})
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	err = service.reservations.Put(res)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen reservation store failed: %s", err.Error())
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	service.sweepReservations(now)
+
+	atomic.AddInt64(&service.numUUIDs, int64(count))
+	atomic.AddInt64(&service.numRequests, 1)
+
+	_ = service.syslogger.Info("uuidgen reserved %d uuids as %s, until %s", count, res.Id, res.ExpiresOn.Format(time.RFC3339))
+
+	return service.reservationResponse(http.StatusCreated, res)
+}
+
+// GetReservation reports the state of a reservation and its IDs.
+func (service *Service) GetReservation(id string) *piazza.JsonResponse {
+	res, err := service.reservations.Get(id)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if res == nil {
+		return service.newErrorResponse(http.StatusNotFound, "reservation not found: "+id)
+	}
+	return service.reservationResponse(http.StatusOK, res)
+}
+
+// GetReservations lists reservations, a page at a time.
+//
+//	?state=STATE    only those in this state, e.g. "reserved" or "mixed"
+//	?page=INT       from 0
+//	?perPage=INT    default 10, at most 1000
+//	?order=ORDER    by creation time: "desc", the default, or "asc"
+func (service *Service) GetReservations(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	state, err := params.GetAsString("state", "")
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if format.Page < 0 || format.PerPage < 1 || format.PerPage > MaxReservationsPerPage {
+		s := fmt.Sprintf("page out of range: page %d, perPage %d", format.Page, format.PerPage)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+	if format.SortBy != "createdOn" {
+		return service.newErrorResponse(http.StatusBadRequest, "cannot sort by: "+format.SortBy)
+	}
+
+	var list []*Reservation
+	if state == "" {
+		list, format.Count, err = service.listReservations(format)
+	} else {
+		list, format.Count, err = service.listReservationsIn(IdState(state), format)
+	}
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: list, Pagination: format}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// PostReservationConfirm marks the listed IDs of a reservation, or all of
+// them if none are listed, as used.
+func (service *Service) PostReservationConfirm(id string, registration *Registration) *piazza.JsonResponse {
+	return service.settleReservation(id, registration, func(r *IdRecord) error {
+		if r.Revoked {
+			return &conflictError{fmt.Sprintf("cannot confirm %s: revoked", r.Uuid)}
+		}
+		switch r.State {
+		case IdReserved:
+			r.State = IdConfirmed
+		case IdConfirmed:
+		default:
+			return &conflictError{fmt.Sprintf("cannot confirm %s: %s", r.Uuid, r.State)}
+		}
+		return nil
+	})
+}
+
+// PostReservationRelease gives back the listed IDs of a reservation, or all
+// of them if none are listed. Releasing an abandoned ID is allowed, and
+// leaves it abandoned.
+func (service *Service) PostReservationRelease(id string, registration *Registration) *piazza.JsonResponse {
+	return service.settleReservation(id, registration, func(r *IdRecord) error {
+		switch r.State {
+		case IdReserved:
+			r.State = IdReleased
+		case IdReleased, IdAbandoned:
+		default:
+			return &conflictError{fmt.Sprintf("cannot release %s: %s", r.Uuid, r.State)}
+		}
+		return nil
+	})
+}
+
+//---------------------------------------------------------------------
+
+// listReservations returns a page of reservations, and how many there are.
+func (service *Service) listReservations(format *piazza.JsonPagination) ([]*Reservation, int, error) {
+	records, total, err := service.reservations.List(format)
+	if err != nil {
+		return nil, 0, err
+	}
+	list := []*Reservation{}
+	for _, res := range records {
+		view, err := service.viewReservation(res)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, view)
+	}
+	return list, total, nil
+}
+
+// listReservationsIn returns a page of the reservations in state, and how
+// many there are. The state is that of the IDs, so every reservation has
+// to be looked at.
+func (service *Service) listReservationsIn(state IdState, format *piazza.JsonPagination) ([]*Reservation, int, error) {
+	list := []*Reservation{}
+	total := 0
+	for page := 0; ; page++ {
+		scan := &piazza.JsonPagination{
+			PerPage: MaxReservationsPerPage,
+			Page:    page,
+			SortBy:  format.SortBy,
+			Order:   format.Order,
+		}
+		records, _, err := service.reservations.List(scan)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, res := range records {
+			view, err := service.viewReservation(res)
+			if err != nil {
+				return nil, 0, err
+			}
+			if view.State != state {
+				continue
+			}
+			if total >= format.StartIndex() && total < format.EndIndex() {
+				list = append(list, view)
+			}
+			total++
+		}
+		if len(records) < MaxReservationsPerPage {
+			return list, total, nil
+		}
+	}
+}
+
+// settleReservation applies change to the chosen IDs. It checks them all
+// first, so that a conflict normally leaves the reservation untouched;
+// only a change made by someone else between the check and our own can
+// leave it partly applied, and that is reported as a conflict too.
+func (service *Service) settleReservation(id string, registration *Registration, change func(*IdRecord) error) *piazza.JsonResponse {
+	res, err := service.reservations.Get(id)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if res == nil {
+		return service.newErrorResponse(http.StatusNotFound, "reservation not found: "+id)
+	}
+
+	uuids := res.Uuids
+	if registration != nil && len(registration.Uuids) > 0 {
+		member := map[string]bool{}
+		for _, uuid := range res.Uuids {
+			member[uuid] = true
+		}
+		for _, uuid := range registration.Uuids {
+			if !member[uuid] {
+				return service.newErrorResponse(http.StatusBadRequest, "not in reservation: "+uuid)
+			}
+		}
+		uuids = registration.Uuids
+	}
+
+	for _, uuid := range uuids {
+		r, err := service.ids.Get(uuid)
+		if err != nil {
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		if r == nil {
+			return service.newErrorResponse(http.StatusInternalServerError, "missing record: "+uuid)
+		}
+		err = change(r)
+		if err != nil {
+			return service.newErrorResponse(http.StatusConflict, err.Error())
+		}
+	}
+
+	now := time.Now()
+	for _, uuid := range uuids {
+		_, err := service.ids.Update(uuid, func(r *IdRecord) error {
+			before := r.State
+			err := change(r)
+			if err == nil && r.State != before {
+				r.UpdatedOn = now
+			}
+			return err
+		})
+		if err != nil {
+			code := http.StatusInternalServerError
+			if _, ok := err.(*conflictError); ok {
+				code = http.StatusConflict // changed since the check
+			}
+			return service.newErrorResponse(code, err.Error())
+		}
+	}
+
+	view, err := service.viewReservation(res)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if res.SettledOn.IsZero() && settled(view) {
+		_, err = service.reservations.Update(id, func(r *ReservationRecord) error {
+			r.settle(now)
+			return nil
+		})
+		if err != nil {
+			_ = service.syslogger.Warning("uuidgen could not mark reservation %s settled: %s", id, err.Error())
+		}
+	}
+	return service.viewResponse(http.StatusOK, view)
+}
+
+// settled reports whether none of a reservation's IDs is still reserved.
+func settled(view *Reservation) bool {
+	for _, state := range view.States {
+		if state == IdReserved {
+			return false
+		}
+	}
+	return true
+}
+
+// sweepReservations drops reservations kept for ReservationRetention past
+// their expiry or settlement, at most a few times per retention period.
+func (service *Service) sweepReservations(now time.Time) {
+	service.reservationLock.Lock()
+	due := now.Sub(service.reservationsSwept) >= ReservationRetention/4
+	if due {
+		service.reservationsSwept = now
+	}
+	service.reservationLock.Unlock()
+	if !due {
+		return
+	}
+
+	err := service.reservations.Sweep(now.Add(-ReservationRetention))
+	if err != nil {
+		_ = service.syslogger.Warning("uuidgen reservation sweep failed: %s", err.Error())
+	}
+}
+
+func (service *Service) viewReservation(res *ReservationRecord) (*Reservation, error) {
+	view := &Reservation{
+		Id:        res.Id,
+		CreatedOn: res.CreatedOn,
+		ExpiresOn: res.ExpiresOn,
+		Uuids:     res.Uuids,
+		States:    make(map[string]IdState, len(res.Uuids)),
+	}
+	for _, uuid := range res.Uuids {
+		r, err := service.ids.Get(uuid)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			return nil, fmt.Errorf("missing record: %s", uuid)
+		}
+		view.States[uuid] = r.State
+		if view.State == "" {
+			view.State = r.State
+		} else if view.State != r.State {
+			view.State = ReservationMixed
+		}
+	}
+	return view, nil
+}
+
+func (service *Service) reservationResponse(statusCode int, res *ReservationRecord) *piazza.JsonResponse {
+	view, err := service.viewReservation(res)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return service.viewResponse(statusCode, view)
+}
+
+func (service *Service) viewResponse(statusCode int, view *Reservation) *piazza.JsonResponse {
+	resp := &piazza.JsonResponse{StatusCode: statusCode, Data: view}
+	err := resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
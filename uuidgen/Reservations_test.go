@@ -0,0 +1,188 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func reservationParams(query string) *piazza.HttpQueryParams {
+	req, _ := http.NewRequest("GET", "/reservations?"+query, nil)
+	return piazza.NewQueryParams(req)
+}
+
+func TestReservationPages(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		resp := service.PostReservations(reservationParams("count=1"))
+		assert.Equal(http.StatusCreated, resp.StatusCode)
+		res := resp.Data.(*Reservation)
+		assert.True(ValidUuidV4(res.Id))
+		ids = append(ids, res.Id)
+	}
+	service.PostReservationConfirm(ids[0], nil)
+
+	resp := service.GetReservations(reservationParams("perPage=2&page=1"))
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	list := resp.Data.([]*Reservation)
+	assert.Len(list, 2)
+	assert.Equal(5, resp.Pagination.Count)
+
+	resp = service.GetReservations(reservationParams("perPage=2&page=2&order=asc"))
+	list = resp.Data.([]*Reservation)
+	assert.Len(list, 1)
+	assert.Equal(ids[4], list[0].Id)
+
+	resp = service.GetReservations(reservationParams("state=reserved&perPage=10"))
+	assert.Len(resp.Data.([]*Reservation), 4)
+	assert.Equal(4, resp.Pagination.Count)
+
+	for _, bad := range []string{"perPage=0", "perPage=1001", "page=-1", "sortBy=uuid"} {
+		resp = service.GetReservations(reservationParams(bad))
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, bad)
+	}
+}
+
+func TestReservationSweep(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+	settledRes := service.PostReservations(reservationParams("count=1")).Data.(*Reservation)
+	openRes := service.PostReservations(reservationParams("count=1")).Data.(*Reservation)
+	service.PostReservationRelease(settledRes.Id, nil)
+
+	// the settled one goes after the retention; the open one waits for
+	// its expiry
+	service.sweepReservations(time.Now().Add(ReservationRetention + time.Minute))
+	assert.Equal(http.StatusNotFound, service.GetReservation(settledRes.Id).StatusCode)
+	assert.Equal(http.StatusOK, service.GetReservation(openRes.Id).StatusCode)
+
+	service.sweepReservations(time.Now().Add(DefaultReservationTTL + ReservationRetention + time.Minute))
+	assert.Equal(http.StatusNotFound, service.GetReservation(openRes.Id).StatusCode)
+}
+
+func TestReservationsPersist(t *testing.T) {
+	assert := assert.New(t)
+
+	ids := NewMockDocumentIndex()
+	reservations := NewMockDocumentIndex()
+	start := func() *Service {
+		idStore, err := NewElasticIdStore(ids)
+		assert.NoError(err)
+		resStore, err := NewElasticReservationStore(reservations)
+		assert.NoError(err)
+		service := &Service{}
+		sys := &piazza.SystemConfig{Name: piazza.PzUuidgen}
+		err = service.InitWithOptions(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, &ServiceOptions{Ids: idStore, Reservations: resStore})
+		assert.NoError(err)
+		return service
+	}
+
+	// a reservation made before a restart can be settled after it
+	res := start().PostReservations(reservationParams("count=2")).Data.(*Reservation)
+	service := start()
+	resp := service.PostReservationConfirm(res.Id, &Registration{Uuids: res.Uuids[:1]})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp = service.PostReservationRelease(res.Id, &Registration{Uuids: res.Uuids[1:]})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp = start().GetReservation(res.Id)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	view := resp.Data.(*Reservation)
+	assert.Equal(ReservationMixed, view.State)
+	assert.Equal(IdConfirmed, view.States[res.Uuids[0]])
+	assert.Equal(IdReleased, view.States[res.Uuids[1]])
+
+	record, err := service.reservations.Get(res.Id)
+	assert.NoError(err)
+	assert.False(record.SettledOn.IsZero())
+	assert.Equal(record.SettledOn, record.DoneOn)
+
+	resp = start().GetReservations(reservationParams("state=mixed"))
+	assert.Equal(1, resp.Pagination.Count)
+}
+
+func TestPackSweep(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+	service.adminKey = "secret"
+	resp := service.PostPacks("secret", &PackRequest{Count: 2, IssuedTo: "team-7"})
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	lost := resp.Data.(*IdPack)
+	assert.True(ValidUuidV4(lost.Id))
+	done := service.PostPacks("secret", &PackRequest{Count: 1, IssuedTo: "team-8"}).Data.(*IdPack)
+	resp = service.PostPackReconcile(done.Id, &Registration{Uuids: done.Uuids})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	service.sweepPacks(time.Now().Add(ReservationRetention + time.Minute))
+	assert.Equal(http.StatusNotFound, service.PostPackReconcile(done.Id, &Registration{}).StatusCode)
+	record, err := service.packs.Get(lost.Id)
+	assert.NoError(err)
+	assert.NotNil(record)
+
+	// a pack never reconciled is dropped after the grace period, and its
+	// IDs abandoned
+	service.sweepPacks(lost.ValidUntil.Add(PackGrace + time.Minute))
+	record, err = service.packs.Get(lost.Id)
+	assert.NoError(err)
+	assert.Nil(record)
+	id, err := service.ids.Get(lost.Uuids[0])
+	assert.NoError(err)
+	assert.Equal(IdAbandoned, id.State)
+}
+
+func TestPacksPersist(t *testing.T) {
+	assert := assert.New(t)
+
+	ids := NewMockDocumentIndex()
+	packs := NewMockDocumentIndex()
+	start := func() *Service {
+		idStore, err := NewElasticIdStore(ids)
+		assert.NoError(err)
+		packStore, err := NewElasticPackStore(packs)
+		assert.NoError(err)
+		service := &Service{}
+		sys := &piazza.SystemConfig{Name: piazza.PzUuidgen}
+		err = service.InitWithOptions(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, &ServiceOptions{Ids: idStore, Packs: packStore, AdminKey: "secret"})
+		assert.NoError(err)
+		return service
+	}
+
+	// a pack exported before a restart can be reconciled after it, once
+	pack := start().PostPacks("secret", &PackRequest{Count: 2, IssuedTo: "team-7"}).Data.(*IdPack)
+	service := start()
+	resp := service.PostPackReconcile(pack.Id, &Registration{Uuids: pack.Uuids[:1]})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(1, resp.Data.(*PackReconciliation).Used)
+	resp = start().PostPackReconcile(pack.Id, &Registration{})
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+
+	record, err := service.ids.Get(pack.Uuids[0])
+	assert.NoError(err)
+	assert.Equal(IdConfirmed, record.State)
+	record, err = service.ids.Get(pack.Uuids[1])
+	assert.NoError(err)
+	assert.Equal(IdReleased, record.State)
+}
@@ -0,0 +1,251 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// MaxBulkRevocations is the most IDs one bulk request may revoke.
+const MaxBulkRevocations = 10000
+
+// RevocationRequest is the body of a revoke or unrevoke. Uuids is used
+// only by the bulk form.
+type RevocationRequest struct {
+	Uuids  []string `json:"uuids,omitempty"`
+	Actor  string   `json:"actor"`
+	Reason string   `json:"reason"`
+}
+
+// BulkRevocation reports what a bulk revoke did.
+type BulkRevocation struct {
+	Revoked        int      `json:"revoked"`
+	AlreadyRevoked int      `json:"alreadyRevoked"`
+	Invalid        []string `json:"invalid,omitempty"`
+}
+
+//---------------------------------------------------------------------
+
+// GetId reports what the service knows about an ID, including whether it
+// has been revoked. As for claims, the ID may be in upper case.
+func (service *Service) GetId(uuid string) *piazza.JsonResponse {
+	uuid = strings.ToLower(uuid)
+	if !ValidUuid(uuid) {
+		return service.newErrorResponse(http.StatusBadRequest, "invalid uuid: "+uuid)
+	}
+
+	record, err := service.getId(uuid)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if record == nil {
+		return service.newErrorResponse(http.StatusNotFound, "unknown uuid: "+uuid)
+	}
+
+	return service.idRecordResponse(http.StatusOK, record)
+}
+
+// PostRevocation marks an ID as revoked. IDs the service has no record of
+// can be revoked too. Revoking a revoked ID changes nothing. apiKey must be
+// the admin key.
+func (service *Service) PostRevocation(apiKey string, uuid string, request *RevocationRequest) *piazza.JsonResponse {
+	if resp := service.checkAdmin(apiKey); resp != nil {
+		return resp
+	}
+	uuid = strings.ToLower(uuid)
+	if !ValidUuid(uuid) {
+		return service.newErrorResponse(http.StatusBadRequest, "invalid uuid: "+uuid)
+	}
+	if request.Actor == "" || request.Reason == "" {
+		return service.newErrorResponse(http.StatusBadRequest, "actor and reason are required")
+	}
+
+	record, _, err := service.revoke(uuid, request.Actor, request.Reason)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	return service.idRecordResponse(http.StatusOK, record)
+}
+
+// DeleteRevocation lifts a revocation. The actor is required, for the
+// audit trail; the reason is optional. apiKey must be the admin key.
+func (service *Service) DeleteRevocation(apiKey string, uuid string, request *RevocationRequest) *piazza.JsonResponse {
+	if resp := service.checkAdmin(apiKey); resp != nil {
+		return resp
+	}
+	uuid = strings.ToLower(uuid)
+	if !ValidUuid(uuid) {
+		return service.newErrorResponse(http.StatusBadRequest, "invalid uuid: "+uuid)
+	}
+	if request.Actor == "" {
+		return service.newErrorResponse(http.StatusBadRequest, "actor is required")
+	}
+
+	changed := false
+	record, err := service.ids.Update(uuid, func(r *IdRecord) error {
+		changed = r.Revoked
+		r.Revoked = false
+		r.Revocation = nil
+		return nil
+	})
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if record == nil || !changed {
+		return service.newErrorResponse(http.StatusNotFound, "not revoked: "+uuid)
+	}
+
+	_ = service.syslogger.Audit(request.Actor, "unrevoke", uuid, "uuidgen unrevoked %s: %s", uuid, request.Reason)
+
+	return service.idRecordResponse(http.StatusOK, record)
+}
+
+// PostRevocations revokes a list of IDs. Invalid IDs are reported, and do
+// not stop the valid ones being revoked. apiKey must be the admin key.
+func (service *Service) PostRevocations(apiKey string, request *RevocationRequest) *piazza.JsonResponse {
+	if resp := service.checkAdmin(apiKey); resp != nil {
+		return resp
+	}
+	if request.Actor == "" || request.Reason == "" {
+		return service.newErrorResponse(http.StatusBadRequest, "actor and reason are required")
+	}
+	if len(request.Uuids) > MaxBulkRevocations {
+		s := fmt.Sprintf("too many uuids: %d", len(request.Uuids))
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+
+	result := &BulkRevocation{}
+	for _, uuid := range request.Uuids {
+		if !ValidUuid(strings.ToLower(uuid)) {
+			result.Invalid = append(result.Invalid, uuid)
+			continue
+		}
+		uuid = strings.ToLower(uuid)
+		_, changed, err := service.revoke(uuid, request.Actor, request.Reason)
+		if err != nil {
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		if changed {
+			result.Revoked++
+		} else {
+			result.AlreadyRevoked++
+		}
+	}
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: result}
+	err := resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+//---------------------------------------------------------------------
+
+// revoke revokes one ID, creating a record for it if need be. It reports
+// whether anything changed.
+func (service *Service) revoke(uuid string, actor string, reason string) (*IdRecord, bool, error) {
+	now := time.Now()
+	changed := false
+	apply := func(r *IdRecord) error {
+		if r.Revoked {
+			return nil
+		}
+		changed = true
+		r.Revoked = true
+		r.Revocation = &Revocation{Actor: actor, Reason: reason, RevokedOn: now}
+		r.UpdatedOn = now
+		return nil
+	}
+
+	record, err := service.upsertId(uuid, apply)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if changed {
+		_ = service.syslogger.Audit(actor, "revoke", uuid, "uuidgen revoked %s: %s", uuid, reason)
+	}
+
+	return record, changed, nil
+}
+
+// upsertId applies fn to the record for uuid, first creating one if there
+// isn't one: in the issued state for an ID issued without a record, and
+// otherwise in the unknown state.
+func (service *Service) upsertId(uuid string, fn func(*IdRecord) error) (*IdRecord, error) {
+	for {
+		record, err := service.ids.Update(uuid, fn)
+		if err != nil || record != nil {
+			return record, err
+		}
+
+		fresh, err := service.issuedRecord(uuid)
+		if err != nil {
+			return nil, err
+		}
+		if fresh == nil {
+			now := time.Now()
+			fresh = &IdRecord{Uuid: uuid, State: IdUnknown, CreatedOn: now, UpdatedOn: now}
+		}
+		err = fn(fresh)
+		if err != nil {
+			return nil, err
+		}
+		existing, err := service.ids.Insert([]*IdRecord{fresh})
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) == 0 {
+			return fresh, nil
+		}
+		// someone else created it first; go round and update theirs
+	}
+}
+
+func (service *Service) idRecordResponse(statusCode int, record *IdRecord) *piazza.JsonResponse {
+	resp := &piazza.JsonResponse{StatusCode: statusCode, Data: record}
+	err := resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// readUuidList reads one ID per line, ignoring blank lines and lines
+// starting with "#".
+func readUuidList(r io.Reader) ([]string, error) {
+	var uuids []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		uuids = append(uuids, line)
+		if len(uuids) > MaxBulkRevocations {
+			break
+		}
+	}
+	return uuids, scanner.Err()
+}
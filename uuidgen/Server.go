@@ -15,6 +15,10 @@
 package uuidgen
 
 import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -37,7 +41,47 @@ func (server *Server) Init(service *Service) error {
 		{Verb: "GET", Path: "/", Handler: server.handleGetRoot},
 		{Verb: "GET", Path: "/version", Handler: server.handleGetVersion},
 		{Verb: "GET", Path: "/admin/stats", Handler: server.handleGetStats},
+		{Verb: "GET", Path: "/admin/diagnostics", Handler: server.handleGetDiagnostics},
+		{Verb: "GET", Path: "/capabilities", Handler: server.handleGetCapabilities},
 		{Verb: "POST", Path: "/uuids", Handler: server.handlePostUuids},
+		{Verb: "POST", Path: "/registrations", Handler: server.handlePostRegistrations},
+		{Verb: "POST", Path: "/claims", Handler: server.handlePostClaims},
+		{Verb: "POST", Path: "/packs", Handler: server.handlePostPacks},
+		{Verb: "POST", Path: "/packs/:id/reconcile", Handler: server.handlePostPackReconcile},
+		{Verb: "POST", Path: "/signed-uuids", Handler: server.handlePostSignedUuids},
+		{Verb: "POST", Path: "/verify", Handler: server.handlePostVerify},
+		{Verb: "GET", Path: "/admin/keys", Handler: server.handleGetKeys},
+		{Verb: "POST", Path: "/admin/keys", Handler: server.handlePostKeys},
+		{Verb: "DELETE", Path: "/admin/keys/:id", Handler: server.handleDeleteKey},
+		{Verb: "POST", Path: "/typed-uuids", Handler: server.handlePostTypedUuids},
+		{Verb: "GET", Path: "/typed-uuids/:id", Handler: server.handleGetTypedUuid},
+		{Verb: "GET", Path: "/admin/prefixes", Handler: server.handleGetPrefixes},
+		{Verb: "POST", Path: "/admin/prefixes", Handler: server.handlePostPrefixes},
+		{Verb: "DELETE", Path: "/admin/prefixes/:id", Handler: server.handleDeletePrefix},
+		{Verb: "POST", Path: "/short-ids", Handler: server.handlePostShortIds},
+		{Verb: "GET", Path: "/short-ids/:id", Handler: server.handleGetShortId},
+		{Verb: "POST", Path: "/geo-uuids", Handler: server.handlePostGeoUuids},
+		{Verb: "GET", Path: "/geo-uuids/:id", Handler: server.handleGetGeoUuid},
+		{Verb: "POST", Path: "/counters", Handler: server.handlePostCounters},
+		{Verb: "GET", Path: "/counters/:id", Handler: server.handleGetCounter},
+		{Verb: "POST", Path: "/counters/:id/increment", Handler: server.handlePostCounterIncrement},
+		{Verb: "GET", Path: "/ranges/:id", Handler: server.handleGetRange},
+		{Verb: "POST", Path: "/ranges/:id/blocks", Handler: server.handlePostBlocks},
+		{Verb: "POST", Path: "/ranges/:id/blocks/:block/release", Handler: server.handlePostBlockRelease},
+		{Verb: "POST", Path: "/nonces", Handler: server.handlePostNonces},
+		{Verb: "POST", Path: "/nonces/:id/redeem", Handler: server.handlePostNonceRedeem},
+		{Verb: "GET", Path: "/uuids/:id", Handler: server.handleGetId},
+		{Verb: "POST", Path: "/uuids/:id/children", Handler: server.handlePostChildren},
+		{Verb: "GET", Path: "/uuids/:id/children", Handler: server.handleGetChildren},
+		{Verb: "GET", Path: "/uuids/:id/ancestry", Handler: server.handleGetAncestry},
+		{Verb: "POST", Path: "/revocations", Handler: server.handlePostRevocations},
+		{Verb: "POST", Path: "/revocations/:id", Handler: server.handlePostRevocation},
+		{Verb: "DELETE", Path: "/revocations/:id", Handler: server.handleDeleteRevocation},
+		{Verb: "GET", Path: "/reservations", Handler: server.handleGetReservations},
+		{Verb: "POST", Path: "/reservations", Handler: server.handlePostReservations},
+		{Verb: "GET", Path: "/reservations/:id", Handler: server.handleGetReservation},
+		{Verb: "POST", Path: "/reservations/:id/confirm", Handler: server.handlePostReservationConfirm},
+		{Verb: "POST", Path: "/reservations/:id/release", Handler: server.handlePostReservationRelease},
 	}
 	server.service = service
 	return nil
@@ -60,10 +104,387 @@ func (server *Server) handleGetStats(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetDiagnostics(c *gin.Context) {
+	resp := server.service.GetDiagnostics()
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetCapabilities(c *gin.Context) {
+	resp := server.service.GetCapabilities()
+	piazza.GinReturnJson(c, resp)
+}
+
 // request body is ignored
 // we allow a count of zero, for testing
 func (server *Server) handlePostUuids(c *gin.Context) {
 	params := piazza.NewQueryParams(c.Request)
-	resp := server.service.PostUuids(params)
+	key := c.Request.Header.Get(IdempotencyHeader)
+	resp := server.service.PostUuidsWithKey(params, key)
+	ginReturnStringList(c, resp)
+}
+
+func (server *Server) handlePostRegistrations(c *gin.Context) {
+	var registration Registration
+	err := json.NewDecoder(c.Request.Body).Decode(&registration)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostRegistrations(&registration)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetReservations(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetReservations(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostReservations(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.PostReservations(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetReservation(c *gin.Context) {
+	resp := server.service.GetReservation(c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+// the body, a Registration listing the IDs to confirm, is optional
+func (server *Server) handlePostReservationConfirm(c *gin.Context) {
+	registration, resp := decodeOptionalRegistration(c)
+	if resp == nil {
+		resp = server.service.PostReservationConfirm(c.Param("id"), registration)
+	}
+	piazza.GinReturnJson(c, resp)
+}
+
+// the body, a Registration listing the IDs to release, is optional
+func (server *Server) handlePostReservationRelease(c *gin.Context) {
+	registration, resp := decodeOptionalRegistration(c)
+	if resp == nil {
+		resp = server.service.PostReservationRelease(c.Param("id"), registration)
+	}
+	piazza.GinReturnJson(c, resp)
+}
+
+func decodeOptionalRegistration(c *gin.Context) (*Registration, *piazza.JsonResponse) {
+	var registration Registration
+	err := json.NewDecoder(c.Request.Body).Decode(&registration)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	return &registration, nil
+}
+
+func (server *Server) handleGetId(c *gin.Context) {
+	resp := server.service.GetId(c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostRevocation(c *gin.Context) {
+	var request RevocationRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	apiKey, _, _ := c.Request.BasicAuth()
+	resp := server.service.PostRevocation(apiKey, c.Param("id"), &request)
+	piazza.GinReturnJson(c, resp)
+}
+
+// the actor and reason come from the body or, for clients that can't send
+// a body with a DELETE, from the query
+func (server *Server) handleDeleteRevocation(c *gin.Context) {
+	var request RevocationRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	if request.Actor == "" {
+		request.Actor = c.Query("actor")
+	}
+	if request.Reason == "" {
+		request.Reason = c.Query("reason")
+	}
+	apiKey, _, _ := c.Request.BasicAuth()
+	resp := server.service.DeleteRevocation(apiKey, c.Param("id"), &request)
+	piazza.GinReturnJson(c, resp)
+}
+
+// The IDs come as a JSON RevocationRequest; as a text file, one per line,
+// with ?actor= and ?reason=; or as a form upload, in the field "file",
+// with "actor" and "reason" fields.
+func (server *Server) handlePostRevocations(c *gin.Context) {
+	var request RevocationRequest
+	var err error
+
+	contentType, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+	switch contentType {
+	case "multipart/form-data":
+		var file multipart.File
+		file, _, err = c.Request.FormFile("file")
+		if err == nil {
+			defer file.Close()
+			request.Uuids, err = readUuidList(file)
+			request.Actor = c.Request.FormValue("actor")
+			request.Reason = c.Request.FormValue("reason")
+		}
+	case "text/plain", "text/csv":
+		request.Uuids, err = readUuidList(c.Request.Body)
+		request.Actor = c.Query("actor")
+		request.Reason = c.Query("reason")
+	default:
+		err = json.NewDecoder(c.Request.Body).Decode(&request)
+	}
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	apiKey, _, _ := c.Request.BasicAuth()
+	resp := server.service.PostRevocations(apiKey, &request)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostClaims(c *gin.Context) {
+	var request ClaimRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostClaims(&request)
+	piazza.GinReturnJson(c, resp)
+}
+
+// the caller's API key, sent as the basic auth user name, must be the
+// admin key
+func (server *Server) handlePostPacks(c *gin.Context) {
+	var request PackRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	apiKey, _, _ := c.Request.BasicAuth()
+	resp := server.service.PostPacks(apiKey, &request)
+	if resp.StatusCode == http.StatusCreated {
+		pack := resp.Data.(*IdPack)
+		c.Header("Content-Disposition", "attachment; filename=\"pack-"+pack.Id+".json\"")
+	}
+	piazza.GinReturnJson(c, resp)
+}
+
+// the body is a Registration listing the IDs that were used
+func (server *Server) handlePostPackReconcile(c *gin.Context) {
+	var registration Registration
+	err := json.NewDecoder(c.Request.Body).Decode(&registration)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostPackReconcile(c.Param("id"), &registration)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostSignedUuids(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.PostSignedUuids(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostVerify(c *gin.Context) {
+	var signed SignedUuid
+	err := json.NewDecoder(c.Request.Body).Decode(&signed)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostVerify(&signed)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetKeys(c *gin.Context) {
+	resp := server.service.GetKeys()
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostKeys(c *gin.Context) {
+	var newKey NewKey
+	err := json.NewDecoder(c.Request.Body).Decode(&newKey)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	apiKey, _, _ := c.Request.BasicAuth()
+	resp := server.service.PostKeys(apiKey, &newKey)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteKey(c *gin.Context) {
+	apiKey, _, _ := c.Request.BasicAuth()
+	resp := server.service.DeleteKey(apiKey, c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostTypedUuids(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.PostTypedUuids(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetTypedUuid(c *gin.Context) {
+	resp := server.service.GetTypedUuid(c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetPrefixes(c *gin.Context) {
+	resp := server.service.GetPrefixes()
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostPrefixes(c *gin.Context) {
+	var prefix TypePrefix
+	err := json.NewDecoder(c.Request.Body).Decode(&prefix)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	apiKey, _, _ := c.Request.BasicAuth()
+	resp := server.service.PostPrefixes(apiKey, &prefix)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeletePrefix(c *gin.Context) {
+	apiKey, _, _ := c.Request.BasicAuth()
+	resp := server.service.DeletePrefix(apiKey, c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+// the body, a ShortIdRequest, is optional
+func (server *Server) handlePostShortIds(c *gin.Context) {
+	var request ShortIdRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostShortIds(&request)
+	ginReturnStringList(c, resp)
+}
+
+func (server *Server) handleGetShortId(c *gin.Context) {
+	resp := server.service.GetShortId(c.Param("id"), c.Query("scope"))
+	piazza.GinReturnJson(c, resp)
+}
+
+// the body, a ChildRequest, is optional
+func (server *Server) handlePostChildren(c *gin.Context) {
+	var request ChildRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostChildren(c.Param("id"), &request)
+	ginReturnStringList(c, resp)
+}
+
+func (server *Server) handleGetChildren(c *gin.Context) {
+	resp := server.service.GetChildren(c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAncestry(c *gin.Context) {
+	resp := server.service.GetAncestry(c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostGeoUuids(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.PostGeoUuids(params)
+	ginReturnStringList(c, resp)
+}
+
+func (server *Server) handleGetGeoUuid(c *gin.Context) {
+	resp := server.service.GetGeoUuid(c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostCounters(c *gin.Context) {
+	var request CounterRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostCounters(&request)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetCounter(c *gin.Context) {
+	resp := server.service.GetCounter(c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostCounterIncrement(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.PostCounterIncrement(c.Param("id"), params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetRange(c *gin.Context) {
+	resp := server.service.GetRange(c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostBlocks(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.PostBlocks(c.Param("id"), params)
+	piazza.GinReturnJson(c, resp)
+}
+
+// the body, a BlockRelease, is optional
+func (server *Server) handlePostBlockRelease(c *gin.Context) {
+	var release *BlockRelease
+	err := json.NewDecoder(c.Request.Body).Decode(&release)
+	if err != nil && err != io.EOF {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostBlockRelease(c.Param("id"), c.Param("block"), release)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostNonces(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.PostNonces(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostNonceRedeem(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.PostNonceRedeem(c.Param("id"), params)
 	piazza.GinReturnJson(c, resp)
 }
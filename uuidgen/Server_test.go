@@ -15,6 +15,7 @@
 package uuidgen
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"testing"
@@ -192,7 +193,63 @@ func (suite *UuidgenTester) Test02Bad() {
 	_, err = client.PostUuids(-1)
 	assert.Error(err)
 
-	// count out of range
-	_, err = client.PostUuids(256)
+	// too big for one request: the client splits it up
+	data, err := client.PostUuids(600)
+	assert.NoError(err)
+	assert.Len(*data, 600)
+	seen := map[string]bool{}
+	for _, uuid := range *data {
+		assert.True(ValidUuidV4(uuid))
+		seen[uuid] = true
+	}
+	assert.Len(seen, 600)
+
+	// but not for the server
+	resp := (&piazza.Http{BaseUrl: suite.kit.Url}).PzPost("/uuids?count=256", nil)
+	assert.Equal(400, resp.StatusCode)
+
+	capabilities, err := suite.client.(*Client).GetCapabilitiesContext(context.Background())
+	assert.NoError(err)
+	assert.Equal(DefaultMaxCount, capabilities.MaxCount)
+}
+
+func (suite *UuidgenTester) Test03Bench() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	config := &BenchConfig{Concurrency: 4, BatchSize: 10, Duration: 250 * time.Millisecond}
+	result, err := suite.kit.Bench(config)
+	assert.NoError(err)
+	assert.NotZero(result.NumRequests)
+	assert.Zero(result.NumErrors)
+	assert.Equal(result.NumRequests*10, result.NumUUIDs)
+	assert.Zero(result.Duplicates)
+	assert.Zero(result.Invalid)
+	assert.Equal(result.NumRequests, result.Latency.Count)
+
+	_, err = suite.kit.Bench(&BenchConfig{Concurrency: 1, BatchSize: 0, Duration: time.Second})
 	assert.Error(err)
+
+	assert.True(ValidUuidV4("0f8fad5b-d9cb-469f-a165-70867728950e"))
+	assert.False(ValidUuidV4("0f8fad5b-d9cb-169f-a165-70867728950e"))
+	assert.False(ValidUuidV4("0f8fad5b-d9cb-469f-a165-70867728950"))
+	assert.False(ValidUuidV4("0f8fad5bxd9cb-469f-a165-70867728950e"))
+}
+
+func (suite *UuidgenTester) Test04Registrations() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	h := &piazza.Http{BaseUrl: suite.kit.Url}
+
+	uuids := []string{piazza.NewUuid().String(), piazza.NewUuid().String()}
+	resp := h.PzPost("/registrations", &Registration{Uuids: uuids})
+	assert.Equal(201, resp.StatusCode)
+
+	resp = h.PzPost("/registrations", &Registration{Uuids: []string{"not-a-uuid"}})
+	assert.Equal(400, resp.StatusCode)
+
+	stats, err := suite.client.GetStats()
+	assert.NoError(err)
+	assert.Equal(2, stats.NumRegistered)
 }
@@ -17,43 +17,444 @@ package uuidgen
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
 	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
 )
 
 //---------------------------------------------------------------------
 
+// ServiceOptions holds the optional parts of a Service's configuration.
+type ServiceOptions struct {
+	// Random is the source of the random bits in every ID. If nil, the
+	// operating system's CSPRNG is used.
+	Random RandomSource
+
+	// Ids records the IDs that are tracked after issue: those claimed,
+	// reserved, linked or revoked. If nil, they are kept in memory, and
+	// lost on restart.
+	Ids IdStore
+
+	// Issued notes the IDs issued without a record of their own, e.g. by
+	// POST /uuids, so that they can't be claimed. If nil, they are kept in
+	// memory, every one of them, and lost on restart.
+	Issued IssuedStore
+
+	// Reservations holds the reservations. If nil, they are kept in
+	// memory, and lost on restart; keep them wherever Ids are kept.
+	Reservations ReservationStore
+
+	// Keys signs ID packs and signed IDs. If nil, a random key is made at
+	// startup, so signatures don't outlive the process, unless KeyStore
+	// already holds keys.
+	Keys *KeyRing
+
+	// KeyStore, if not nil, persists the keys, including those added and
+	// retired at runtime. When it is empty, it starts with Keys, or the
+	// random key.
+	KeyStore KeyStore
+
+	// Packs holds the exported ID packs. If nil, they are kept in memory,
+	// and can't be reconciled after a restart; keep them wherever Ids are
+	// kept.
+	Packs PackStore
+
+	// AdminKey is the API key allowed to export ID packs, revoke and
+	// unrevoke IDs, rotate signing keys and manage typed ID prefixes. If
+	// empty, no one is.
+	AdminKey string
+
+	// Prefixes are those typed IDs may be issued with. If nil,
+	// DefaultPrefixes are used.
+	Prefixes *PrefixRegistry
+
+	// ShortIds records the short IDs issued, by scope. If nil, they are
+	// kept in memory.
+	ShortIds ShortIdStore
+
+	// Blocklist holds substrings short IDs must not contain. If nil,
+	// DefaultBlocklist is used.
+	Blocklist []string
+
+	// Counters holds the named counters, and the high water marks of
+	// integer ranges. If nil, they are kept in memory, and integer ranges
+	// are refused: a restart would issue their blocks again.
+	Counters CounterStore
+
+	// Leases records the blocks leased from integer ranges. If nil, they
+	// are kept in memory.
+	Leases LeaseStore
+
+	// Nonces holds the nonces issued. If nil, they are kept in memory.
+	Nonces NonceStore
+
+	// IdempotencyWindow is how long idempotency keys are remembered. If
+	// zero, DefaultIdempotencyWindow is used.
+	IdempotencyWindow time.Duration
+
+	// IdempotencyIndex, if not nil, persists idempotency keys, so they
+	// survive restarts and are shared between instances.
+	IdempotencyIndex DocumentIndex
+}
+
+// NewServiceOptionsFromEnv builds the options from the environment:
+//
+//	UUIDGEN_RANDOM_DEVICE       file or device to read random bits from,
+//	                            instead of the OS CSPRNG
+//	UUIDGEN_IDEMPOTENCY_WINDOW  how long to remember idempotency keys,
+//	                            e.g. "1h"
+//	UUIDGEN_IDEMPOTENCY_INDEX   Elasticsearch index in which to persist
+//	                            idempotency keys
+//	UUIDGEN_SIGNING_KEYS        "id1:base64key1,id2:base64key2"; the
+//	                            first is current
+//	UUIDGEN_KEY_INDEX           Elasticsearch index in which to keep the
+//	                            signing keys; UUIDGEN_SIGNING_KEYS only
+//	                            seeds it
+//	UUIDGEN_ADMIN_KEY           API key allowed to export ID packs,
+//	                            revoke IDs, rotate signing keys and
+//	                            manage typed ID prefixes
+//	UUIDGEN_PREFIXES            "job=job,svc=service"; the typed ID
+//	                            prefixes, instead of the defaults
+//	UUIDGEN_ID_INDEX            Elasticsearch index in which to keep
+//	                            claimed, reserved, linked and revoked IDs
+//	UUIDGEN_ISSUED_INDEX        Elasticsearch index in which to keep
+//	                            the IDs issued without a record
+//	UUIDGEN_RESERVATION_INDEX   Elasticsearch index in which to keep
+//	                            reservations
+//	UUIDGEN_PACK_INDEX          Elasticsearch index in which to keep
+//	                            exported ID packs
+//	UUIDGEN_SHORT_ID_INDEX      Elasticsearch index in which to keep the
+//	                            short IDs issued
+//	UUIDGEN_COUNTER_INDEX       Elasticsearch index in which to keep
+//	                            named counters
+//	UUIDGEN_LEASE_INDEX         Elasticsearch index in which to keep
+//	                            the blocks leased from integer ranges
+//	UUIDGEN_NONCE_INDEX         Elasticsearch index in which to keep
+//	                            nonces
+func NewServiceOptionsFromEnv(sys *piazza.SystemConfig) (*ServiceOptions, error) {
+	options := &ServiceOptions{}
+
+	if path := os.Getenv("UUIDGEN_RANDOM_DEVICE"); path != "" {
+		src, err := NewFileSource(path)
+		if err != nil {
+			return nil, err
+		}
+		options.Random = src
+	}
+
+	if window := os.Getenv("UUIDGEN_IDEMPOTENCY_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return nil, err
+		}
+		options.IdempotencyWindow = d
+	}
+
+	if spec := os.Getenv("UUIDGEN_SIGNING_KEYS"); spec != "" {
+		ring, err := ParseKeyRing(spec)
+		if err != nil {
+			return nil, err
+		}
+		options.Keys = ring
+	}
+
+	if index := os.Getenv("UUIDGEN_KEY_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticKeyStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.KeyStore = store
+	}
+
+	options.AdminKey = os.Getenv("UUIDGEN_ADMIN_KEY")
+
+	if spec := os.Getenv("UUIDGEN_PREFIXES"); spec != "" {
+		registry, err := ParsePrefixRegistry(spec)
+		if err != nil {
+			return nil, err
+		}
+		options.Prefixes = registry
+	}
+
+	if index := os.Getenv("UUIDGEN_IDEMPOTENCY_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		options.IdempotencyIndex = NewDocumentIndex(esi)
+	}
+
+	if index := os.Getenv("UUIDGEN_ID_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticIdStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.Ids = store
+	}
+
+	if index := os.Getenv("UUIDGEN_ISSUED_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticIssuedStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.Issued = store
+	}
+
+	if index := os.Getenv("UUIDGEN_RESERVATION_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticReservationStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.Reservations = store
+	}
+
+	if index := os.Getenv("UUIDGEN_PACK_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticPackStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.Packs = store
+	}
+
+	if index := os.Getenv("UUIDGEN_SHORT_ID_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticShortIdStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.ShortIds = store
+	}
+
+	if index := os.Getenv("UUIDGEN_COUNTER_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticCounterStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.Counters = store
+	}
+
+	if index := os.Getenv("UUIDGEN_LEASE_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticLeaseStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.Leases = store
+	}
+
+	if index := os.Getenv("UUIDGEN_NONCE_INDEX"); index != "" {
+		esi, err := elasticsearch.NewIndexInterface(sys, index, "", false)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewElasticNonceStore(NewDocumentIndex(esi))
+		if err != nil {
+			return nil, err
+		}
+		options.Nonces = store
+	}
+
+	return options, nil
+}
+
 type Service struct {
-	sync.Mutex
-	stats     Stats
+	// counters come first, for 64-bit alignment of the atomics
+	numUUIDs      int64
+	numRequests   int64
+	numRegistered int64
+	createdOn     time.Time
+
 	syslogger *pzsyslog.Logger
 	origin    string
+	instance  string
+	maxCount  int
+	random    RandomSource
+	health    *HealthCheckedSource
+
+	ids    IdStore
+	issued IssuedStore
+
+	reservations      ReservationStore
+	reservationLock   sync.Mutex // guards reservationsSwept
+	reservationsSwept time.Time
+
+	keys       *KeyRing
+	keyStore   KeyStore
+	keysLock   sync.Mutex
+	keysLoaded time.Time
+	adminKey   string
+	packs      PackStore
+	packLock   sync.Mutex // guards packsSwept
+	packsSwept time.Time
+
+	prefixes *PrefixRegistry
+
+	shortIds  ShortIdStore
+	blocklist []string
+
+	counters  CounterStore
+	leaseLock sync.Mutex
+	leases    LeaseStore
+
+	nonces NonceStore
+
+	idempotencyLock    sync.Mutex
+	idempotencyFlights map[string]chan struct{} // keys being handled
+	idempotencyWindow  time.Duration
+	idempotency        *MemoryIdempotencyStore
+	durableIdempotency IdempotencyStore
 }
 
 //---------------------------------------------------------------------
 
 func (service *Service) Init(sys *piazza.SystemConfig, logWriter pzsyslog.Writer, auditWriter pzsyslog.Writer) error {
-	service.stats.CreatedOn = time.Now()
+	return service.InitWithOptions(sys, logWriter, auditWriter, &ServiceOptions{})
+}
+
+func (service *Service) InitWithOptions(sys *piazza.SystemConfig, logWriter pzsyslog.Writer, auditWriter pzsyslog.Writer, options *ServiceOptions) error {
+	service.createdOn = time.Now()
 
 	service.origin = string(sys.Name)
+	service.maxCount = DefaultMaxCount
 
 	service.syslogger = pzsyslog.NewLogger(logWriter, auditWriter, string(piazza.PzUuidgen))
 
+	random := options.Random
+	if random == nil {
+		random = NewCryptoSource()
+	}
+
+	// every byte is health-tested; on a failure we stop issuing IDs
+	service.health = NewHealthCheckedSource(random, func(reason string) {
+		_ = service.syslogger.Fatal("uuidgen random source failed its health tests: %s", reason)
+	})
+	service.random = service.health
+
+	service.ids = options.Ids
+	if service.ids == nil {
+		service.ids = NewMemoryIdStore()
+	}
+	service.issued = options.Issued
+	if service.issued == nil {
+		service.issued = NewMemoryIssuedStore()
+	}
+	service.reservations = options.Reservations
+	if service.reservations == nil {
+		service.reservations = NewMemoryReservationStore()
+	}
+
+	err := service.initKeys(options)
+	if err != nil {
+		return err
+	}
+	service.adminKey = options.AdminKey
+	service.packs = options.Packs
+	if service.packs == nil {
+		service.packs = NewMemoryPackStore()
+	}
+
+	service.prefixes = options.Prefixes
+	if service.prefixes == nil {
+		service.prefixes = NewDefaultPrefixRegistry()
+	}
+
+	service.shortIds = options.ShortIds
+	if service.shortIds == nil {
+		service.shortIds = NewMemoryShortIdStore()
+	}
+	service.blocklist = options.Blocklist
+	if service.blocklist == nil {
+		service.blocklist = DefaultBlocklist
+	}
+
+	service.counters = options.Counters
+	if service.counters == nil {
+		service.counters = NewMemoryCounterStore()
+	}
+	service.leases = options.Leases
+	if service.leases == nil {
+		service.leases = NewMemoryLeaseStore()
+	}
+	service.nonces = options.Nonces
+	if service.nonces == nil {
+		service.nonces = NewMemoryNonceStore()
+	}
+
+	hostname, _ := os.Hostname()
+	service.instance = service.origin + "@" + hostname
+
+	service.idempotencyWindow = options.IdempotencyWindow
+	if service.idempotencyWindow <= 0 {
+		service.idempotencyWindow = DefaultIdempotencyWindow
+	}
+	service.idempotency = NewMemoryIdempotencyStore(service.idempotencyWindow)
+	service.idempotencyFlights = map[string]chan struct{}{}
+	if options.IdempotencyIndex != nil {
+		store, err := NewElasticIdempotencyStore(options.IdempotencyIndex)
+		if err != nil {
+			return err
+		}
+		service.durableIdempotency = store
+	}
+
 	_ = service.syslogger.Info("uuidgen service started")
 
 	return nil
 }
 
+func (service *Service) newErrorResponse(statusCode int, message string) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: statusCode,
+		Message:    message,
+		Origin:     service.origin,
+	}
+}
+
 func (service *Service) GetStats() *piazza.JsonResponse {
 	//log.Printf("uuidgen stats service called (1)")
 	_ = service.syslogger.Info("uuidgen stats service called")
 
-	service.Lock()
-	data := service.stats
-	service.Unlock()
+	data := Stats{
+		NumUUIDs:      int(atomic.LoadInt64(&service.numUUIDs)),
+		NumRequests:   int(atomic.LoadInt64(&service.numRequests)),
+		NumRegistered: int(atomic.LoadInt64(&service.numRegistered)),
+		CreatedOn:     service.createdOn,
+	}
 
 	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: data}
 	err := resp.SetType()
@@ -68,10 +469,51 @@ func (service *Service) GetStats() *piazza.JsonResponse {
 	return resp
 }
 
+// GetDiagnostics reports the state of the random source's health tests.
+func (service *Service) GetDiagnostics() *piazza.JsonResponse {
+	data := service.health.Report()
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: data}
+	err := resp.SetType()
+	if err != nil {
+		return &piazza.JsonResponse{
+			StatusCode: http.StatusInternalServerError,
+			Message:    err.Error(),
+			Origin:     service.origin,
+		}
+	}
+
+	return resp
+}
+
+func (service *Service) GetCapabilities() *piazza.JsonResponse {
+	data := &Capabilities{MaxCount: service.maxCount}
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: data}
+	err := resp.SetType()
+	if err != nil {
+		return &piazza.JsonResponse{
+			StatusCode: http.StatusInternalServerError,
+			Message:    err.Error(),
+			Origin:     service.origin,
+		}
+	}
+
+	return resp
+}
+
 // PostUuids generates one or more UUIDs.
 //
 // The request body is ignored. We allow a count of zero, for testing.
 func (service *Service) PostUuids(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	return service.PostUuidsWithKey(params, "")
+}
+
+// PostUuidsWithKey is PostUuids for a request that may carry an idempotency
+// key. Within the window, a repeat of the key with the same count gets the
+// same IDs and status as the first request; with a different count it is
+// rejected with a 409, and if any of the IDs has been revoked since, with
+// a 410. Only successful requests are remembered, so a retry after a
+// failure generates afresh.
+func (service *Service) PostUuidsWithKey(params *piazza.HttpQueryParams, key string) *piazza.JsonResponse {
 	var count int
 	var err error
 
@@ -85,7 +527,7 @@ func (service *Service) PostUuids(params *piazza.HttpQueryParams) *piazza.JsonRe
 		}
 	}
 
-	if count < 0 || count > 255 {
+	if count < 0 || count > service.maxCount {
 		s := fmt.Sprintf("query argument out of range: %d", count)
 		return &piazza.JsonResponse{
 			StatusCode: http.StatusBadRequest,
@@ -94,17 +536,250 @@ func (service *Service) PostUuids(params *piazza.HttpQueryParams) *piazza.JsonRe
 		}
 	}
 
-	uuids := make([]string, count)
-	for i := 0; i < count; i++ {
-		uuids[i] = piazza.NewUuid().String()
+	if key == "" {
+		return service.generateUuids(count)
 	}
+
+	if !validIdempotencyKey(key) {
+		return &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    "invalid " + IdempotencyHeader + " header",
+			Origin:     service.origin,
+		}
+	}
+
+	// concurrent repeats of a key wait for the first, so they can't both
+	// generate; other keys go ahead
+	service.beginIdempotent(key)
+	defer service.endIdempotent(key)
+
+	record, expired, err := service.getIdempotencyRecord(key)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen idempotency store failed: %s", err.Error())
+		return &piazza.JsonResponse{
+			StatusCode: http.StatusServiceUnavailable,
+			Message:    "idempotency store failure: " + err.Error(),
+			Origin:     service.origin,
+		}
+	}
+
+	if record != nil {
+		return service.replayIdempotent(record, count)
+	}
+
+	resp := service.generateUuids(count)
+	if resp.StatusCode == http.StatusCreated {
+		record = &IdempotencyRecord{
+			Key:        key,
+			Count:      count,
+			StatusCode: resp.StatusCode,
+			Uuids:      resp.Data.([]string),
+			CreatedOn:  time.Now(),
+			Version:    1,
+		}
+		if expired != nil {
+			record.Version = expired.Version + 1
+		}
+		stored := service.putIdempotencyRecord(record, expired != nil)
+		if stored != record {
+			// another instance answered the key first; ours are never used
+			return service.replayIdempotent(stored, count)
+		}
+	}
+
+	return resp
+}
+
+// replayIdempotent answers a repeat of a key with the remembered result.
+func (service *Service) replayIdempotent(record *IdempotencyRecord, count int) *piazza.JsonResponse {
+	if record.Count != count {
+		s := fmt.Sprintf("idempotency key reused with a different count: %d, was %d", count, record.Count)
+		return &piazza.JsonResponse{
+			StatusCode: http.StatusConflict,
+			Message:    s,
+			Origin:     service.origin,
+		}
+	}
+	revoked, err := service.firstRevoked(record.Uuids)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	if revoked != "" {
+		s := fmt.Sprintf("idempotency key's uuids include one since revoked: %s", revoked)
+		return service.newErrorResponse(http.StatusGone, s)
+	}
+	return &piazza.JsonResponse{StatusCode: record.StatusCode, Type: stringListType, Data: record.Uuids}
+}
+
+func (service *Service) generateUuids(count int) *piazza.JsonResponse {
+	uuids, err := newUuids(service.random, count)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen random source failed: %s", err.Error())
+		return &piazza.JsonResponse{
+			StatusCode: http.StatusServiceUnavailable,
+			Message:    "random source failure: " + err.Error(),
+			Origin:     service.origin,
+		}
+	}
+
+	// so that they can't be claimed; with 122 random bits, a claim
+	// taking one first isn't worth a lookup
+	err = service.noteIssued(uuids)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
 	// service.syslogger.Audit("pz-uuidgen", "createUUID", "", "UUIDGen created uuids: [%s]", uuids)
-	service.Lock()
-	service.stats.NumUUIDs += count
-	service.stats.NumRequests++
-	service.Unlock()
+	atomic.AddInt64(&service.numUUIDs, int64(count))
+	atomic.AddInt64(&service.numRequests, 1)
+
+	// the type is known, so skip SetType's reflection
+	return &piazza.JsonResponse{StatusCode: http.StatusCreated, Type: stringListType, Data: uuids}
+}
+
+// beginIdempotent waits until no other request is handling key, then
+// marks it as handled by this one. The lock is held only to look at the
+// map, never while waiting or during the request's I/O.
+func (service *Service) beginIdempotent(key string) {
+	for {
+		service.idempotencyLock.Lock()
+		done, busy := service.idempotencyFlights[key]
+		if !busy {
+			service.idempotencyFlights[key] = make(chan struct{})
+			service.idempotencyLock.Unlock()
+			return
+		}
+		service.idempotencyLock.Unlock()
+		<-done
+	}
+}
+
+func (service *Service) endIdempotent(key string) {
+	service.idempotencyLock.Lock()
+	defer service.idempotencyLock.Unlock()
+
+	close(service.idempotencyFlights[key])
+	delete(service.idempotencyFlights, key)
+}
+
+// firstRevoked returns the first of uuids that has been revoked, or "".
+func (service *Service) firstRevoked(uuids []string) (string, error) {
+	known, err := service.ids.Known(uuids)
+	if err != nil {
+		return "", err
+	}
+	for _, uuid := range known {
+		record, err := service.ids.Get(uuid)
+		if err != nil {
+			return "", err
+		}
+		if record != nil && record.Revoked {
+			return uuid, nil
+		}
+	}
+	return "", nil
+}
+
+// getIdempotencyRecord looks in memory, then in the durable store, and
+// ignores records older than the window. The durable store's record, if
+// it has expired, is returned second: a new answer must replace it.
+func (service *Service) getIdempotencyRecord(key string) (*IdempotencyRecord, *IdempotencyRecord, error) {
+	fresh := func(r *IdempotencyRecord) bool {
+		return r != nil && time.Since(r.CreatedOn) <= service.idempotencyWindow
+	}
+
+	record, err := service.idempotency.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fresh(record) {
+		return record, nil, nil
+	}
+
+	if service.durableIdempotency == nil {
+		return nil, nil, nil
+	}
+
+	record, err = service.durableIdempotency.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record == nil {
+		return nil, nil, nil
+	}
+	if !fresh(record) {
+		return nil, record, nil
+	}
+	_ = service.idempotency.Put(record)
+	return record, nil, nil
+}
+
+// putIdempotencyRecord stores the record everywhere, replacing an expired
+// one if replace, and returns the record that stands: if another instance
+// stored one for the key first, that one. Failing to persist it is logged
+// but does not fail the request: the IDs have been issued, and the key
+// still works for as long as this instance remembers it.
+func (service *Service) putIdempotencyRecord(record *IdempotencyRecord, replace bool) *IdempotencyRecord {
+	if service.durableIdempotency != nil {
+		var ok bool
+		var err error
+		if replace {
+			ok, err = service.durableIdempotency.CompareAndSet(record)
+		} else {
+			ok, err = service.durableIdempotency.Create(record)
+		}
+		if err == nil && !ok {
+			var stored *IdempotencyRecord
+			stored, err = service.durableIdempotency.Get(record.Key)
+			if stored != nil {
+				record = stored
+			}
+		}
+		if err != nil {
+			_ = service.syslogger.Error("uuidgen idempotency store failed: %s", err.Error())
+		}
+	}
+
+	_ = service.idempotency.Put(record)
+	return record
+}
+
+// PostRegistrations records IDs that a client generated on its own while
+// the service was unavailable. They are claimed, with no owner; any that
+// are taken already are logged and reported as conflicts, so the client
+// can stop using them.
+func (service *Service) PostRegistrations(registration *Registration) *piazza.JsonResponse {
+	count := len(registration.Uuids)
+	if count > service.maxCount {
+		s := fmt.Sprintf("too many uuids: %d", count)
+		return &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    s,
+			Origin:     service.origin,
+		}
+	}
+	for _, uuid := range registration.Uuids {
+		if !ValidUuidV4(uuid) {
+			s := fmt.Sprintf("invalid uuid: %s", uuid)
+			return &piazza.JsonResponse{
+				StatusCode: http.StatusBadRequest,
+				Message:    s,
+				Origin:     service.origin,
+			}
+		}
+	}
+
+	result, err := service.claim(registration.Uuids, "")
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	_ = service.syslogger.Info("uuidgen registered %d locally generated uuids", len(result.Claimed))
+	for _, conflict := range result.Conflicts {
+		_ = service.syslogger.Warning("uuidgen could not register %s: %s", conflict.Uuid, conflict.Reason)
+	}
 
-	resp := &piazza.JsonResponse{StatusCode: http.StatusCreated, Data: uuids}
+	resp := &piazza.JsonResponse{StatusCode: http.StatusCreated, Data: result}
 	err = resp.SetType()
 	if err != nil {
 		return &piazza.JsonResponse{
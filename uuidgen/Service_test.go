@@ -0,0 +1,285 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// perIdUuids is the original generation path, one read and one encode per
+// ID, kept here as the benchmarks' baseline.
+func perIdUuids(src RandomSource, count int) ([]string, error) {
+	uuids := make([]string, count)
+	for i := 0; i < count; i++ {
+		uuid, err := newUuid(src)
+		if err != nil {
+			return nil, err
+		}
+		uuids[i] = uuid.String()
+	}
+	return uuids, nil
+}
+
+func newTestService(t testing.TB) *Service {
+	service := &Service{}
+	sys := &piazza.SystemConfig{Name: piazza.PzUuidgen}
+	err := service.Init(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func TestNewUuids(t *testing.T) {
+	assert := assert.New(t)
+
+	// same bytes in, same IDs out, whichever path made them
+	a, err := newUuids(NewSeededSource(3), DefaultMaxCount)
+	assert.NoError(err)
+	b, err := perIdUuids(NewSeededSource(3), DefaultMaxCount)
+	assert.NoError(err)
+	assert.Equal(b, a)
+	for _, uuid := range a {
+		assert.True(ValidUuidV4(uuid), uuid)
+	}
+
+	a, err = newUuids(NewSeededSource(3), 0)
+	assert.NoError(err)
+	assert.Len(a, 0)
+
+	// the scratch buffer goes back to the pool cleared
+	bufp := randomBuffers.Get().(*[]byte)
+	assert.Equal(make([]byte, len(*bufp)), *bufp)
+	randomBuffers.Put(bufp)
+
+	// stats stay consistent under concurrent requests
+	service := newTestService(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				req, _ := http.NewRequest("POST", "/uuids?count=5", nil)
+				resp := service.PostUuids(piazza.NewQueryParams(req))
+				assert.Equal(http.StatusCreated, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := service.GetStats().Data.(Stats)
+	assert.Equal(400, stats.NumUUIDs)
+	assert.Equal(80, stats.NumRequests)
+}
+
+func TestIssuedNeverClaimed(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+
+	// an issued ID can't be claimed
+	req, _ := http.NewRequest("POST", "/uuids?count=1", nil)
+	issued := service.PostUuids(piazza.NewQueryParams(req)).Data.([]string)[0]
+	result, err := service.claim([]string{strings.ToUpper(issued)}, "partner")
+	assert.NoError(err)
+	assert.Empty(result.Claimed)
+	assert.Equal([]ClaimConflict{{Uuid: issued, Reason: "issued"}}, result.Conflicts)
+
+	// a geo ID has few enough random bits that a claim could get there
+	// first, so one that has is replaced
+	claimed := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	result, err = service.claim([]string{claimed}, "partner")
+	assert.NoError(err)
+	assert.Equal([]string{claimed}, result.Claimed)
+	got, err := service.skipKnown([]string{claimed, issued}, func(n int) ([]string, error) {
+		assert.Equal(1, n)
+		return []string{"6ba7b811-9dad-11d1-80b4-00c04fd430c8"}, nil
+	})
+	assert.NoError(err)
+	assert.Equal([]string{issued, "6ba7b811-9dad-11d1-80b4-00c04fd430c8"}, got)
+}
+
+func TestRevocationsPersist(t *testing.T) {
+	assert := assert.New(t)
+
+	sys := &piazza.SystemConfig{Name: piazza.PzUuidgen}
+	index := NewMockDocumentIndex()
+	newService := func() *Service {
+		ids, err := NewElasticIdStore(index)
+		assert.NoError(err)
+		service := &Service{}
+		err = service.InitWithOptions(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, &ServiceOptions{Ids: ids, AdminKey: "secret"})
+		assert.NoError(err)
+		return service
+	}
+
+	uuid := "0f8fad5b-d9cb-469f-a165-70867728950e"
+	resp := newService().PostRevocation("secret", uuid, &RevocationRequest{Actor: "alice", Reason: "spill"})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// as after a restart
+	resp = newService().GetId(uuid)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(resp.Data.(*IdRecord).Revoked)
+	assert.Equal("alice", resp.Data.(*IdRecord).Revocation.Actor)
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+	req, _ := http.NewRequest("POST", "/uuids?count=3", nil)
+	params := piazza.NewQueryParams(req)
+
+	// repeats of one key all get the first answer; other keys don't wait
+	var wg sync.WaitGroup
+	results := make([][]string, 16)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "shared"
+			if i%2 == 1 {
+				key = "own-" + strconv.Itoa(i)
+			}
+			resp := service.PostUuidsWithKey(params, key)
+			assert.Equal(http.StatusCreated, resp.StatusCode)
+			results[i] = resp.Data.([]string)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 2; i < len(results); i += 2 {
+		assert.Equal(results[0], results[i])
+	}
+	assert.Equal(3*9, service.GetStats().Data.(Stats).NumUUIDs)
+	assert.Empty(service.idempotencyFlights)
+}
+
+func TestIdempotencyRevoked(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+	service.adminKey = "secret"
+	req, _ := http.NewRequest("POST", "/uuids?count=2", nil)
+	params := piazza.NewQueryParams(req)
+
+	first := service.PostUuidsWithKey(params, "job-9").Data.([]string)
+	resp := service.PostRevocation("secret", first[1], &RevocationRequest{Actor: "alice", Reason: "spill"})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// a revoked ID is never handed out again, even to a retry
+	resp = service.PostUuidsWithKey(params, "job-9")
+	assert.Equal(http.StatusGone, resp.StatusCode)
+}
+
+func TestIdempotencyShared(t *testing.T) {
+	assert := assert.New(t)
+
+	sys := &piazza.SystemConfig{Name: piazza.PzUuidgen}
+	index := NewMockDocumentIndex()
+	newService := func() *Service {
+		service := &Service{}
+		err := service.InitWithOptions(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, &ServiceOptions{IdempotencyIndex: index})
+		assert.NoError(err)
+		return service
+	}
+	a, b := newService(), newService()
+	req, _ := http.NewRequest("POST", "/uuids?count=2", nil)
+	params := piazza.NewQueryParams(req)
+
+	first := a.PostUuidsWithKey(params, "job-1")
+	assert.Equal(http.StatusCreated, first.StatusCode)
+
+	// b generated too, before a's answer was stored: a's still stands
+	late := &IdempotencyRecord{Key: "job-1", Count: 2, StatusCode: http.StatusCreated, Uuids: []string{"x", "y"}, CreatedOn: time.Now(), Version: 1}
+	stored := b.putIdempotencyRecord(late, false)
+	assert.Equal(first.Data, stored.Uuids)
+	assert.Equal(first.Data, b.PostUuidsWithKey(params, "job-1").Data)
+
+	// an expired answer is replaced
+	old := &IdempotencyRecord{Key: "job-2", Count: 2, StatusCode: http.StatusCreated, Uuids: []string{"x", "y"}, CreatedOn: time.Now().Add(-48 * time.Hour), Version: 1}
+	ok, err := a.durableIdempotency.Create(old)
+	assert.NoError(err)
+	assert.True(ok)
+	resp := b.PostUuidsWithKey(params, "job-2")
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	assert.NotEqual(old.Uuids, resp.Data)
+	assert.Equal(resp.Data, a.PostUuidsWithKey(params, "job-2").Data)
+}
+
+//---------------------------------------------------------------------
+
+func benchmarkGenerate(b *testing.B, generate func(RandomSource, int) ([]string, error), src RandomSource, count int) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := generate(src, count)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPerId1(b *testing.B) {
+	benchmarkGenerate(b, perIdUuids, NewCryptoSource(), 1)
+}
+
+func BenchmarkBatched1(b *testing.B) {
+	benchmarkGenerate(b, newUuids, NewCryptoSource(), 1)
+}
+
+func BenchmarkPerId255(b *testing.B) {
+	benchmarkGenerate(b, perIdUuids, NewCryptoSource(), DefaultMaxCount)
+}
+
+func BenchmarkBatched255(b *testing.B) {
+	benchmarkGenerate(b, newUuids, NewCryptoSource(), DefaultMaxCount)
+}
+
+// the health-checked source pays for its lock once per read, so batching
+// matters more here
+func BenchmarkPerId255Checked(b *testing.B) {
+	benchmarkGenerate(b, perIdUuids, NewHealthCheckedSource(NewCryptoSource(), nil), DefaultMaxCount)
+}
+
+func BenchmarkBatched255Checked(b *testing.B) {
+	benchmarkGenerate(b, newUuids, NewHealthCheckedSource(NewCryptoSource(), nil), DefaultMaxCount)
+}
+
+func BenchmarkServicePostUuids255(b *testing.B) {
+	service := newTestService(b)
+	req, _ := http.NewRequest("POST", "/uuids?count="+strconv.Itoa(DefaultMaxCount), nil)
+	params := piazza.NewQueryParams(req)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp := service.PostUuids(params)
+			if resp.StatusCode != http.StatusCreated {
+				b.Fatal(resp.Message)
+			}
+		}
+	})
+}
@@ -0,0 +1,468 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// Short IDs are for people: read over the phone, typed into tickets. Each
+// ends in a check character, so most transcription errors are caught, and
+// is unique within its scope, e.g. one Piazza space.
+const (
+	ShortBase32 = "base32" // e.g. "7KQM3XRAF"
+	ShortWords  = "words"  // e.g. "amber-falcon-rivet-7"
+
+	DefaultShortIdLength = 8 // base32 characters; words default to 3
+	MinShortIdLength     = 4
+	MaxShortIdLength     = 16
+	DefaultShortIdWords  = 3
+	MinShortIdWords      = 2
+	MaxShortIdWords      = 8
+
+	// candidates tried before giving up on a scope as too full
+	shortIdAttempts = 16
+)
+
+// Crockford's check symbols: the base32 alphabet, then five more for the
+// values 32 to 36.
+const crockfordCheckAlphabet = crockfordAlphabet + "*~$=U"
+
+// ErrShortIdSpaceFull is returned when no unused, acceptable short ID was
+// found; a longer ID is needed.
+var ErrShortIdSpaceFull = errors.New("no unused short id found; try a longer one")
+
+// DefaultBlocklist holds substrings that short IDs must not contain. They
+// are matched after digits are read as the letters they resemble, so
+// "5H1T" is caught too.
+var DefaultBlocklist = []string{
+	"ASS", "CNT", "COCK", "CUM", "CUNT", "DCK", "DICK", "FAG", "FCK", "FUCK",
+	"FUK", "JIZ", "KKK", "NAZI", "NGR", "NIG", "PISS", "PNS", "PORN", "SEX",
+	"SHIT", "SHT", "SLUT", "TIT", "TWAT", "WANK", "WHORE", "XXX",
+}
+
+// ShortIdRequest is the body of a POST to /short-ids.
+type ShortIdRequest struct {
+	Count  int    `json:"count"`
+	Format string `json:"format"` // ShortBase32 (the default) or ShortWords
+	Length int    `json:"length"` // characters, or words, not counting the check
+	Scope  string `json:"scope"`
+}
+
+// ShortIdStatus describes a short ID that someone has read back.
+type ShortIdStatus struct {
+	Id       string    `json:"id"`
+	Scope    string    `json:"scope"`
+	Valid    bool      `json:"valid"`
+	Issued   bool      `json:"issued"`
+	IssuedOn time.Time `json:"issuedOn,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+//---------------------------------------------------------------------
+
+// ShortIdStore records the short IDs issued in each scope.
+type ShortIdStore interface {
+	// Insert records id in scope, unless it is already there; it reports
+	// whether it was added.
+	Insert(scope string, id string, issuedOn time.Time) (bool, error)
+
+	// Get returns when id was issued in scope, and whether it was.
+	Get(scope string, id string) (time.Time, bool, error)
+}
+
+// MemoryShortIdStore is a ShortIdStore that does not survive restarts.
+type MemoryShortIdStore struct {
+	sync.Mutex
+	scopes map[string]map[string]time.Time
+}
+
+func NewMemoryShortIdStore() *MemoryShortIdStore {
+	return &MemoryShortIdStore{scopes: map[string]map[string]time.Time{}}
+}
+
+func (store *MemoryShortIdStore) Insert(scope string, id string, issuedOn time.Time) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	ids := store.scopes[scope]
+	if ids == nil {
+		ids = map[string]time.Time{}
+		store.scopes[scope] = ids
+	}
+	if _, ok := ids[id]; ok {
+		return false, nil
+	}
+	ids[id] = issuedOn
+	return true, nil
+}
+
+func (store *MemoryShortIdStore) Get(scope string, id string) (time.Time, bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	issuedOn, ok := store.scopes[scope][id]
+	return issuedOn, ok, nil
+}
+
+//---------------------------------------------------------------------
+
+const shortIdType = "shortid"
+
+// shortIdDoc is how an issued short ID is stored.
+type shortIdDoc struct {
+	Scope    string    `json:"scope"`
+	Id       string    `json:"id"`
+	IssuedOn time.Time `json:"issuedOn"`
+	Version  int64     `json:"version"`
+}
+
+// ElasticShortIdStore keeps issued short IDs in an Elasticsearch index, so
+// that they stay unique across restarts and between instances. Each is
+// created conditionally, as counters are, so two instances can't both
+// issue the same ID in a scope.
+type ElasticShortIdStore struct {
+	index DocumentIndex
+}
+
+// NewElasticShortIdStore uses index, creating it if need be.
+func NewElasticShortIdStore(index DocumentIndex) (*ElasticShortIdStore, error) {
+	err := index.Prepare(shortIdType, "")
+	if err != nil {
+		return nil, err
+	}
+	return &ElasticShortIdStore{index: index}, nil
+}
+
+// shortIdKey is the document ID: scopes are free text, so it is hashed.
+func shortIdKey(scope string, id string) string {
+	sum := sha256.Sum256([]byte(scope + "\n" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+func (store *ElasticShortIdStore) Insert(scope string, id string, issuedOn time.Time) (bool, error) {
+	doc := &shortIdDoc{Scope: scope, Id: id, IssuedOn: issuedOn, Version: 1}
+	return store.index.Put(shortIdType, shortIdKey(scope, id), doc.Version, doc, true)
+}
+
+func (store *ElasticShortIdStore) Get(scope string, id string) (time.Time, bool, error) {
+	doc := &shortIdDoc{}
+	ok, err := getDocument(store.index, shortIdType, shortIdKey(scope, id), doc)
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	return doc.IssuedOn, true, nil
+}
+
+//---------------------------------------------------------------------
+
+// checkSymbol is Crockford's check: the value of the digits mod 37. For
+// words, each word is a digit in base 256.
+func checkSymbol(digits []byte, base int) byte {
+	sum := 0
+	for _, d := range digits {
+		sum = (sum*base + int(d)) % 37
+	}
+	return crockfordCheckAlphabet[sum]
+}
+
+// newShortId makes a candidate of the given length, which is in
+// characters for base32 and in words for ShortWords.
+func newShortId(src RandomSource, format string, length int) (string, error) {
+	digits := make([]byte, length)
+	_, err := io.ReadFull(src, digits)
+	if err != nil {
+		return "", err
+	}
+
+	if format == ShortWords {
+		// 256 words, so a byte picks one without bias
+		parts := make([]string, length+1)
+		for i, d := range digits {
+			parts[i] = shortIdWords[d]
+		}
+		parts[length] = strings.ToLower(string(checkSymbol(digits, len(shortIdWords))))
+		return strings.Join(parts, "-"), nil
+	}
+
+	out := make([]byte, length+1)
+	for i := range digits {
+		digits[i] &= 0x1f
+		out[i] = crockfordAlphabet[digits[i]]
+	}
+	out[length] = checkSymbol(digits, 32)
+	return string(out), nil
+}
+
+// ParseShortId checks a short ID as a person might type it: in any case,
+// with I and L for 1 and O for 0, and with hyphens or spaces anywhere in
+// a base32 ID. It returns the ID in its issued form, or an error if it is
+// malformed or fails its check.
+func ParseShortId(s string) (string, error) {
+	if parts := strings.FieldsFunc(strings.ToLower(s), isShortIdSeparator); len(parts) > MinShortIdWords {
+		digits := make([]byte, len(parts)-1)
+		isWords := true
+		for i, part := range parts[:len(parts)-1] {
+			d, ok := shortIdWordIndex[part]
+			if !ok {
+				isWords = false
+				break
+			}
+			digits[i] = byte(d)
+		}
+		if isWords {
+			check := parts[len(parts)-1]
+			want := strings.ToLower(string(checkSymbol(digits, len(shortIdWords))))
+			if len(check) != 1 || normaliseCheck(check[0]) != normaliseCheck(want[0]) {
+				return "", fmt.Errorf("short id failed its check: %s", s)
+			}
+			parts[len(parts)-1] = want
+			return strings.Join(parts, "-"), nil
+		}
+	}
+
+	var body []byte
+	for i := 0; i < len(s); i++ {
+		if !isShortIdSeparator(rune(s[i])) {
+			body = append(body, s[i])
+		}
+	}
+	if len(body) < MinShortIdLength+1 || len(body) > MaxShortIdLength+1 {
+		return "", fmt.Errorf("invalid short id, wrong length: %s", s)
+	}
+	n := len(body) - 1
+	digits := make([]byte, n)
+	out := make([]byte, n+1)
+	for i := 0; i < n; i++ {
+		v := crockfordValues[body[i]]
+		if v == 0xff {
+			return "", fmt.Errorf("invalid short id character: %q", body[i])
+		}
+		digits[i] = v
+		out[i] = crockfordAlphabet[v]
+	}
+	out[n] = checkSymbol(digits, 32)
+	if normaliseCheck(body[n]) != out[n] {
+		return "", fmt.Errorf("short id failed its check: %s", s)
+	}
+	return string(out), nil
+}
+
+func isShortIdSeparator(r rune) bool {
+	return r == '-' || r == ' '
+}
+
+// normaliseCheck reads a check symbol as ParseShortId reads digits.
+func normaliseCheck(c byte) byte {
+	if v := crockfordValues[c]; v != 0xff {
+		return crockfordAlphabet[v]
+	}
+	if c == 'u' {
+		return 'U'
+	}
+	return c
+}
+
+// blocked reports whether id contains any of the blocklist's substrings,
+// reading digits as the letters they look like.
+func blocked(id string, blocklist []string) bool {
+	s := strings.Map(func(r rune) rune {
+		switch r {
+		case '0':
+			return 'O'
+		case '1':
+			return 'I'
+		case '3':
+			return 'E'
+		case '4':
+			return 'A'
+		case '5':
+			return 'S'
+		case '6', '9':
+			return 'G'
+		case '7':
+			return 'T'
+		case '8':
+			return 'B'
+		case 'V':
+			return 'U'
+		}
+		return r
+	}, strings.ToUpper(id))
+	for _, bad := range blocklist {
+		if strings.Contains(s, bad) {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------
+
+// PostShortIds issues short IDs, each unique within the request's scope.
+func (service *Service) PostShortIds(request *ShortIdRequest) *piazza.JsonResponse {
+	if request.Count == 0 {
+		request.Count = 1
+	}
+	if request.Count < 0 || request.Count > service.maxCount {
+		s := fmt.Sprintf("count out of range: %d", request.Count)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+
+	min, max := MinShortIdLength, MaxShortIdLength
+	switch request.Format {
+	case "", ShortBase32:
+		request.Format = ShortBase32
+		if request.Length == 0 {
+			request.Length = DefaultShortIdLength
+		}
+	case ShortWords:
+		min, max = MinShortIdWords, MaxShortIdWords
+		if request.Length == 0 {
+			request.Length = DefaultShortIdWords
+		}
+	default:
+		return service.newErrorResponse(http.StatusBadRequest, "invalid format: "+request.Format)
+	}
+	if request.Length < min || request.Length > max {
+		s := fmt.Sprintf("length out of range: %d", request.Length)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+
+	now := time.Now()
+	ids := make([]string, 0, request.Count)
+	for len(ids) < request.Count {
+		id, err := service.newUniqueShortId(request, now)
+		if err == ErrShortIdSpaceFull {
+			_ = service.syslogger.Warning("uuidgen short id scope %q is full at length %d", request.Scope, request.Length)
+			return service.newErrorResponse(http.StatusServiceUnavailable, err.Error())
+		}
+		if err != nil {
+			_ = service.syslogger.Error("uuidgen could not make short ids: %s", err.Error())
+			return service.newErrorResponse(http.StatusServiceUnavailable, err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	atomic.AddInt64(&service.numRequests, 1)
+
+	return &piazza.JsonResponse{StatusCode: http.StatusCreated, Type: stringListType, Data: ids}
+}
+
+func (service *Service) newUniqueShortId(request *ShortIdRequest, now time.Time) (string, error) {
+	for i := 0; i < shortIdAttempts; i++ {
+		id, err := newShortId(service.random, request.Format, request.Length)
+		if err != nil {
+			return "", err
+		}
+		if blocked(id, service.blocklist) {
+			continue
+		}
+		ok, err := service.shortIds.Insert(request.Scope, id, now)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return id, nil
+		}
+	}
+	return "", ErrShortIdSpaceFull
+}
+
+// GetShortId checks a short ID read back by a person, and says whether it
+// was issued in the scope.
+func (service *Service) GetShortId(id string, scope string) *piazza.JsonResponse {
+	status := &ShortIdStatus{Id: id, Scope: scope}
+	parsed, err := ParseShortId(id)
+	if err != nil {
+		status.Reason = err.Error()
+	} else {
+		status.Id = parsed
+		status.Valid = true
+		status.IssuedOn, status.Issued, err = service.shortIds.Get(scope, parsed)
+		if err != nil {
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: status}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+//---------------------------------------------------------------------
+
+// shortIdWords are easy to say and to spell, and distinct when heard.
+// There are exactly 256.
+var shortIdWords = [256]string{
+	"acorn", "agent", "alarm", "album", "amber", "anchor", "angle", "apple",
+	"apron", "arrow", "atlas", "autumn", "bacon", "badge", "badger", "baker",
+	"bamboo", "banjo", "barley", "basil", "basin", "beacon", "beaver",
+	"bench", "berry", "bison", "blanket", "blossom", "bonnet", "border",
+	"bottle", "bracket", "bread", "breeze", "brick", "bridge", "bronze",
+	"brook", "bucket", "bugle", "butter", "button", "cabin", "cactus",
+	"camel", "camera", "candle", "canoe", "canyon", "carbon", "carpet",
+	"carrot", "castle", "cedar", "cello", "chalk", "cherry", "chess", "cider",
+	"cinder", "circle", "citrus", "clover", "cobalt", "coconut", "comet",
+	"copper", "coral", "cotton", "cougar", "coyote", "crater", "crayon",
+	"cricket", "crystal", "cypress", "daisy", "delta", "desert", "diamond",
+	"dolphin", "domino", "donkey", "dragon", "drum", "eagle", "easel", "echo",
+	"elbow", "ember", "emerald", "engine", "falcon", "feather", "fern",
+	"ferry", "fiddle", "fig", "flute", "forest", "fossil", "fountain", "fox",
+	"galaxy", "garden", "garnet", "gecko", "geyser", "ginger", "glacier",
+	"globe", "goose", "granite", "grape", "gravel", "guitar", "hammer",
+	"harbor", "harvest", "hazel", "heron", "honey", "horizon", "hornet",
+	"igloo", "indigo", "island", "ivory", "jacket", "jaguar", "jasmine",
+	"jelly", "jigsaw", "jungle", "kayak", "kernel", "kettle", "kiwi", "koala",
+	"ladder", "lagoon", "lantern", "laurel", "lemon", "lentil", "lilac",
+	"linen", "lizard", "llama", "lobster", "locket", "lotus", "magnet",
+	"mango", "maple", "marble", "meadow", "melon", "meteor", "mitten",
+	"monsoon", "mosaic", "muffin", "nectar", "needle", "nickel", "nutmeg",
+	"oasis", "ocean", "olive", "onion", "opal", "orbit", "orchid", "otter",
+	"oyster", "paddle", "panda", "paper", "parrot", "peach", "pebble",
+	"pelican", "pepper", "piano", "pigeon", "pillow", "pine", "planet",
+	"plum", "polar", "pollen", "pony", "poppy", "potato", "prairie", "prism",
+	"pumpkin", "puzzle", "quail", "quartz", "quill", "rabbit", "radar",
+	"radish", "raven", "ribbon", "river", "robin", "rocket", "saddle",
+	"salmon", "sandal", "satin", "scooter", "shadow", "sierra", "silver",
+	"sketch", "sparrow", "spider", "spruce", "squash", "summit", "sunset",
+	"swan", "tablet", "tango", "teapot", "thistle", "thunder", "tiger",
+	"timber", "tomato", "topaz", "torch", "tractor", "tulip", "tundra",
+	"turtle", "valley", "velvet", "violet", "wagon", "walnut", "walrus",
+	"willow", "window", "winter", "wizard", "wombat", "yacht", "yarrow",
+	"zebra", "zephyr", "zinc",
+}
+
+var shortIdWordIndex = map[string]int{}
+
+func init() {
+	for i, word := range shortIdWords {
+		shortIdWordIndex[word] = i
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fullShortIdStore has no room left in any scope.
+type fullShortIdStore struct{}
+
+func (fullShortIdStore) Insert(string, string, time.Time) (bool, error) { return false, nil }
+func (fullShortIdStore) Get(string, string) (time.Time, bool, error)    { return time.Time{}, false, nil }
+
+func TestShortIds(t *testing.T) {
+	assert := assert.New(t)
+
+	src := NewSeededSource(45)
+	for i := 0; i < 100; i++ {
+		id, err := newShortId(src, ShortBase32, 8)
+		assert.NoError(err)
+		assert.Len(id, 9)
+		parsed, err := ParseShortId(id)
+		assert.NoError(err)
+		assert.Equal(id, parsed)
+
+		// as a person might write it down
+		spaced := strings.ToLower(id[:4] + "-" + id[4:])
+		spaced = strings.Replace(spaced, "1", "l", -1)
+		spaced = strings.Replace(spaced, "0", "o", -1)
+		parsed, err = ParseShortId(spaced)
+		assert.NoError(err, spaced)
+		assert.Equal(id, parsed)
+
+		// any one character wrong is caught
+		j := i % 8
+		c := crockfordValues[id[j]]
+		wrong := id[:j] + string(crockfordAlphabet[(c+1)%32]) + id[j+1:]
+		_, err = ParseShortId(wrong)
+		assert.Error(err, wrong)
+
+		// and so is swapping two neighbours, unless they're the same
+		if id[j] != id[j+1] {
+			swapped := id[:j] + string(id[j+1]) + string(id[j]) + id[j+2:]
+			_, err = ParseShortId(swapped)
+			assert.Error(err, swapped)
+		}
+
+		words, err := newShortId(src, ShortWords, 3)
+		assert.NoError(err)
+		parts := strings.Split(words, "-")
+		assert.Len(parts, 4)
+		parsed, err = ParseShortId(strings.ToUpper(strings.Join(parts, " ")))
+		assert.NoError(err)
+		assert.Equal(words, parsed)
+	}
+
+	_, err := ParseShortId("amber-falcon")
+	assert.Error(err)
+	_, err = ParseShortId("7KQ")
+	assert.Error(err)
+
+	assert.True(blocked("7K5H1TQ", DefaultBlocklist))
+	assert.True(blocked("FVCK", DefaultBlocklist))
+	assert.False(blocked("7KQM3XRA", DefaultBlocklist))
+	assert.False(blocked("amber-falcon-rivet-7", DefaultBlocklist))
+}
+
+func TestShortIdUniqueness(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t)
+
+	// two words: 65,536 IDs per scope, so collisions happen
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		resp := service.PostShortIds(&ShortIdRequest{Count: 255, Format: ShortWords, Length: 2, Scope: "space-1"})
+		assert.Equal(http.StatusCreated, resp.StatusCode)
+		for _, id := range resp.Data.([]string) {
+			assert.False(seen[id], id)
+			seen[id] = true
+		}
+	}
+
+	resp := service.PostShortIds(&ShortIdRequest{Scope: "space-1"})
+	id := resp.Data.([]string)[0]
+	resp = service.GetShortId(strings.ToLower(id), "space-1")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	status := resp.Data.(*ShortIdStatus)
+	assert.Equal(id, status.Id)
+	assert.True(status.Valid)
+	assert.True(status.Issued)
+
+	resp = service.GetShortId(id, "space-2")
+	assert.True(resp.Data.(*ShortIdStatus).Valid)
+	assert.False(resp.Data.(*ShortIdStatus).Issued)
+
+	resp = service.PostShortIds(&ShortIdRequest{Length: 2})
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp = service.PostShortIds(&ShortIdRequest{Format: "emoji"})
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	service.shortIds = fullShortIdStore{}
+	resp = service.PostShortIds(&ShortIdRequest{})
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestShortIdStores(t *testing.T) {
+	assert := assert.New(t)
+
+	elastic, err := NewElasticShortIdStore(NewMockDocumentIndex())
+	assert.NoError(err)
+
+	now := time.Now().UTC().Round(time.Second)
+	for _, store := range []ShortIdStore{NewMemoryShortIdStore(), elastic} {
+		ok, err := store.Insert("space-1", "7KQM3XRAF", now)
+		assert.NoError(err)
+		assert.True(ok)
+
+		// the same ID can't be issued twice in a scope, but can in another
+		ok, err = store.Insert("space-1", "7KQM3XRAF", now.Add(time.Hour))
+		assert.NoError(err)
+		assert.False(ok)
+		ok, err = store.Insert("space-2", "7KQM3XRAF", now)
+		assert.NoError(err)
+		assert.True(ok)
+
+		issuedOn, ok, err := store.Get("space-1", "7KQM3XRAF")
+		assert.NoError(err)
+		assert.True(ok)
+		assert.True(now.Equal(issuedOn))
+		_, ok, err = store.Get("space-3", "7KQM3XRAF")
+		assert.NoError(err)
+		assert.False(ok)
+	}
+}
@@ -0,0 +1,473 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// There are two ways to sign an ID, so that anyone holding the keys can
+// check that this service minted it:
+//
+// SignEmbedded makes a version 8 UUID that carries its own signature:
+//
+//	bytes 0-10  random, but for the version nibble and the variant bits
+//	bytes 11-15 the first 40 bits of HMAC-SHA256(key, "pz-uuidgen-id-v2" + bytes 0-10)
+//
+// That leaves 82 random bits, so that, like v4 IDs, they are unique
+// without the service remembering them: the chance of any repeat in a
+// billion IDs is about 1 in 10 million. A forger, without the key, guesses
+// a tag right once in 2^40 tries. There is no room to say which key
+// signed the ID, so verifying tries each key in the ring.
+//
+// SignToken issues an ordinary random ID with a companion token,
+// "v1.KEYID.TAG", where TAG is the first 128 bits of
+// HMAC-SHA256(key, "pz-uuidgen-token-v1\n" + ID), base64url-encoded.
+const (
+	SignEmbedded = "embedded"
+	SignToken    = "token"
+)
+
+const (
+	embeddedTagBytes = 5
+	tokenTagBytes    = 16
+)
+
+var errBadSignature = errors.New("invalid signature")
+
+// SignedUuid is a signed ID, with its token if it has one.
+type SignedUuid struct {
+	Uuid  string `json:"uuid"`
+	Token string `json:"token,omitempty"`
+}
+
+// Verification is the result of checking a signed ID.
+type Verification struct {
+	Uuid   string `json:"uuid"`
+	Valid  bool   `json:"valid"`
+	Mode   string `json:"mode,omitempty"`
+	KeyId  string `json:"keyId,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+//---------------------------------------------------------------------
+
+func embeddedMessage(uuid []byte) []byte {
+	return append([]byte("pz-uuidgen-id-v2"), uuid[:16-embeddedTagBytes]...)
+}
+
+func tokenMessage(uuid string) []byte {
+	return []byte("pz-uuidgen-token-v1\n" + uuid)
+}
+
+// parseUuid decodes the canonical form.
+func parseUuid(s string) ([]byte, bool) {
+	if !ValidUuid(s) {
+		return nil, false
+	}
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// newEmbeddedUuid makes one version 8 ID signed with the ring's current key.
+func newEmbeddedUuid(src RandomSource, ring *KeyRing) (string, error) {
+	uuid := make([]byte, 16)
+	_, err := io.ReadFull(src, uuid[:16-embeddedTagBytes])
+	if err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x80 // Version 8
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // Variant is 10
+
+	_, tag, err := ring.Sign(embeddedMessage(uuid))
+	if err != nil {
+		return "", err
+	}
+	copy(uuid[16-embeddedTagBytes:], tag[:embeddedTagBytes])
+
+	out := make([]byte, 36)
+	encodeUuid(out, uuid)
+	return string(out), nil
+}
+
+// newTokenUuids makes count random IDs, each with a token.
+func newTokenUuids(src RandomSource, ring *KeyRing, count int) ([]SignedUuid, error) {
+	uuids, err := newUuids(src, count)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]SignedUuid, count)
+	for i, uuid := range uuids {
+		token, err := signToken(ring, uuid)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = SignedUuid{Uuid: uuid, Token: token}
+	}
+	return out, nil
+}
+
+func signToken(ring *KeyRing, uuid string) (string, error) {
+	keyId, tag, err := ring.Sign(tokenMessage(uuid))
+	if err != nil {
+		return "", err
+	}
+	return "v1." + keyId + "." + base64.RawURLEncoding.EncodeToString(tag[:tokenTagBytes]), nil
+}
+
+//---------------------------------------------------------------------
+
+// VerifyUuid checks an ID that carries its own signature, and returns the
+// ID of the key that signed it. The ID may be in upper case.
+func VerifyUuid(ring *KeyRing, uuid string) (string, error) {
+	b, ok := parseUuid(strings.ToLower(uuid))
+	if !ok {
+		return "", errors.New("invalid uuid")
+	}
+	if b[6]>>4 != 8 || b[8]>>6 != 2 {
+		return "", errors.New("not a signed uuid")
+	}
+
+	message := embeddedMessage(b)
+	tag := b[16-embeddedTagBytes:]
+	for _, keyId := range ring.Ids() {
+		if ring.Verify(keyId, message, tag, embeddedTagBytes) == nil {
+			return keyId, nil
+		}
+	}
+	return "", errBadSignature
+}
+
+// VerifyUuidToken checks an ID against its companion token, and returns the
+// ID of the key that signed it. The ID may be in upper case; the token is
+// for its lower-case form.
+func VerifyUuidToken(ring *KeyRing, uuid string, token string) (string, error) {
+	uuid = strings.ToLower(uuid)
+	if !ValidUuid(uuid) {
+		return "", errors.New("invalid uuid")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != "v1" {
+		return "", errors.New("invalid token")
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(tag) != tokenTagBytes {
+		return "", errors.New("invalid token")
+	}
+	err = ring.Verify(parts[1], tokenMessage(uuid), tag, tokenTagBytes)
+	if err != nil {
+		return "", err
+	}
+	return parts[1], nil
+}
+
+// Verify checks a signed ID, with its token if it has one.
+func Verify(ring *KeyRing, uuid string, token string) *Verification {
+	result := &Verification{Uuid: uuid, Mode: SignEmbedded}
+	var err error
+	if token != "" {
+		result.Mode = SignToken
+		result.KeyId, err = VerifyUuidToken(ring, uuid, token)
+	} else {
+		result.KeyId, err = VerifyUuid(ring, uuid)
+	}
+	if err != nil {
+		result.Reason = err.Error()
+		result.KeyId = ""
+		return result
+	}
+	result.Valid = true
+	return result
+}
+
+//---------------------------------------------------------------------
+
+// KeyList describes the signing keys, without the keys themselves.
+type KeyList struct {
+	Current string   `json:"current"`
+	Ids     []string `json:"ids"`
+}
+
+// NewKey is the body of a key rotation.
+type NewKey struct {
+	Id  string `json:"id"`
+	Key string `json:"key"` // base64
+}
+
+func (service *Service) randomUuids(count int) ([]string, error) {
+	return newUuids(service.random, count)
+}
+
+func (service *Service) embeddedUuids(count int) ([]string, error) {
+	uuids := make([]string, count)
+	for i := range uuids {
+		uuid, err := newEmbeddedUuid(service.random, service.keys)
+		if err != nil {
+			return nil, err
+		}
+		uuids[i] = uuid
+	}
+	return uuids, nil
+}
+
+// PostSignedUuids generates signed IDs.
+//
+//	?count=INT    as for PostUuids
+//	?mode=STRING  "embedded" (the default) or "token"
+func (service *Service) PostSignedUuids(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	count, err := params.GetCount(1)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if count < 0 || count > service.maxCount {
+		s := fmt.Sprintf("query argument out of range: %d", count)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+	mode, err := params.GetAsString("mode", SignEmbedded)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	service.refreshKeys()
+
+	var generate func(int) ([]string, error)
+	switch mode {
+	case SignEmbedded:
+		generate = service.embeddedUuids
+	case SignToken:
+		generate = service.randomUuids
+	default:
+		return service.newErrorResponse(http.StatusBadRequest, "invalid mode: "+mode)
+	}
+
+	uuids, err := generate(count)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen could not make signed uuids: %s", err.Error())
+		return service.newErrorResponse(http.StatusServiceUnavailable, err.Error())
+	}
+	err = service.noteIssued(uuids)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	out := make([]SignedUuid, len(uuids))
+	for i, uuid := range uuids {
+		out[i].Uuid = uuid
+		if mode == SignToken {
+			out[i].Token, err = signToken(service.keys, uuid)
+			if err != nil {
+				return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+			}
+		}
+	}
+
+	atomic.AddInt64(&service.numUUIDs, int64(count))
+	atomic.AddInt64(&service.numRequests, 1)
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusCreated, Data: out}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// PostVerify checks a signed ID. An ID that fails is not an error: the
+// result says why.
+func (service *Service) PostVerify(signed *SignedUuid) *piazza.JsonResponse {
+	service.refreshKeys()
+	result := Verify(service.keys, signed.Uuid, signed.Token)
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: result}
+	err := resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+func (service *Service) GetKeys() *piazza.JsonResponse {
+	service.refreshKeys()
+	data := &KeyList{Current: service.keys.CurrentId(), Ids: service.keys.Ids()}
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: data}
+	err := resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// PostKeys rotates: the new key is added and becomes current. Older keys
+// still verify until they are deleted. apiKey must be the admin key.
+func (service *Service) PostKeys(apiKey string, newKey *NewKey) *piazza.JsonResponse {
+	if resp := service.checkAdmin(apiKey); resp != nil {
+		return resp
+	}
+	key, err := base64.StdEncoding.DecodeString(newKey.Key)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, "invalid key: "+err.Error())
+	}
+
+	status := http.StatusInternalServerError
+	err = service.changeKeys(func(ring *KeyRing) error {
+		if ring.Has(newKey.Id) {
+			status = http.StatusConflict
+			return errors.New("key already exists: " + newKey.Id)
+		}
+		err := ring.Add(newKey.Id, key)
+		if err == nil {
+			err = ring.SetCurrent(newKey.Id)
+		}
+		if err != nil {
+			status = http.StatusBadRequest
+		}
+		return err
+	})
+	if err != nil {
+		return service.newErrorResponse(status, err.Error())
+	}
+
+	_ = service.syslogger.Audit("admin", "rotateKey", newKey.Id, "uuidgen signing key is now %s", newKey.Id)
+
+	return service.GetKeys()
+}
+
+// DeleteKey retires a key: what it signed no longer verifies. apiKey must
+// be the admin key.
+func (service *Service) DeleteKey(apiKey string, id string) *piazza.JsonResponse {
+	if resp := service.checkAdmin(apiKey); resp != nil {
+		return resp
+	}
+	status := http.StatusInternalServerError
+	err := service.changeKeys(func(ring *KeyRing) error {
+		if !ring.Has(id) {
+			status = http.StatusNotFound
+			return errors.New("key not found: " + id)
+		}
+		err := ring.Remove(id)
+		if err != nil {
+			status = http.StatusConflict
+		}
+		return err
+	})
+	if err != nil {
+		return service.newErrorResponse(status, err.Error())
+	}
+
+	_ = service.syslogger.Audit("admin", "retireKey", id, "uuidgen retired signing key %s", id)
+
+	return service.GetKeys()
+}
+
+//---------------------------------------------------------------------
+
+// keyRefresh is how often the keys are reloaded from the KeyStore, so that
+// changes made through another instance are seen.
+const keyRefresh = time.Minute
+
+// initKeys sets up the ring from the options. With a KeyStore, the stored
+// keys win; the configured ones, or a random one, only fill an empty
+// store.
+func (service *Service) initKeys(options *ServiceOptions) error {
+	seed := options.Keys
+	if seed == nil {
+		key := make([]byte, 32)
+		_, err := io.ReadFull(NewCryptoSource(), key)
+		if err != nil {
+			return err
+		}
+		seed = NewKeyRing()
+		err = seed.Add("ephemeral", key)
+		if err != nil {
+			return err
+		}
+	}
+
+	service.keyStore = options.KeyStore
+	if service.keyStore == nil {
+		if options.Keys == nil {
+			_ = service.syslogger.Warning("uuidgen has no signing keys configured; using a temporary one")
+		}
+		service.keys = seed
+		return nil
+	}
+
+	ring, err := service.keyStore.Update(func(ring *KeyRing) error {
+		if ring.Len() == 0 {
+			ring.Replace(seed)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	service.keys = ring
+	service.keysLoaded = time.Now()
+	return nil
+}
+
+// refreshKeys reloads the keys from the KeyStore, if there is one and
+// they are older than keyRefresh. If the store can't be read, the keys
+// already loaded are kept.
+func (service *Service) refreshKeys() {
+	if service.keyStore == nil {
+		return
+	}
+
+	service.keysLock.Lock()
+	defer service.keysLock.Unlock()
+
+	if time.Since(service.keysLoaded) < keyRefresh {
+		return
+	}
+	ring, err := service.keyStore.Get()
+	if err != nil {
+		_ = service.syslogger.Warning("uuidgen could not reload its signing keys: %s", err.Error())
+		return
+	}
+	if ring != nil && ring.Len() > 0 {
+		service.keys.Replace(ring)
+	}
+	service.keysLoaded = time.Now()
+}
+
+// changeKeys applies fn to the keys, through the KeyStore if there is one.
+func (service *Service) changeKeys(fn func(*KeyRing) error) error {
+	if service.keyStore == nil {
+		return fn(service.keys)
+	}
+
+	service.keysLock.Lock()
+	defer service.keysLock.Unlock()
+
+	ring, err := service.keyStore.Update(fn)
+	if err != nil {
+		return err
+	}
+	service.keys.Replace(ring)
+	service.keysLoaded = time.Now()
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestSignedUuids(t *testing.T) {
+	assert := assert.New(t)
+
+	ring := NewKeyRing()
+	assert.NoError(ring.Add("2016a", []byte("first key, 16+ bytes")))
+	assert.Error(ring.Add("short", []byte("tiny")))
+	assert.Error(ring.Add("a.b", []byte("dots are separators")))
+
+	src := NewSeededSource(1)
+
+	uuid, err := newEmbeddedUuid(src, ring)
+	assert.NoError(err)
+	assert.True(ValidUuid(uuid))
+	assert.False(ValidUuidV4(uuid))
+	assert.Equal(byte('8'), uuid[14])
+
+	keyId, err := VerifyUuid(ring, uuid)
+	assert.NoError(err)
+	assert.Equal("2016a", keyId)
+
+	// flip one bit of the random part, at either end
+	for _, i := range []int{0, 10} {
+		b, _ := parseUuid(uuid)
+		b[i] ^= 1
+		forged := make([]byte, 36)
+		encodeUuid(forged, b)
+		_, err = VerifyUuid(ring, string(forged))
+		assert.Error(err)
+	}
+
+	// all 82 random bits vary
+	var ones, zeros [16]byte
+	for i := range zeros {
+		zeros[i] = 0xff
+	}
+	for i := 0; i < 64; i++ {
+		uuid, err := newEmbeddedUuid(src, ring)
+		assert.NoError(err)
+		b, _ := parseUuid(uuid)
+		for j := range b {
+			ones[j] |= b[j]
+			zeros[j] &= b[j]
+		}
+	}
+	random := 0
+	for j := 0; j < 16-embeddedTagBytes; j++ {
+		for bit := uint(0); bit < 8; bit++ {
+			if (ones[j]>>bit)&1 == 1 && (zeros[j]>>bit)&1 == 0 {
+				random++
+			}
+		}
+	}
+	assert.Equal(82, random)
+
+	// plain IDs aren't signed
+	plain, err := newUuids(src, 1)
+	assert.NoError(err)
+	_, err = VerifyUuid(ring, plain[0])
+	assert.Error(err)
+
+	token, err := signToken(ring, plain[0])
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(token, "v1.2016a."))
+	result := Verify(ring, plain[0], token)
+	assert.True(result.Valid)
+	assert.Equal(SignToken, result.Mode)
+	result = Verify(ring, uuid, token)
+	assert.False(result.Valid)
+
+	// upper case verifies too
+	keyId, err = VerifyUuid(ring, strings.ToUpper(uuid))
+	assert.NoError(err)
+	assert.Equal("2016a", keyId)
+	keyId, err = VerifyUuidToken(ring, strings.ToUpper(plain[0]), token)
+	assert.NoError(err)
+	assert.Equal("2016a", keyId)
+
+	// rotate: old signatures still verify, new ones use the new key
+	assert.NoError(ring.Add("2017a", []byte("second key, 16+ bytes")))
+	assert.NoError(ring.SetCurrent("2017a"))
+
+	keyId, err = VerifyUuid(ring, uuid)
+	assert.NoError(err)
+	assert.Equal("2016a", keyId)
+
+	uuid2, err := newEmbeddedUuid(src, ring)
+	assert.NoError(err)
+	keyId, err = VerifyUuid(ring, uuid2)
+	assert.NoError(err)
+	assert.Equal("2017a", keyId)
+
+	// retire the old key
+	assert.Error(ring.Remove("2017a"))
+	assert.NoError(ring.Remove("2016a"))
+	_, err = VerifyUuid(ring, uuid)
+	assert.Error(err)
+	assert.False(Verify(ring, plain[0], token).Valid)
+}
+
+func TestKeyStores(t *testing.T) {
+	assert := assert.New(t)
+
+	elastic, err := NewElasticKeyStore(NewMockDocumentIndex())
+	assert.NoError(err)
+
+	for _, store := range []KeyStore{NewMemoryKeyStore(), elastic} {
+		ring, err := store.Get()
+		assert.NoError(err)
+		assert.Nil(ring)
+
+		ring, err = store.Update(func(ring *KeyRing) error {
+			return ring.Add("2016a", []byte("first key, 16+ bytes"))
+		})
+		assert.NoError(err)
+		assert.Equal("2016a", ring.CurrentId())
+
+		_, err = store.Update(func(ring *KeyRing) error {
+			err := ring.Add("2017a", []byte("second key, 16+ bytes"))
+			if err == nil {
+				err = ring.SetCurrent("2017a")
+			}
+			return err
+		})
+		assert.NoError(err)
+
+		// a failed change stores nothing
+		_, err = store.Update(func(ring *KeyRing) error {
+			return ring.Remove("2017a")
+		})
+		assert.Error(err)
+
+		ring, err = store.Get()
+		assert.NoError(err)
+		assert.Equal([]string{"2016a", "2017a"}, ring.Ids())
+		assert.Equal("2017a", ring.CurrentId())
+	}
+}
+
+func TestKeysShared(t *testing.T) {
+	assert := assert.New(t)
+
+	sys := &piazza.SystemConfig{Name: piazza.PzUuidgen}
+	store, err := NewElasticKeyStore(NewMockDocumentIndex())
+	assert.NoError(err)
+	newService := func(seed string) *Service {
+		ring, err := ParseKeyRing(seed + ":" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123")))
+		assert.NoError(err)
+		service := &Service{}
+		options := &ServiceOptions{Keys: ring, KeyStore: store, AdminKey: "secret"}
+		err = service.InitWithOptions(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, options)
+		assert.NoError(err)
+		return service
+	}
+
+	// the first instance seeds the store; the next one uses what is stored
+	a := newService("k1")
+	b := newService("other")
+	assert.Equal([]string{"k1"}, b.keys.Ids())
+
+	newKey := &NewKey{Id: "k2", Key: base64.StdEncoding.EncodeToString([]byte("another key of 16+ bytes"))}
+	resp := a.PostKeys("secret", newKey)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp = b.PostKeys("secret", newKey)
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+
+	// b sees the rotation once its copy is stale, or after a restart
+	b.keysLoaded = time.Now().Add(-keyRefresh)
+	assert.Equal("k2", b.GetKeys().Data.(*KeyList).Current)
+	assert.Equal("k2", newService("k3").keys.CurrentId())
+
+	resp = b.DeleteKey("secret", "k1")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp = a.DeleteKey("secret", "k1")
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,335 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// A typed ID is a prefix naming the kind of resource, an underscore, and
+// the 128 bits of a v4 UUID in Crockford base32, e.g.
+// "job_2ZP3WMSQFA8XN0G5J8YV7RTK1C". The UUID is noted in the IssuedStore
+// like any other issued ID, so it can't be claimed.
+const (
+	typedIdSeparator = '_'
+	typedIdBodyLen   = 26 // crockfordLen(16)
+	maxPrefixLen     = 16
+)
+
+// TypePrefix maps a prefix to the kind of Piazza resource it names.
+type TypePrefix struct {
+	Prefix string `json:"prefix"`
+	Kind   string `json:"kind"`
+}
+
+// DefaultPrefixes are the Piazza entity kinds.
+var DefaultPrefixes = []TypePrefix{
+	{Prefix: "job", Kind: "job"},
+	{Prefix: "data", Kind: "data"},
+	{Prefix: "svc", Kind: "service"},
+	{Prefix: "trig", Kind: "trigger"},
+	{Prefix: "evt", Kind: "event"},
+	{Prefix: "evtype", Kind: "eventtype"},
+	{Prefix: "alert", Kind: "alert"},
+	{Prefix: "deploy", Kind: "deployment"},
+}
+
+// TypedId is a parsed typed ID.
+type TypedId struct {
+	Id     string `json:"id"`
+	Prefix string `json:"prefix"`
+	Kind   string `json:"kind,omitempty"`
+	Uuid   string `json:"uuid"`
+}
+
+//---------------------------------------------------------------------
+
+// PrefixRegistry holds the prefixes typed IDs may be issued with. It can
+// be changed while the service runs.
+type PrefixRegistry struct {
+	sync.RWMutex
+	kinds map[string]string
+}
+
+func NewPrefixRegistry() *PrefixRegistry {
+	return &PrefixRegistry{kinds: map[string]string{}}
+}
+
+// NewDefaultPrefixRegistry returns a registry holding DefaultPrefixes.
+func NewDefaultPrefixRegistry() *PrefixRegistry {
+	registry := NewPrefixRegistry()
+	for _, p := range DefaultPrefixes {
+		registry.kinds[p.Prefix] = p.Kind
+	}
+	return registry
+}
+
+// ParsePrefixRegistry reads prefixes in the form "job=job,svc=service".
+func ParsePrefixRegistry(spec string) (*PrefixRegistry, error) {
+	registry := NewPrefixRegistry()
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid prefix: %q", item)
+		}
+		err := registry.Add(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// validPrefix: a lowercase letter, then up to 15 lowercase letters or
+// digits.
+func validPrefix(prefix string) bool {
+	if len(prefix) == 0 || len(prefix) > maxPrefixLen {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		c := prefix[i]
+		if !(c >= 'a' && c <= 'z') && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Add registers a prefix, or changes the kind of an existing one.
+func (registry *PrefixRegistry) Add(prefix string, kind string) error {
+	if !validPrefix(prefix) {
+		return fmt.Errorf("invalid prefix: %q", prefix)
+	}
+	if kind == "" {
+		return fmt.Errorf("prefix %s has no kind", prefix)
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.kinds[prefix] = kind
+	return nil
+}
+
+// Remove drops a prefix. IDs already issued with it still parse with
+// ParseTypedId, but not with the registry's Parse.
+func (registry *PrefixRegistry) Remove(prefix string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	delete(registry.kinds, prefix)
+}
+
+// Kind returns the kind of resource a prefix names.
+func (registry *PrefixRegistry) Kind(prefix string) (string, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	kind, ok := registry.kinds[prefix]
+	return kind, ok
+}
+
+// List returns the registered prefixes, in order.
+func (registry *PrefixRegistry) List() []TypePrefix {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	list := make([]TypePrefix, 0, len(registry.kinds))
+	for prefix, kind := range registry.kinds {
+		list = append(list, TypePrefix{Prefix: prefix, Kind: kind})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Prefix < list[j].Prefix })
+	return list
+}
+
+// Parse is ParseTypedId, but also rejects unregistered prefixes, and fills
+// in the kind.
+func (registry *PrefixRegistry) Parse(s string) (*TypedId, error) {
+	typed, err := ParseTypedId(s)
+	if err != nil {
+		return nil, err
+	}
+	kind, ok := registry.Kind(typed.Prefix)
+	if !ok {
+		return nil, fmt.Errorf("unknown prefix: %s", typed.Prefix)
+	}
+	typed.Kind = kind
+	return typed, nil
+}
+
+//---------------------------------------------------------------------
+
+// NewTypedId makes a typed ID from a prefix and a canonical UUID.
+func NewTypedId(prefix string, uuid string) (string, error) {
+	if !validPrefix(prefix) {
+		return "", fmt.Errorf("invalid prefix: %q", prefix)
+	}
+	b, ok := parseUuid(uuid)
+	if !ok {
+		return "", fmt.Errorf("invalid uuid: %s", uuid)
+	}
+	out := make([]byte, len(prefix)+1+typedIdBodyLen)
+	copy(out, prefix)
+	out[len(prefix)] = typedIdSeparator
+	encodeCrockford(out[len(prefix)+1:], b)
+	return string(out), nil
+}
+
+// ParseTypedId splits a typed ID into its prefix and the UUID it carries.
+// It needs no registry, so the kind is left empty. The body is read
+// case-insensitively, as Crockford base32 allows.
+func ParseTypedId(s string) (*TypedId, error) {
+	i := strings.IndexByte(s, typedIdSeparator)
+	if i < 0 {
+		return nil, fmt.Errorf("invalid typed id, no prefix: %s", s)
+	}
+	prefix, body := s[:i], s[i+1:]
+	if !validPrefix(prefix) {
+		return nil, fmt.Errorf("invalid typed id prefix: %q", prefix)
+	}
+	if len(body) != typedIdBodyLen {
+		return nil, fmt.Errorf("invalid typed id, wrong length: %s", s)
+	}
+	b, err := decodeCrockford(body, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid typed id %s: %s", s, err.Error())
+	}
+	uuid := make([]byte, 36)
+	encodeUuid(uuid, b)
+
+	// normalise, so equal IDs compare equal
+	id := make([]byte, len(s))
+	copy(id, prefix)
+	id[i] = typedIdSeparator
+	encodeCrockford(id[i+1:], b)
+
+	return &TypedId{Id: string(id), Prefix: prefix, Uuid: string(uuid)}, nil
+}
+
+//---------------------------------------------------------------------
+
+// PostTypedUuids generates typed IDs.
+//
+//	?count=INT      as for PostUuids
+//	?prefix=STRING  a registered prefix
+func (service *Service) PostTypedUuids(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	count, err := params.GetCount(1)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	if count < 0 || count > service.maxCount {
+		s := fmt.Sprintf("query argument out of range: %d", count)
+		return service.newErrorResponse(http.StatusBadRequest, s)
+	}
+	prefix, err := params.GetAsString("prefix", "")
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	kind, ok := service.prefixes.Kind(prefix)
+	if !ok {
+		return service.newErrorResponse(http.StatusBadRequest, "unknown prefix: "+prefix)
+	}
+
+	uuids, err := service.randomUuids(count)
+	if err != nil {
+		_ = service.syslogger.Error("uuidgen could not make typed uuids: %s", err.Error())
+		return service.newErrorResponse(http.StatusServiceUnavailable, err.Error())
+	}
+	err = service.noteIssued(uuids)
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	out := make([]TypedId, len(uuids))
+	for i, uuid := range uuids {
+		id, err := NewTypedId(prefix, uuid)
+		if err != nil {
+			return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		out[i] = TypedId{Id: id, Prefix: prefix, Kind: kind, Uuid: uuid}
+	}
+
+	atomic.AddInt64(&service.numUUIDs, int64(count))
+	atomic.AddInt64(&service.numRequests, 1)
+
+	resp := &piazza.JsonResponse{StatusCode: http.StatusCreated, Data: out}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// GetTypedUuid parses a typed ID against the registry.
+func (service *Service) GetTypedUuid(id string) *piazza.JsonResponse {
+	typed, err := service.prefixes.Parse(id)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: typed}
+	err = resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+func (service *Service) GetPrefixes() *piazza.JsonResponse {
+	resp := &piazza.JsonResponse{StatusCode: http.StatusOK, Data: service.prefixes.List()}
+	err := resp.SetType()
+	if err != nil {
+		return service.newErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return resp
+}
+
+// PostPrefixes registers a prefix, or changes its kind. apiKey must be the
+// admin key.
+func (service *Service) PostPrefixes(apiKey string, prefix *TypePrefix) *piazza.JsonResponse {
+	if resp := service.checkAdmin(apiKey); resp != nil {
+		return resp
+	}
+	err := service.prefixes.Add(prefix.Prefix, prefix.Kind)
+	if err != nil {
+		return service.newErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	_ = service.syslogger.Audit("admin", "addPrefix", prefix.Prefix, "uuidgen prefix %s now names %s", prefix.Prefix, prefix.Kind)
+
+	return service.GetPrefixes()
+}
+
+// DeletePrefix stops new IDs being issued with a prefix. apiKey must be
+// the admin key.
+func (service *Service) DeletePrefix(apiKey string, prefix string) *piazza.JsonResponse {
+	if resp := service.checkAdmin(apiKey); resp != nil {
+		return resp
+	}
+	if _, ok := service.prefixes.Kind(prefix); !ok {
+		return service.newErrorResponse(http.StatusNotFound, "prefix not found: "+prefix)
+	}
+	service.prefixes.Remove(prefix)
+
+	_ = service.syslogger.Audit("admin", "removePrefix", prefix, "uuidgen removed prefix %s", prefix)
+
+	return service.GetPrefixes()
+}
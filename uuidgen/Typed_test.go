@@ -0,0 +1,101 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrockford(t *testing.T) {
+	assert := assert.New(t)
+
+	b := []byte{0x01, 0x8f, 0xff, 0x00, 0x7a}
+	s := make([]byte, crockfordLen(len(b)))
+	encodeCrockford(s, b)
+	assert.Equal("067ZY03T", string(s))
+
+	out, err := decodeCrockford(string(s), len(b))
+	assert.NoError(err)
+	assert.Equal(b, out)
+
+	// lowercase, and the look-alikes
+	out, err = decodeCrockford("o67zyo3t", len(b))
+	assert.NoError(err)
+	assert.Equal(b, out)
+	out, err = decodeCrockford("I", 1)
+	assert.NoError(err)
+	assert.Equal([]byte{1}, out)
+
+	_, err = decodeCrockford("U", 1)
+	assert.Error(err)
+	_, err = decodeCrockford("ZZ", 1)
+	assert.Error(err)
+}
+
+func TestTypedIds(t *testing.T) {
+	assert := assert.New(t)
+
+	uuid := "0190a6c2-3b1e-4f7a-9c2d-5e6f7a8b9c0d"
+	id, err := NewTypedId("job", uuid)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(id, "job_"))
+	assert.Len(id, 4+typedIdBodyLen)
+
+	typed, err := ParseTypedId(id)
+	assert.NoError(err)
+	assert.Equal("job", typed.Prefix)
+	assert.Equal("", typed.Kind)
+	assert.Equal(uuid, typed.Uuid)
+	assert.Equal(id, typed.Id)
+
+	// case doesn't matter, and the ID comes back normalised
+	typed, err = ParseTypedId("job_" + strings.ToLower(id[4:]))
+	assert.NoError(err)
+	assert.Equal(id, typed.Id)
+
+	for _, bad := range []string{"", "job", uuid, "Job_" + id[4:], "job_" + id[5:], "job_U" + id[5:], "job_8" + id[5:]} {
+		_, err = ParseTypedId(bad)
+		assert.Error(err, bad)
+	}
+	_, err = NewTypedId("has_underscore", uuid)
+	assert.Error(err)
+
+	registry := NewDefaultPrefixRegistry()
+	typed, err = registry.Parse(id)
+	assert.NoError(err)
+	assert.Equal("job", typed.Kind)
+
+	svc, _ := NewTypedId("svc", uuid)
+	typed, err = registry.Parse(svc)
+	assert.NoError(err)
+	assert.Equal("service", typed.Kind)
+
+	registry.Remove("svc")
+	_, err = registry.Parse(svc)
+	assert.Error(err)
+	_, err = ParseTypedId(svc)
+	assert.NoError(err)
+
+	registry, err = ParsePrefixRegistry("job=job, ds=dataset")
+	assert.NoError(err)
+	assert.Equal([]TypePrefix{{Prefix: "ds", Kind: "dataset"}, {Prefix: "job", Kind: "job"}}, registry.List())
+	_, err = ParsePrefixRegistry("job")
+	assert.Error(err)
+	_, err = ParsePrefixRegistry("9lives=cat")
+	assert.Error(err)
+}
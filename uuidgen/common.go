@@ -15,6 +15,7 @@
 package uuidgen
 
 import (
+	"context"
 	"time"
 
 	"github.com/venicegeo/pz-gocommon/gocommon"
@@ -28,12 +29,81 @@ type IClient interface {
 	PostUuids(count int) (*[]string, error)
 	GetStats() (*Stats, error)
 	GetVersion() (*piazza.Version, error)
+
+	// as above, but bounded by the given context
+	GetUUIDContext(ctx context.Context) (string, error)
+	PostUuidsContext(ctx context.Context, count int) (*[]string, error)
+	GetStatsContext(ctx context.Context) (*Stats, error)
+	GetVersionContext(ctx context.Context) (*piazza.Version, error)
+}
+
+// ICounterClient is the named counters part of the API, which both
+// Client and MockClient implement.
+type ICounterClient interface {
+	CreateCounterContext(ctx context.Context, request *CounterRequest) (*Counter, error)
+	GetCounterContext(ctx context.Context, name string) (*Counter, error)
+	IncrementCounterContext(ctx context.Context, name string, count int) (*CounterRange, error)
 }
 
 type Stats struct {
-	NumUUIDs    int       `json:"numUuids"`
-	NumRequests int       `json:"numRequests"`
-	CreatedOn   time.Time `json:"createdOn"`
+	NumUUIDs      int       `json:"numUuids"`
+	NumRequests   int       `json:"numRequests"`
+	NumRegistered int       `json:"numRegistered"`
+	CreatedOn     time.Time `json:"createdOn"`
+}
+
+// DefaultMaxCount is the largest count a single POST to /uuids accepts,
+// unless the server says otherwise in its Capabilities.
+const DefaultMaxCount = 255
+
+// Capabilities describes the limits of a server.
+type Capabilities struct {
+	MaxCount int `json:"maxCount"`
+}
+
+// Registration is the body of a POST to /registrations: IDs that a client
+// generated locally while the service was unavailable.
+type Registration struct {
+	Uuids []string `json:"uuids"`
+}
+
+//---------------------------------------------------------------------------
+
+// ValidUuid reports whether s is in the canonical
+// "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx" form, with lowercase hex digits.
+func ValidUuid(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ValidUuidV4 reports whether s is a canonical random (version 4, variant 10) UUID.
+func ValidUuidV4(s string) bool {
+	if !ValidUuid(s) {
+		return false
+	}
+	if s[14] != '4' {
+		return false
+	}
+	switch s[19] {
+	case '8', '9', 'a', 'b':
+		return true
+	}
+	return false
 }
 
 //---------------------------------------------------------------------------
@@ -41,4 +111,28 @@ type Stats struct {
 func init() {
 	piazza.JsonResponseDataTypes["*uuidgen.Stats"] = "uuidstats"
 	piazza.JsonResponseDataTypes["uuidgen.Stats"] = "uuidstats"
+	piazza.JsonResponseDataTypes["*uuidgen.Capabilities"] = "uuidcapabilities"
+	piazza.JsonResponseDataTypes["*uuidgen.HealthReport"] = "uuiddiagnostics"
+	piazza.JsonResponseDataTypes["*uuidgen.Reservation"] = "uuidreservation"
+	piazza.JsonResponseDataTypes["[]*uuidgen.Reservation"] = "uuidreservation-list"
+	piazza.JsonResponseDataTypes["*uuidgen.IdRecord"] = "uuidrecord"
+	piazza.JsonResponseDataTypes["[]*uuidgen.IdRecord"] = "uuidrecord-list"
+	piazza.JsonResponseDataTypes["*uuidgen.BulkRevocation"] = "uuidbulkrevocation"
+	piazza.JsonResponseDataTypes["*uuidgen.ClaimResult"] = "uuidclaimresult"
+	piazza.JsonResponseDataTypes["*uuidgen.IdPack"] = "uuidpack"
+	piazza.JsonResponseDataTypes["*uuidgen.PackReconciliation"] = "uuidpackreconciliation"
+	piazza.JsonResponseDataTypes["[]uuidgen.SignedUuid"] = "uuidsigned-list"
+	piazza.JsonResponseDataTypes["*uuidgen.Verification"] = "uuidverification"
+	piazza.JsonResponseDataTypes["*uuidgen.KeyList"] = "uuidkeys"
+	piazza.JsonResponseDataTypes["*uuidgen.TypedId"] = "uuidtyped"
+	piazza.JsonResponseDataTypes["[]uuidgen.TypedId"] = "uuidtyped-list"
+	piazza.JsonResponseDataTypes["[]uuidgen.TypePrefix"] = "uuidprefix-list"
+	piazza.JsonResponseDataTypes["*uuidgen.ShortIdStatus"] = "uuidshortid"
+	piazza.JsonResponseDataTypes["*uuidgen.GeoCell"] = "uuidgeocell"
+	piazza.JsonResponseDataTypes["*uuidgen.Counter"] = "uuidcounter"
+	piazza.JsonResponseDataTypes["*uuidgen.CounterRange"] = "uuidcounterrange"
+	piazza.JsonResponseDataTypes["*uuidgen.BlockLease"] = "uuidblocklease"
+	piazza.JsonResponseDataTypes["*uuidgen.IntRange"] = "uuidintrange"
+	piazza.JsonResponseDataTypes["*uuidgen.Nonce"] = "uuidnonce"
+	piazza.JsonResponseDataTypes["[]*uuidgen.Nonce"] = "uuidnonce-list"
 }
@@ -0,0 +1,144 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package uuidgentest runs the real pz-uuidgen routes in-process, on an
+// ephemeral port, for use in other services' integration tests.
+package uuidgentest
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"github.com/venicegeo/pz-uuidgen/uuidgen"
+)
+
+// MemoryWriter is an in-memory log writer that is safe for concurrent use.
+type MemoryWriter struct {
+	sync.Mutex
+	pzsyslog.LocalReaderWriter
+}
+
+func (w *MemoryWriter) Write(mssg *pzsyslog.Message, async bool) error {
+	w.Lock()
+	defer w.Unlock()
+	return w.LocalReaderWriter.Write(mssg, async)
+}
+
+func (w *MemoryWriter) Read(count int) ([]pzsyslog.Message, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.LocalReaderWriter.Read(count)
+}
+
+//---------------------------------------------------------------------
+
+// Server is a running pz-uuidgen instance.
+type Server struct {
+	Url         string
+	Client      *uuidgen.Client
+	Service     *uuidgen.Service
+	LogWriter   *MemoryWriter
+	AuditWriter *MemoryWriter
+	http        *httptest.Server
+}
+
+// NewServer starts a server on an ephemeral port and returns it with a
+// client already connected to it. Call Close when done.
+func NewServer() (*Server, error) {
+	return NewServerWithOptions(&uuidgen.ServiceOptions{})
+}
+
+// NewServerWithOptions is NewServer with a non-default service configuration,
+// e.g. a seeded random source.
+func NewServerWithOptions(options *uuidgen.ServiceOptions) (*Server, error) {
+	var err error
+
+	server := &Server{
+		LogWriter:   &MemoryWriter{},
+		AuditWriter: &MemoryWriter{},
+	}
+
+	sys := &piazza.SystemConfig{Name: piazza.PzUuidgen}
+
+	server.Service = &uuidgen.Service{}
+	err = server.Service.InitWithOptions(sys, server.LogWriter, server.AuditWriter, options)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := &uuidgen.Server{}
+	err = routes.Init(server.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := newRouter(routes.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	server.http = httptest.NewServer(router)
+	server.Url = server.http.URL
+
+	server.Client, err = uuidgen.NewClient(server.Url, "")
+	if err != nil {
+		server.http.Close()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// Start is NewServer for callers that only need the client: it returns the
+// client and a function that shuts the server down.
+func Start() (*uuidgen.Client, func(), error) {
+	server, err := NewServer()
+	if err != nil {
+		return nil, nil, err
+	}
+	return server.Client, server.Close, nil
+}
+
+func (server *Server) Close() {
+	server.http.Close()
+}
+
+// newRouter does what piazza.GenericServer.Configure does, without the
+// SystemConfig and the fixed port that comes with it.
+func newRouter(routeData []piazza.RouteData) (*gin.Engine, error) {
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	for _, data := range routeData {
+		switch data.Verb {
+		case "GET":
+			router.GET(data.Path, data.Handler)
+		case "POST":
+			router.POST(data.Path, data.Handler)
+		case "PUT":
+			router.PUT(data.Path, data.Handler)
+		case "DELETE":
+			router.DELETE(data.Path, data.Handler)
+		default:
+			return nil, errors.New("Invalid verb: " + data.Verb)
+		}
+	}
+
+	return router, nil
+}
@@ -0,0 +1,996 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uuidgentest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"github.com/venicegeo/pz-uuidgen/uuidgen"
+)
+
+func TestParallelServers(t *testing.T) {
+	assert := assert.New(t)
+
+	a, err := NewServer()
+	assert.NoError(err)
+	defer a.Close()
+
+	client, cleanup, err := Start()
+	assert.NoError(err)
+	defer cleanup()
+
+	assert.NotEqual(a.Url, "")
+
+	uuids, err := a.Client.PostUuids(10)
+	assert.NoError(err)
+	assert.Len(*uuids, 10)
+
+	uuid, err := client.GetUUID()
+	assert.NoError(err)
+	assert.True(uuidgen.ValidUuidV4(uuid))
+
+	stats, err := a.Client.GetStats()
+	assert.NoError(err)
+	assert.Equal(10, stats.NumUUIDs)
+
+	stats, err = client.GetStats()
+	assert.NoError(err)
+	assert.Equal(1, stats.NumUUIDs)
+
+	messages, err := a.LogWriter.Read(100)
+	assert.NoError(err)
+	assert.NotEmpty(messages)
+}
+
+type brokenSource struct{}
+
+func (brokenSource) Read(b []byte) (int, error) {
+	return 0, errors.New("device unplugged")
+}
+
+func TestRandomSources(t *testing.T) {
+	assert := assert.New(t)
+
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{Random: uuidgen.NewSeededSource(7)})
+	assert.NoError(err)
+	defer a.Close()
+	b, err := NewServerWithOptions(&uuidgen.ServiceOptions{Random: uuidgen.NewSeededSource(7)})
+	assert.NoError(err)
+	defer b.Close()
+
+	ua, err := a.Client.PostUuids(5)
+	assert.NoError(err)
+	ub, err := b.Client.PostUuids(5)
+	assert.NoError(err)
+	assert.Equal(*ua, *ub)
+
+	broken, err := NewServerWithOptions(&uuidgen.ServiceOptions{Random: brokenSource{}})
+	assert.NoError(err)
+	defer broken.Close()
+
+	_, err = broken.Client.GetUUID()
+	assert.Error(err)
+	assert.Contains(err.Error(), "503")
+}
+
+// stuckSource is healthy for a while, then returns nothing but zeros.
+type stuckSource struct {
+	good    *uuidgen.SeededSource
+	healthy int
+}
+
+func (src *stuckSource) Read(b []byte) (int, error) {
+	if src.healthy > 0 {
+		src.healthy -= len(b)
+		return src.good.Read(b)
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func getDiagnostics(url string) (*uuidgen.HealthReport, error) {
+	resp, err := http.Get(url + "/admin/diagnostics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	report := &uuidgen.HealthReport{}
+	jresp := &piazza.JsonResponse{Data: report}
+	err = json.NewDecoder(resp.Body).Decode(jresp)
+	if err != nil {
+		return nil, err
+	}
+	if jresp.Type != "uuiddiagnostics" {
+		return nil, errors.New("unexpected type: " + jresp.Type)
+	}
+	return report, nil
+}
+
+func TestHealthChecks(t *testing.T) {
+	assert := assert.New(t)
+
+	src := &stuckSource{good: uuidgen.NewSeededSource(11), healthy: 4096 + 16*100}
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{Random: src})
+	assert.NoError(err)
+	defer a.Close()
+
+	report, err := getDiagnostics(a.Url)
+	assert.NoError(err)
+	assert.True(report.Healthy)
+	assert.True(report.KnownAnswerTests)
+	assert.True(report.StartupTests)
+	assert.EqualValues(4096, report.BytesTested)
+
+	_, err = a.Client.PostUuids(100)
+	assert.NoError(err)
+
+	// the source is now stuck
+	_, err = a.Client.GetUUID()
+	assert.Error(err)
+	assert.Contains(err.Error(), "503")
+
+	report, err = getDiagnostics(a.Url)
+	assert.NoError(err)
+	assert.False(report.Healthy)
+	assert.Contains(report.Failure, "repetition count")
+
+	messages, err := a.LogWriter.Read(100)
+	assert.NoError(err)
+	fatal := 0
+	for _, m := range messages {
+		if m.Severity == pzsyslog.Fatal && strings.Contains(m.Message, "health tests") {
+			fatal++
+		}
+	}
+	assert.Equal(1, fatal)
+
+	// a source that is bad from the start never issues an ID
+	b, err := NewServerWithOptions(&uuidgen.ServiceOptions{Random: &stuckSource{}})
+	assert.NoError(err)
+	defer b.Close()
+
+	report, err = getDiagnostics(b.Url)
+	assert.NoError(err)
+	assert.False(report.Healthy)
+	assert.True(report.KnownAnswerTests)
+	assert.False(report.StartupTests)
+
+	_, err = b.Client.GetUUID()
+	assert.Error(err)
+	assert.Contains(err.Error(), "503")
+}
+
+// postWithKey makes a POST /uuids with an idempotency key.
+func postWithKey(url string, key string, count int) (int, []string, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/uuids?count=%d", url, count), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set(uuidgen.IdempotencyHeader, key)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	var uuids []string
+	jresp := &piazza.JsonResponse{Data: &uuids}
+	err = json.NewDecoder(resp.Body).Decode(jresp)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, uuids, nil
+}
+
+func TestIdempotency(t *testing.T) {
+	assert := assert.New(t)
+
+	index := uuidgen.NewMockDocumentIndex()
+	options := &uuidgen.ServiceOptions{IdempotencyIndex: index, IdempotencyWindow: 200 * time.Millisecond}
+
+	a, err := NewServerWithOptions(options)
+	assert.NoError(err)
+	defer a.Close()
+
+	code, first, err := postWithKey(a.Url, "job-17", 5)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, code)
+	assert.Len(first, 5)
+
+	code, again, err := postWithKey(a.Url, "job-17", 5)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, code)
+	assert.Equal(first, again)
+
+	code, _, err = postWithKey(a.Url, "job-17", 6)
+	assert.NoError(err)
+	assert.Equal(http.StatusConflict, code)
+
+	code, other, err := postWithKey(a.Url, "job-18", 5)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, code)
+	assert.NotEqual(first, other)
+
+	stats, err := a.Client.GetStats()
+	assert.NoError(err)
+	assert.Equal(10, stats.NumUUIDs)
+
+	// a second instance sharing the index knows the key
+	b, err := NewServerWithOptions(options)
+	assert.NoError(err)
+	defer b.Close()
+
+	code, again, err = postWithKey(b.Url, "job-17", 5)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, code)
+	assert.Equal(first, again)
+
+	// and after the window, it's forgotten
+	time.Sleep(300 * time.Millisecond)
+	code, again, err = postWithKey(a.Url, "job-17", 5)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, code)
+	assert.NotEqual(first, again)
+
+	code, _, err = postWithKey(a.Url, "bad key", 5)
+	assert.NoError(err)
+	assert.Equal(http.StatusBadRequest, code)
+}
+
+func TestReservations(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, err := NewServer()
+	assert.NoError(err)
+	defer a.Close()
+
+	res, err := a.Client.ReserveContext(ctx, 4, time.Minute)
+	assert.NoError(err)
+	assert.Len(res.Uuids, 4)
+	assert.Equal(uuidgen.IdReserved, res.State)
+
+	// confirm some, release the rest
+	res, err = a.Client.ConfirmContext(ctx, res.Id, res.Uuids[0], res.Uuids[1])
+	assert.NoError(err)
+	assert.Equal(uuidgen.ReservationMixed, res.State)
+	assert.Equal(uuidgen.IdConfirmed, res.States[res.Uuids[0]])
+	assert.Equal(uuidgen.IdReserved, res.States[res.Uuids[2]])
+
+	res, err = a.Client.ReleaseContext(ctx, res.Id, res.Uuids[2], res.Uuids[3])
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdReleased, res.States[res.Uuids[3]])
+
+	// confirmed can't be released, nor released confirmed
+	_, err = a.Client.ReleaseContext(ctx, res.Id, res.Uuids[0])
+	assert.Error(err)
+	assert.Contains(err.Error(), "409")
+	_, err = a.Client.ConfirmContext(ctx, res.Id)
+	assert.Error(err)
+	assert.Contains(err.Error(), "409")
+
+	// IDs from elsewhere are refused
+	_, err = a.Client.ConfirmContext(ctx, res.Id, "0f8fad5b-d9cb-469f-a165-70867728950e")
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+
+	_, err = a.Client.GetReservationContext(ctx, "nonesuch")
+	assert.Error(err)
+	assert.Contains(err.Error(), "404")
+
+	// unconfirmed IDs are abandoned at expiry
+	short, err := a.Client.ReserveContext(ctx, 2, 50*time.Millisecond)
+	assert.NoError(err)
+	time.Sleep(100 * time.Millisecond)
+
+	short, err = a.Client.GetReservationContext(ctx, short.Id)
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdAbandoned, short.State)
+	_, err = a.Client.ConfirmContext(ctx, short.Id)
+	assert.Error(err)
+	assert.Contains(err.Error(), "409")
+
+	list, err := getReservations(a.Url, "abandoned")
+	assert.NoError(err)
+	assert.Len(list, 1)
+	assert.Equal(short.Id, list[0].Id)
+
+	list, err = getReservations(a.Url, "")
+	assert.NoError(err)
+	assert.Len(list, 2)
+}
+
+func getReservations(url string, state string) ([]uuidgen.Reservation, error) {
+	resp, err := http.Get(url + "/reservations?state=" + state)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list []uuidgen.Reservation
+	jresp := &piazza.JsonResponse{Data: &list}
+	err = json.NewDecoder(resp.Body).Decode(jresp)
+	if err != nil {
+		return nil, err
+	}
+	if jresp.Type != "uuidreservation-list" {
+		return nil, errors.New("unexpected type: " + jresp.Type)
+	}
+	return list, nil
+}
+
+func TestRevocations(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{AdminKey: "secret"})
+	assert.NoError(err)
+	defer a.Close()
+	admin, err := uuidgen.NewClient(a.Url, "secret")
+	assert.NoError(err)
+
+	res, err := a.Client.ReserveContext(ctx, 2, time.Minute)
+	assert.NoError(err)
+	uuid := res.Uuids[0]
+
+	// revoking needs the admin key
+	_, err = a.Client.RevokeContext(ctx, uuid, "mallory", "spite")
+	assert.Error(err)
+	assert.Contains(err.Error(), "403")
+	_, err = a.Client.RevokeAllContext(ctx, []string{uuid}, "mallory", "spite")
+	assert.Error(err)
+	assert.Contains(err.Error(), "403")
+
+	// IDs in upper case are the same IDs, as for claims
+	record, err := admin.RevokeContext(ctx, strings.ToUpper(uuid), "alice", "data spill 42")
+	assert.NoError(err)
+	assert.True(record.Revoked)
+	assert.Equal(uuidgen.IdReserved, record.State)
+
+	record, err = a.Client.GetIdContext(ctx, strings.ToUpper(uuid))
+	assert.NoError(err)
+	assert.True(record.Revoked)
+	assert.Equal("alice", record.Revocation.Actor)
+	assert.Equal("data spill 42", record.Revocation.Reason)
+
+	// a revoked ID can't be confirmed
+	_, err = a.Client.ConfirmContext(ctx, res.Id, uuid)
+	assert.Error(err)
+	assert.Contains(err.Error(), "409")
+
+	// the reason is required
+	_, err = admin.RevokeContext(ctx, uuid, "alice", "")
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+
+	_, err = a.Client.UnrevokeContext(ctx, uuid, "mallory", "spite")
+	assert.Error(err)
+	assert.Contains(err.Error(), "403")
+	record, err = admin.UnrevokeContext(ctx, uuid, "bob", "false alarm")
+	assert.NoError(err)
+	assert.False(record.Revoked)
+	_, err = admin.UnrevokeContext(ctx, uuid, "bob", "again")
+	assert.Error(err)
+	assert.Contains(err.Error(), "404")
+
+	// IDs we didn't issue can be revoked too
+	other := "0f8fad5b-d9cb-469f-a165-70867728950e"
+	_, err = a.Client.GetIdContext(ctx, other)
+	assert.Error(err)
+	assert.Contains(err.Error(), "404")
+
+	bulk, err := admin.RevokeAllContext(ctx, []string{other, res.Uuids[1], "junk"}, "alice", "spill")
+	assert.NoError(err)
+	assert.Equal(2, bulk.Revoked)
+	assert.Equal([]string{"junk"}, bulk.Invalid)
+
+	record, err = a.Client.GetIdContext(ctx, other)
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdUnknown, record.State)
+	assert.True(record.Revoked)
+
+	// as a text file
+	file := "# purge list\n" + other + "\n\n" + uuid + "\n"
+	req, err := http.NewRequest("POST", a.Url+"/revocations?actor=carol&reason=purge", strings.NewReader(file))
+	assert.NoError(err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.SetBasicAuth("secret", "")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	result := &uuidgen.BulkRevocation{}
+	err = json.NewDecoder(resp.Body).Decode(&piazza.JsonResponse{Data: result})
+	resp.Body.Close()
+	assert.NoError(err)
+	assert.Equal(1, result.Revoked)
+	assert.Equal(1, result.AlreadyRevoked)
+
+	// and as a form upload
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "purge.txt")
+	assert.NoError(err)
+	_, _ = part.Write([]byte(res.Uuids[1] + "\n"))
+	_ = form.WriteField("actor", "carol")
+	_ = form.WriteField("reason", "purge")
+	assert.NoError(form.Close())
+	req, err = http.NewRequest("POST", a.Url+"/revocations", &body)
+	assert.NoError(err)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("secret", "")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	result = &uuidgen.BulkRevocation{}
+	err = json.NewDecoder(resp.Body).Decode(&piazza.JsonResponse{Data: result})
+	resp.Body.Close()
+	assert.NoError(err)
+	assert.Equal(1, result.AlreadyRevoked)
+
+	// everything is in the audit trail
+	messages, err := a.AuditWriter.Read(100)
+	assert.NoError(err)
+	actions := map[string]int{}
+	for _, m := range messages {
+		if m.AuditData != nil {
+			actions[m.AuditData.Action]++
+		}
+	}
+	assert.Equal(4, actions["revoke"])
+	assert.Equal(1, actions["unrevoke"])
+}
+
+func TestClaims(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{AdminKey: "secret"})
+	assert.NoError(err)
+	defer a.Close()
+	admin, err := uuidgen.NewClient(a.Url, "secret")
+	assert.NoError(err)
+
+	// plain issued IDs are noted as issued; reserved ones are recorded
+	issued, err := a.Client.PostUuids(1)
+	assert.NoError(err)
+	record, err := a.Client.GetIdContext(ctx, (*issued)[0])
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdIssued, record.State)
+	res, err := a.Client.ReserveContext(ctx, 1, time.Minute)
+	assert.NoError(err)
+	reserved := res.Uuids[0]
+
+	mine := "6ba7b810-9dad-11d1-80b4-00c04fd430c8" // version 1, from a partner
+	theirs := "6ba7b811-9dad-11d1-80b4-00c04fd430c8"
+	revoked := "6ba7b812-9dad-11d1-80b4-00c04fd430c8"
+
+	_, err = admin.RevokeContext(ctx, revoked, "alice", "spill")
+	assert.NoError(err)
+
+	result, err := a.Client.ClaimContext(ctx, []string{theirs}, "partner-b")
+	assert.NoError(err)
+	assert.Equal([]string{theirs}, result.Claimed)
+
+	result, err = a.Client.ClaimContext(ctx, []string{
+		strings.ToUpper(mine), theirs, revoked, reserved, (*issued)[0], "not-a-uuid", "00000000-0000-0000-0000-000000000000",
+	}, "partner-a")
+	assert.NoError(err)
+	assert.Equal([]string{mine}, result.Claimed)
+	assert.Len(result.Invalid, 2)
+	reasons := map[string]string{}
+	for _, c := range result.Conflicts {
+		reasons[c.Uuid] = c.Reason
+	}
+	assert.Equal("claimed", reasons[theirs])
+	assert.Equal("revoked", reasons[revoked])
+	assert.Equal("reserved", reasons[reserved])
+	assert.Equal("issued", reasons[(*issued)[0]])
+
+	// claiming again is harmless
+	result, err = a.Client.ClaimContext(ctx, []string{mine}, "partner-a")
+	assert.NoError(err)
+	assert.Equal([]string{mine}, result.Claimed)
+
+	// claimed IDs are looked up and revoked like issued ones
+	record, err = a.Client.GetIdContext(ctx, mine)
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdClaimed, record.State)
+	assert.Equal("partner-a", record.Owner)
+
+	record, err = admin.RevokeContext(ctx, mine, "alice", "spill")
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdClaimed, record.State)
+	assert.True(record.Revoked)
+
+	_, err = a.Client.ClaimContext(ctx, []string{mine}, "")
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+
+	stats, err := a.Client.GetStats()
+	assert.NoError(err)
+	assert.Equal(2, stats.NumRegistered)
+}
+
+func TestPacks(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	ring, err := uuidgen.ParseKeyRing("k1:" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123")))
+	assert.NoError(err)
+
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{Keys: ring, AdminKey: "secret"})
+	assert.NoError(err)
+	defer a.Close()
+
+	_, err = a.Client.ExportPackContext(ctx, &uuidgen.PackRequest{Count: 5, IssuedTo: "team-7"})
+	assert.Error(err)
+	assert.Contains(err.Error(), "403")
+
+	admin, err := uuidgen.NewClient(a.Url, "secret")
+	assert.NoError(err)
+
+	pack, err := admin.ExportPackContext(ctx, &uuidgen.PackRequest{Count: 5, IssuedTo: "team-7", Validity: "72h"})
+	assert.NoError(err)
+	assert.Len(pack.Uuids, 5)
+	assert.Equal("k1", pack.KeyId)
+	assert.Equal("team-7", pack.IssuedTo)
+	assert.NoError(uuidgen.VerifyPack(ring, pack))
+
+	tampered := *pack
+	tampered.ValidUntil = tampered.ValidUntil.Add(time.Hour)
+	assert.Error(uuidgen.VerifyPack(ring, &tampered))
+
+	// an empty or cut-short signature is no signature
+	tag, err := base64.StdEncoding.DecodeString(pack.Signature)
+	assert.NoError(err)
+	for _, n := range []int{0, 1, len(tag) - 1} {
+		truncated := *pack
+		truncated.Signature = base64.StdEncoding.EncodeToString(tag[:n])
+		assert.Error(uuidgen.VerifyPack(ring, &truncated), "length %d", n)
+	}
+
+	other := "0f8fad5b-d9cb-469f-a165-70867728950e"
+	result, err := a.Client.ReconcilePackContext(ctx, pack.Id, []string{pack.Uuids[0], pack.Uuids[1], other})
+	assert.NoError(err)
+	assert.Equal(2, result.Used)
+	assert.Equal(pack.Uuids[2:], result.Unused)
+	assert.Equal([]string{other}, result.Unknown)
+	assert.False(result.Expired)
+
+	record, err := a.Client.GetIdContext(ctx, pack.Uuids[0])
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdConfirmed, record.State)
+	record, err = a.Client.GetIdContext(ctx, pack.Uuids[4])
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdReleased, record.State)
+
+	_, err = a.Client.ReconcilePackContext(ctx, pack.Id, nil)
+	assert.Error(err)
+	assert.Contains(err.Error(), "409")
+}
+
+func TestSignedUuids(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	ring, err := uuidgen.ParseKeyRing("k1:" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123")))
+	assert.NoError(err)
+
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{Keys: ring, AdminKey: "secret"})
+	assert.NoError(err)
+	defer a.Close()
+
+	embedded, err := a.Client.PostSignedUuidsContext(ctx, 3, uuidgen.SignEmbedded)
+	assert.NoError(err)
+	assert.Len(embedded, 3)
+	tokens, err := a.Client.PostSignedUuidsContext(ctx, 3, uuidgen.SignToken)
+	assert.NoError(err)
+	assert.NotEqual("", tokens[0].Token)
+
+	// checked locally, with the keys, and by the service
+	keyId, err := uuidgen.VerifyUuid(ring, embedded[0].Uuid)
+	assert.NoError(err)
+	assert.Equal("k1", keyId)
+	result, err := a.Client.VerifyContext(ctx, tokens[1].Uuid, tokens[1].Token)
+	assert.NoError(err)
+	assert.True(result.Valid)
+	result, err = a.Client.VerifyContext(ctx, tokens[1].Uuid, tokens[2].Token)
+	assert.NoError(err)
+	assert.False(result.Valid)
+
+	// like other issued IDs, signed ones are noted as issued, and keep
+	// that state when revoked
+	record, err := a.Client.GetIdContext(ctx, embedded[2].Uuid)
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdIssued, record.State)
+	admin, err := uuidgen.NewClient(a.Url, "secret")
+	assert.NoError(err)
+	record, err = admin.RevokeContext(ctx, embedded[2].Uuid, "alice", "spill")
+	assert.NoError(err)
+	assert.True(record.Revoked)
+	assert.Equal(uuidgen.IdIssued, record.State)
+
+	// rotation needs the admin key
+	newKey := &uuidgen.NewKey{Id: "k2", Key: base64.StdEncoding.EncodeToString([]byte("another key of 16+ bytes"))}
+	resp, err := http.Post(a.Url+"/admin/keys", "application/json", strings.NewReader(`{"id":"k2","key":"`+newKey.Key+`"}`))
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	req, _ := http.NewRequest("POST", a.Url+"/admin/keys", strings.NewReader(`{"id":"k2","key":"`+newKey.Key+`"}`))
+	req.SetBasicAuth("secret", "")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("k2", ring.CurrentId())
+
+	rotated, err := admin.PostSignedUuidsContext(ctx, 1, uuidgen.SignEmbedded)
+	assert.NoError(err)
+	result, err = admin.VerifyContext(ctx, rotated[0].Uuid, "")
+	assert.NoError(err)
+	assert.Equal("k2", result.KeyId)
+	result, err = admin.VerifyContext(ctx, embedded[0].Uuid, "")
+	assert.NoError(err)
+	assert.Equal("k1", result.KeyId)
+
+	req, _ = http.NewRequest("DELETE", a.Url+"/admin/keys/k1", nil)
+	req.SetBasicAuth("secret", "")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	result, err = admin.VerifyContext(ctx, embedded[0].Uuid, "")
+	assert.NoError(err)
+	assert.False(result.Valid)
+}
+
+func TestTypedUuids(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{AdminKey: "secret"})
+	assert.NoError(err)
+	defer a.Close()
+
+	ids, err := a.Client.PostTypedUuidsContext(ctx, "job", 5)
+	assert.NoError(err)
+	assert.Len(ids, 5)
+	for _, id := range ids {
+		assert.True(strings.HasPrefix(id.Id, "job_"))
+		assert.Equal("job", id.Kind)
+
+		typed, err := uuidgen.ParseTypedId(id.Id)
+		assert.NoError(err)
+		assert.Equal(id.Uuid, typed.Uuid)
+
+		// the UUID underneath is issued like any other
+		record, err := a.Client.GetIdContext(ctx, id.Uuid)
+		assert.NoError(err)
+		assert.Equal(uuidgen.IdIssued, record.State)
+	}
+
+	_, err = a.Client.PostTypedUuidsContext(ctx, "dataset", 1)
+	assert.Error(err)
+
+	resp, err := http.Get(a.Url + "/typed-uuids/" + ids[0].Id)
+	assert.NoError(err)
+	var parsed struct {
+		Type string          `json:"type"`
+		Data uuidgen.TypedId `json:"data"`
+	}
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&parsed))
+	resp.Body.Close()
+	assert.Equal("uuidtyped", parsed.Type)
+	assert.Equal(ids[0], parsed.Data)
+
+	// the registry changes at runtime, with the admin key
+	body := `{"prefix":"ds","kind":"dataset"}`
+	resp, err = http.Post(a.Url+"/admin/prefixes", "application/json", strings.NewReader(body))
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	req, _ := http.NewRequest("POST", a.Url+"/admin/prefixes", strings.NewReader(body))
+	req.SetBasicAuth("secret", "")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	ds, err := a.Client.PostTypedUuidsContext(ctx, "ds", 1)
+	assert.NoError(err)
+	assert.Equal("dataset", ds[0].Kind)
+
+	req, _ = http.NewRequest("DELETE", a.Url+"/admin/prefixes/ds", nil)
+	req.SetBasicAuth("secret", "")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	_, err = a.Client.PostTypedUuidsContext(ctx, "ds", 1)
+	assert.Error(err)
+	resp, err = http.Get(a.Url + "/typed-uuids/" + ds[0].Id)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestShortIds(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, err := NewServer()
+	assert.NoError(err)
+	defer a.Close()
+
+	ids, err := a.Client.PostShortIdsContext(ctx, &uuidgen.ShortIdRequest{Count: 100, Scope: "space-1"})
+	assert.NoError(err)
+	assert.Len(ids, 100)
+	for _, id := range ids {
+		// the check character may be any of "*~$=U"
+		status, err := a.Client.GetShortIdContext(ctx, strings.ToLower(id), "space-1")
+		assert.NoError(err)
+		assert.True(status.Valid, id)
+		assert.True(status.Issued, id)
+		assert.Equal(id, status.Id)
+	}
+
+	words, err := a.Client.PostShortIdsContext(ctx, &uuidgen.ShortIdRequest{Format: uuidgen.ShortWords, Length: 4})
+	assert.NoError(err)
+	assert.Len(strings.Split(words[0], "-"), 5)
+
+	status, err := a.Client.GetShortIdContext(ctx, words[0], "space-1")
+	assert.NoError(err)
+	assert.True(status.Valid)
+	assert.False(status.Issued)
+
+	status, err = a.Client.GetShortIdContext(ctx, "7KQM3XRAZ", "")
+	assert.NoError(err)
+	assert.False(status.Valid)
+	assert.NotEqual("", status.Reason)
+
+	_, err = a.Client.PostShortIdsContext(ctx, &uuidgen.ShortIdRequest{Length: 99})
+	assert.Error(err)
+
+	// no body: one base32 ID, in the global scope
+	resp, err := http.Post(a.Url+"/short-ids", "application/json", nil)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+}
+
+func TestChildren(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{AdminKey: "secret"})
+	assert.NoError(err)
+	defer a.Close()
+
+	root, err := a.Client.GetUUIDContext(ctx)
+	assert.NoError(err)
+
+	children, err := a.Client.ChildrenContext(ctx, root, &uuidgen.ChildRequest{Count: 2})
+	assert.NoError(err)
+	want, _ := uuidgen.ChildUuid(root, 2)
+	assert.Equal(want, children[1])
+
+	grandchildren, err := a.Client.ChildrenContext(ctx, children[0], &uuidgen.ChildRequest{Mode: uuidgen.ChildRandom})
+	assert.NoError(err)
+
+	records, err := a.Client.GetChildrenContext(ctx, root)
+	assert.NoError(err)
+	assert.Len(records, 2)
+
+	ancestors, err := a.Client.GetAncestryContext(ctx, grandchildren[0])
+	assert.NoError(err)
+	assert.Len(ancestors, 2)
+	assert.Equal(children[0], ancestors[0].Uuid)
+	assert.Equal(root, ancestors[1].Uuid)
+
+	record, err := a.Client.GetIdContext(ctx, grandchildren[0])
+	assert.NoError(err)
+	assert.Equal(children[0], record.Parent)
+
+	// a revoked parent gets no more children
+	admin, err := uuidgen.NewClient(a.Url, "secret")
+	assert.NoError(err)
+	_, err = admin.RevokeContext(ctx, children[1], "alice", "spill")
+	assert.NoError(err)
+	_, err = a.Client.ChildrenContext(ctx, children[1], nil)
+	assert.Error(err)
+}
+
+func TestGeoUuids(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, err := NewServer()
+	assert.NoError(err)
+	defer a.Close()
+
+	uuids, err := a.Client.PostGeoUuidsContext(ctx, 2, uuidgen.GeoGeohash, 7, 57.64911, 10.40744)
+	assert.NoError(err)
+	assert.Len(uuids, 2)
+	cell, err := uuidgen.DecodeGeoUuid(uuids[0])
+	assert.NoError(err)
+	assert.Equal("u4pruyd", cell.Cell)
+
+	uuids, err = a.Client.PostGeoUuidsBboxContext(ctx, 1, uuidgen.GeoQuadkey, 0, [4]float64{-45, 0.5, -22.5, 40.97})
+	assert.NoError(err)
+	cell, err = uuidgen.DecodeGeoUuid(uuids[0])
+	assert.NoError(err)
+	assert.Equal(uuidgen.GeoQuadkey, cell.Scheme)
+	assert.Equal("0", cell.Cell[:1])
+
+	record, err := a.Client.GetIdContext(ctx, uuids[0])
+	assert.NoError(err)
+	assert.Equal(uuidgen.IdIssued, record.State)
+
+	_, err = a.Client.PostGeoUuidsContext(ctx, 1, "h3", 0, 0, 0)
+	assert.Error(err)
+}
+
+func TestCounters(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// two instances sharing one durable store
+	store, err := uuidgen.NewElasticCounterStore(uuidgen.NewMockDocumentIndex())
+	assert.NoError(err)
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{Counters: store})
+	assert.NoError(err)
+	defer a.Close()
+	b, err := NewServerWithOptions(&uuidgen.ServiceOptions{Counters: store})
+	assert.NoError(err)
+	defer b.Close()
+
+	counter, err := a.Client.CreateCounterContext(ctx, &uuidgen.CounterRequest{Name: "space-1.jobs", Format: "JOB-%06d", Start: 123})
+	assert.NoError(err)
+	assert.Equal("JOB-%06d", counter.Format)
+
+	_, err = b.Client.CreateCounterContext(ctx, &uuidgen.CounterRequest{Name: "space-1.jobs"})
+	assert.Error(err)
+	_, err = a.Client.CreateCounterContext(ctx, &uuidgen.CounterRequest{Name: "bad", Format: "%s"})
+	assert.Error(err)
+
+	r, err := a.Client.IncrementCounterContext(ctx, "space-1.jobs", 1)
+	assert.NoError(err)
+	assert.Equal([]string{"JOB-000123"}, r.Values())
+	r, err = b.Client.IncrementCounterContext(ctx, "space-1.jobs", 10)
+	assert.NoError(err)
+	assert.Equal(int64(124), r.First)
+	assert.Equal(int64(133), r.Last)
+
+	counter, err = a.Client.GetCounterContext(ctx, "space-1.jobs")
+	assert.NoError(err)
+	assert.Equal(int64(133), counter.Value)
+
+	_, err = a.Client.IncrementCounterContext(ctx, "space-2.jobs", 1)
+	assert.Error(err)
+	_, err = a.Client.IncrementCounterContext(ctx, "space-1.jobs", uuidgen.MaxCounterIncrement+1)
+	assert.Error(err)
+}
+
+func TestRanges(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// not with counters in memory
+	plain, err := NewServer()
+	assert.NoError(err)
+	defer plain.Close()
+	_, err = plain.Client.LeaseBlockContext(ctx, "orders", 100, "test")
+	assert.Error(err)
+
+	counters, err := uuidgen.NewElasticCounterStore(uuidgen.NewMockDocumentIndex())
+	assert.NoError(err)
+	leases, err := uuidgen.NewElasticLeaseStore(uuidgen.NewMockDocumentIndex())
+	assert.NoError(err)
+	server, err := NewServerWithOptions(&uuidgen.ServiceOptions{Counters: counters, Leases: leases})
+	assert.NoError(err)
+	defer server.Close()
+
+	lease, err := server.Client.LeaseBlockContext(ctx, "orders", 100, "test")
+	assert.NoError(err)
+	assert.Equal(int64(1), lease.First)
+	assert.Equal(int64(100), lease.Last)
+	assert.Equal("test", lease.Holder)
+
+	options := uuidgen.DefaultAllocatorOptions()
+	options.BlockSize = 20
+	options.LowWater = 5
+	allocator, err := uuidgen.NewBlockAllocator(server.Client, "orders", options)
+	assert.NoError(err)
+	first, err := allocator.Next(ctx)
+	assert.NoError(err)
+	assert.True(first > lease.Last)
+	for i := 0; i < 30; i++ {
+		_, err = allocator.Next(ctx)
+		assert.NoError(err)
+	}
+	assert.NoError(allocator.Close())
+
+	released, err := server.Client.ReleaseBlockContext(ctx, lease, 7)
+	assert.NoError(err)
+	assert.Equal(int64(7), *released.Used)
+	_, err = server.Client.ReleaseBlockContext(ctx, lease, 7)
+	assert.Error(err)
+
+	state, err := server.Client.GetRangeContext(ctx, "orders")
+	assert.NoError(err)
+	assert.True(state.Next > first+30)
+	for _, outstanding := range state.Outstanding {
+		assert.NotEqual(lease.Id, outstanding.Id)
+	}
+
+	_, err = server.Client.GetRangeContext(ctx, "missing")
+	assert.Error(err)
+}
+
+func TestNonces(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// two instances sharing one durable store
+	store, err := uuidgen.NewElasticNonceStore(uuidgen.NewMockDocumentIndex())
+	assert.NoError(err)
+	a, err := NewServerWithOptions(&uuidgen.ServiceOptions{Nonces: store})
+	assert.NoError(err)
+	defer a.Close()
+	b, err := NewServerWithOptions(&uuidgen.ServiceOptions{Nonces: store})
+	assert.NoError(err)
+	defer b.Close()
+
+	nonces, err := a.Client.PostNoncesContext(ctx, 2, "upload", time.Minute)
+	assert.NoError(err)
+	assert.Len(nonces, 2)
+	assert.Equal("upload", nonces[0].Scope)
+
+	redeemed, err := b.Client.RedeemNonceContext(ctx, nonces[0].Value, "upload")
+	assert.NoError(err)
+	assert.Equal(nonces[0].Value, redeemed.Value)
+	assert.False(redeemed.RedeemedOn.IsZero())
+
+	_, err = a.Client.RedeemNonceContext(ctx, nonces[0].Value, "upload")
+	assert.Error(err)
+	_, err = a.Client.RedeemNonceContext(ctx, nonces[1].Value, "download")
+	assert.Error(err)
+	_, err = a.Client.RedeemNonceContext(ctx, nonces[1].Value, "upload")
+	assert.NoError(err)
+
+	// the server's default TTL
+	nonces, err = a.Client.PostNoncesContext(ctx, 1, "", 0)
+	assert.NoError(err)
+	assert.Equal(uuidgen.DefaultNonceTTL, nonces[0].ExpiresOn.Sub(nonces[0].IssuedOn))
+}